@@ -0,0 +1,510 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	kubeapi "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	accountKeySecretKey           = "account.key"
+	accountRegistrationsSecretKey = "registrations.json"
+	// accountNextKeySecretKey holds the key an account key rollover is
+	// changing to until the rollover is done, so that the new key isn't lost
+	// if lekube dies after the CA has switched to it.
+	accountNextKeySecretKey = "account-next.key"
+	// accountRegistrationKeysSecretKey holds the PEM encoded keys of the
+	// accounts that aren't registered with account.key, by account name.
+	// They're the accounts of secrets with their own emails and the ones an
+	// account key rollover couldn't change the key of.
+	accountRegistrationKeysSecretKey = "registration-keys.json"
+	// accountRegistrationNextKeysSecretKey is registration-keys.json's
+	// account-next.key. It holds the keys the accounts of secrets with their
+	// own emails are changing to.
+	accountRegistrationNextKeysSecretKey = "registration-next-keys.json"
+)
+
+// accountStore keeps the ACME account key and the account URIs it has been
+// registered under in a Kubernetes Secret. Generating a new account key on
+// every boot meant every restart of lekube created a new ACME account, burning
+// through the CA's new account rate limits and orphaning the old accounts.
+type accountStore struct {
+	client corev1.SecretInterface
+	name   string
+}
+
+func newAccountStore(client corev1.SecretInterface, name string) *accountStore {
+	return &accountStore{client: client, name: name}
+}
+
+// persistedAccount is the account key and the account URIs registered with it,
+// keyed by account name (see acmeCA.account).
+type persistedAccount struct {
+	key           *rsa.PrivateKey
+	registrations map[string]string
+	// keys are the keys of the accounts that aren't registered with key, by
+	// account name.
+	keys map[string]*rsa.PrivateKey
+	// keyCreatedAt is the zero time if it's not known when the key was
+	// generated.
+	keyCreatedAt time.Time
+}
+
+// LoadOrCreate returns the account stored in the account Secret. If the Secret
+// doesn't exist or has no account key in it, a new key is generated and stored
+// before being returned. If an account key rollover was interrupted, the CAs
+// are asked with httpClient which of the keys they now know the account by.
+func (as *accountStore) LoadOrCreate(ctx context.Context, httpClient *http.Client) (*persistedAccount, error) {
+	sec, err := as.client.Get(ctx, as.name, metav1.GetOptions{})
+	notFound := kerrors.IsNotFound(err)
+	if err != nil && !notFound {
+		return nil, fmt.Errorf("unable to fetch account secret %#v: %s", as.name, err)
+	}
+	if !notFound && len(sec.Data[accountKeySecretKey]) != 0 {
+		acct, err := parseAccountSecret(sec)
+		if err != nil {
+			return nil, err
+		}
+		if len(sec.Data[accountNextKeySecretKey]) != 0 {
+			return as.finishRollover(ctx, sec, acct, httpClient)
+		}
+		return acct, nil
+	}
+
+	log.Printf("no ACME account key found in secret %#v, generating a new one", as.name)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate private account key (not a TLS private key) for the ACME account: %s", err)
+	}
+	acct := &persistedAccount{key: key, registrations: make(map[string]string), keys: make(map[string]*rsa.PrivateKey), keyCreatedAt: time.Now()}
+	keyPEM := encodeAccountKey(key)
+
+	if notFound {
+		sec = &kubeapi.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        as.name,
+				Annotations: map[string]string{keyCreatedAtAnnotation: acct.keyCreatedAt.UTC().Format(time.RFC3339)},
+			},
+			Data: map[string][]byte{
+				accountKeySecretKey:           keyPEM,
+				accountRegistrationsSecretKey: []byte("{}"),
+			},
+		}
+		_, err = as.client.Create(ctx, sec, metav1.CreateOptions{})
+		if kerrors.IsAlreadyExists(err) {
+			// Another lekube created the account at the same time we did, so
+			// use theirs.
+			return as.LoadOrCreate(ctx, httpClient)
+		}
+	} else {
+		sec = sec.DeepCopy()
+		if sec.Data == nil {
+			sec.Data = make(map[string][]byte)
+		}
+		sec.Data[accountKeySecretKey] = keyPEM
+		sec.Data[accountRegistrationsSecretKey] = []byte("{}")
+		delete(sec.Data, accountRegistrationKeysSecretKey)
+		delete(sec.Data, accountRegistrationNextKeysSecretKey)
+		if sec.Annotations == nil {
+			sec.Annotations = make(map[string]string)
+		}
+		sec.Annotations[keyCreatedAtAnnotation] = acct.keyCreatedAt.UTC().Format(time.RFC3339)
+		_, err = as.client.Update(ctx, sec, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to store new account key in secret %#v: %s", as.name, err)
+	}
+	return acct, nil
+}
+
+// finishRollover stores the outcome of the account key rollover that left the
+// key in account-next.key behind. Each CA an account is registered with is
+// asked whether it knows the account by its new key, since lekube may have died
+// after some of them switched to it. The accounts at the CAs that didn't switch
+// keep their old key.
+func (as *accountStore) finishRollover(ctx context.Context, sec *kubeapi.Secret, acct *persistedAccount, httpClient *http.Client) (*persistedAccount, error) {
+	nextKey, err := parseAccountKey(sec.Data[accountNextKeySecretKey])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s in account secret %#v: %s", accountNextKeySecretKey, as.name, err)
+	}
+	nextKeys, err := parseAccountKeys(sec.Data[accountRegistrationNextKeysSecretKey])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s in account secret %#v: %s", accountRegistrationNextKeysSecretKey, as.name, err)
+	}
+	log.Printf("account secret %#v has a %s left over from an interrupted account key rollover, asking the CAs which key they know the accounts by", as.name, accountNextKeySecretKey)
+	keys := unregisteredKeys(acct.registrations, acct.keys)
+	moved := false
+	for name, regURI := range acct.registrations {
+		dir := accountDirectory(name)
+		next := nextKey
+		if isOwnAccount(name) {
+			next = nextKeys[name]
+		}
+		if next == nil {
+			keys[name] = acct.registrationKey(name)
+			continue
+		}
+		cl := &acme.Client{Key: next, HTTPClient: httpClient, DirectoryURL: dir}
+		reg, err := cl.GetReg(ctx, "")
+		switch {
+		case err == nil && reg.URI == regURI:
+			log.Printf("account %s at %s was rolled over to its new key", regURI, dir)
+			if isOwnAccount(name) {
+				keys[name] = next
+			} else {
+				moved = true
+			}
+			continue
+		case err == nil || errors.Is(err, acme.ErrNoAccount):
+			log.Printf("account %s at %s wasn't rolled over to its new key, keeping its old key", regURI, dir)
+		default:
+			return nil, fmt.Errorf("unable to ask the CA at %s whether account %s was rolled over to its new key: %s", dir, regURI, err)
+		}
+		keys[name] = acct.registrationKey(name)
+	}
+	finished := &persistedAccount{key: nextKey, registrations: acct.registrations, keys: keys, keyCreatedAt: time.Now()}
+	if !moved {
+		// No CA switched to the new account key, so it's dropped and the
+		// accounts that kept the old one go back to using it as the
+		// account key.
+		finished.key = acct.key
+		finished.keyCreatedAt = acct.keyCreatedAt
+		for name, k := range keys {
+			if k.Equal(acct.key) {
+				delete(keys, name)
+			}
+		}
+	}
+	err = as.SwapKey(ctx, finished)
+	if err != nil {
+		return nil, err
+	}
+	return finished, nil
+}
+
+// registrationKey returns the key the named account is registered with.
+func (acct *persistedAccount) registrationKey(name string) *rsa.PrivateKey {
+	if k, ok := acct.keys[name]; ok {
+		return k
+	}
+	return acct.key
+}
+
+// unregisteredKeys returns the keys of the accounts that have no registration.
+// They're the keys of the accounts of secrets with their own emails that were
+// generated, but not yet registered or whose registration couldn't be saved.
+func unregisteredKeys(registrations map[string]string, keys map[string]*rsa.PrivateKey) map[string]*rsa.PrivateKey {
+	unregistered := make(map[string]*rsa.PrivateKey)
+	for name, k := range keys {
+		if _, ok := registrations[name]; !ok {
+			unregistered[name] = k
+		}
+	}
+	return unregistered
+}
+
+// SaveRegistration records the account URI that the named account is
+// registered under.
+func (as *accountStore) SaveRegistration(ctx context.Context, name, accountURI string) error {
+	sec, err := as.client.Get(ctx, as.name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to fetch account secret %#v to save registration: %s", as.name, err)
+	}
+	acct, err := parseAccountSecret(sec)
+	if err != nil {
+		return err
+	}
+	acct.registrations[name] = accountURI
+	b, err := json.Marshal(acct.registrations)
+	if err != nil {
+		return err
+	}
+	sec = sec.DeepCopy()
+	sec.Data[accountRegistrationsSecretKey] = b
+	_, err = as.client.Update(ctx, sec, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to save registration in account secret %#v: %s", as.name, err)
+	}
+	return nil
+}
+
+// SaveRegistrationKey stores the key the named account is about to be
+// registered with, since it's not the account key.
+func (as *accountStore) SaveRegistrationKey(ctx context.Context, name string, key *rsa.PrivateKey) error {
+	sec, err := as.client.Get(ctx, as.name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to fetch account secret %#v to save the key of account %s: %s", as.name, name, err)
+	}
+	acct, err := parseAccountSecret(sec)
+	if err != nil {
+		return err
+	}
+	acct.keys[name] = key
+	b, err := encodeAccountKeys(acct.keys)
+	if err != nil {
+		return err
+	}
+	sec = sec.DeepCopy()
+	sec.Data[accountRegistrationKeysSecretKey] = b
+	_, err = as.client.Update(ctx, sec, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to save the key of account %s in account secret %#v: %s", name, as.name, err)
+	}
+	return nil
+}
+
+// SavePendingKey stores the key an account key rollover is about to change to,
+// and the ones the accounts of secrets with their own emails are about to
+// change to, alongside the current ones.
+func (as *accountStore) SavePendingKey(ctx context.Context, key *rsa.PrivateKey, ownKeys map[string]*rsa.PrivateKey) error {
+	sec, err := as.client.Get(ctx, as.name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to fetch account secret %#v to save the new account key: %s", as.name, err)
+	}
+	b, err := encodeAccountKeys(ownKeys)
+	if err != nil {
+		return err
+	}
+	sec = sec.DeepCopy()
+	sec.Data[accountNextKeySecretKey] = encodeAccountKey(key)
+	sec.Data[accountRegistrationNextKeysSecretKey] = b
+	_, err = as.client.Update(ctx, sec, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to save the new account key in account secret %#v: %s", as.name, err)
+	}
+	return nil
+}
+
+// ClearPendingKey removes the keys SavePendingKey stored for an account key
+// rollover the CA turned down.
+func (as *accountStore) ClearPendingKey(ctx context.Context) error {
+	sec, err := as.client.Get(ctx, as.name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to fetch account secret %#v to clear the new account key: %s", as.name, err)
+	}
+	sec = sec.DeepCopy()
+	delete(sec.Data, accountNextKeySecretKey)
+	delete(sec.Data, accountRegistrationNextKeysSecretKey)
+	_, err = as.client.Update(ctx, sec, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to clear the new account key in account secret %#v: %s", as.name, err)
+	}
+	return nil
+}
+
+// SwapKey replaces the account key, registrations, and the keys of the
+// registrations not registered with the account key with the ones from a
+// finished account key rollover in a single update of the account Secret.
+func (as *accountStore) SwapKey(ctx context.Context, acct *persistedAccount) error {
+	sec, err := as.client.Get(ctx, as.name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to fetch account secret %#v to swap in the new account key: %s", as.name, err)
+	}
+	b, err := json.Marshal(acct.registrations)
+	if err != nil {
+		return err
+	}
+	kb, err := encodeAccountKeys(acct.keys)
+	if err != nil {
+		return err
+	}
+	sec = sec.DeepCopy()
+	sec.Data[accountKeySecretKey] = encodeAccountKey(acct.key)
+	sec.Data[accountRegistrationsSecretKey] = b
+	if len(acct.keys) == 0 {
+		delete(sec.Data, accountRegistrationKeysSecretKey)
+	} else {
+		sec.Data[accountRegistrationKeysSecretKey] = kb
+	}
+	delete(sec.Data, accountNextKeySecretKey)
+	delete(sec.Data, accountRegistrationNextKeysSecretKey)
+	if sec.Annotations == nil {
+		sec.Annotations = make(map[string]string)
+	}
+	sec.Annotations[keyCreatedAtAnnotation] = acct.keyCreatedAt.UTC().Format(time.RFC3339)
+	_, err = as.client.Update(ctx, sec, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to swap in the new account key in account secret %#v: %s", as.name, err)
+	}
+	return nil
+}
+
+func encodeAccountKey(key *rsa.PrivateKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+func parseAccountKey(b []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("not valid PEM")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+// encodeAccountKeys encodes the keys of the accounts as a JSON object of their
+// PEM encoded keys by account name.
+func encodeAccountKeys(keys map[string]*rsa.PrivateKey) ([]byte, error) {
+	keyPEMs := make(map[string]string)
+	for name, k := range keys {
+		keyPEMs[name] = string(encodeAccountKey(k))
+	}
+	return json.Marshal(keyPEMs)
+}
+
+func parseAccountKeys(b []byte) (map[string]*rsa.PrivateKey, error) {
+	keys := make(map[string]*rsa.PrivateKey)
+	if len(b) == 0 {
+		return keys, nil
+	}
+	keyPEMs := make(map[string]string)
+	err := json.Unmarshal(b, &keyPEMs)
+	if err != nil {
+		return nil, err
+	}
+	for name, p := range keyPEMs {
+		keys[name], err = parseAccountKey([]byte(p))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse the key of account %s: %s", name, err)
+		}
+	}
+	return keys, nil
+}
+
+func parseAccountSecret(sec *kubeapi.Secret) (*persistedAccount, error) {
+	key, err := parseAccountKey(sec.Data[accountKeySecretKey])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s in account secret %#v: %s", accountKeySecretKey, sec.Name, err)
+	}
+	regs := make(map[string]string)
+	if b := sec.Data[accountRegistrationsSecretKey]; len(b) != 0 {
+		err = json.Unmarshal(b, &regs)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %s in account secret %#v: %s", accountRegistrationsSecretKey, sec.Name, err)
+		}
+	}
+	keys, err := parseAccountKeys(sec.Data[accountRegistrationKeysSecretKey])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s in account secret %#v: %s", accountRegistrationKeysSecretKey, sec.Name, err)
+	}
+	createdAt, _ := time.Parse(time.RFC3339, sec.Annotations[keyCreatedAtAnnotation])
+	return &persistedAccount{key: key, registrations: regs, keys: keys, keyCreatedAt: createdAt}, nil
+}
+
+// RolloverAccountKey changes the ACME account key to a newly generated one at
+// every CA the account is registered with, starting with the one at
+// directoryURL, and the key of each account of secrets with their own emails
+// to a newly generated one of its own. If the rollover fails at directoryURL,
+// the old keys are kept. Any other account that fails keeps the key it had, so
+// that it isn't orphaned and the certs issued under it can still be revoked
+// with it, and the next rollover tries it again. The caller must make sure no
+// orders are in flight, since their challenge responses are tied to the old
+// keys.
+func (lcm *leClientMaker) RolloverAccountKey(ctx context.Context, directoryURL string) error {
+	lcm.mu.Lock()
+	defer lcm.mu.Unlock()
+	rolloverAttempts.Add(ctx, 1)
+	directoryURL = strings.TrimRight(directoryURL, "/")
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		recordErrorMetric(ctx, rolloverStage, "unable to generate new ACME account key: %s", err)
+		return fmt.Errorf("unable to generate new ACME account key: %s", err)
+	}
+	// The CA tells accounts apart by their keys, so the accounts of secrets
+	// with their own emails can't share the new account key.
+	ownKeys := make(map[string]*rsa.PrivateKey)
+	for name := range lcm.registrations {
+		if !isOwnAccount(name) {
+			continue
+		}
+		ownKeys[name], err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			recordErrorMetric(ctx, rolloverStage, "unable to generate new ACME account key: %s", err)
+			return fmt.Errorf("unable to generate new ACME account key: %s", err)
+		}
+	}
+	err = lcm.store.SavePendingKey(ctx, newKey, ownKeys)
+	if err != nil {
+		recordErrorMetric(ctx, rolloverStage, "%s", err)
+		return err
+	}
+
+	old := &persistedAccount{key: lcm.accountKey, keys: lcm.keys}
+	names := slices.Sorted(maps.Keys(lcm.registrations))
+	if i := slices.Index(names, directoryURL); i > 0 {
+		names[0], names[i] = names[i], names[0]
+	}
+	keys := unregisteredKeys(lcm.registrations, lcm.keys)
+	for _, name := range names {
+		dir := accountDirectory(name)
+		regURI := lcm.registrations[name]
+		oldKey := old.registrationKey(name)
+		next := newKey
+		if k, ok := ownKeys[name]; ok {
+			next = k
+			keys[name] = k
+		}
+		cl := &limitedACMEClient{
+			limit: lcm.limit,
+			cl: &acme.Client{
+				Key:          oldKey,
+				KID:          acme.KeyID(regURI),
+				HTTPClient:   lcm.httpClient,
+				DirectoryURL: dir,
+			},
+		}
+		log.Printf("rolling over ACME account key of account %s at %s", regURI, dir)
+		err := cl.AccountKeyRollover(ctx, next)
+		if err != nil {
+			if name == directoryURL {
+				recordErrorMetric(ctx, rolloverStage, "unable to roll over ACME account key at %s, keeping the old key: %s", dir, err)
+				// No other account has been rolled over yet. The new
+				// keys are only kept if the CA didn't answer, since it
+				// may have changed to the new key anyway, and
+				// LoadOrCreate asks it which key it knows the account by.
+				var aerr *acme.Error
+				if errors.As(err, &aerr) {
+					if cerr := lcm.store.ClearPendingKey(ctx); cerr != nil {
+						log.Printf("%s", cerr)
+					}
+				}
+				return fmt.Errorf("unable to roll over ACME account key at %s: %w", dir, err)
+			}
+			recordErrorMetric(ctx, rolloverStage, "unable to roll over ACME account key at %s, keeping the old key for account %s there: %s", dir, regURI, err)
+			keys[name] = oldKey
+		}
+	}
+
+	acct := &persistedAccount{key: newKey, registrations: lcm.registrations, keys: keys, keyCreatedAt: time.Now()}
+	// The CAs only accept the new keys now, so they're used even if they
+	// can't be stored.
+	lcm.accountKey = newKey
+	lcm.accountKeyCreatedAt = acct.keyCreatedAt
+	lcm.keys = keys
+	lcm.clients = make(map[string]*leClient)
+	lcm.upToDate = make(map[string][]string)
+	err = lcm.store.SwapKey(ctx, acct)
+	if err != nil {
+		recordErrorMetric(ctx, rolloverStage, "rolled over ACME account key, but %s. It's still stored as %s and will be picked back up when lekube next starts", err, accountNextKeySecretKey)
+		return err
+	}
+	rolloverSuccesses.Add(ctx, 1)
+	log.Printf("rolled over ACME account key")
+	return nil
+}
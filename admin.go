@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"golang.org/x/crypto/acme"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// adminServer handles the /admin/ endpoints that the lekube subcommands call
+// into the running lekube to perform. It's gated like /debug/ is.
+type adminServer struct {
+	cLoader   *confLoader
+	lcm       *leClientMaker
+	client    corev1.CoreV1Interface
+	leTimeout time.Duration
+	// workMu keeps admin operations from running at the same time as a run
+	// so that they don't fight over the responder and the ACME clients.
+	workMu *sync.Mutex
+}
+
+func (as *adminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conf := as.cLoader.Get()
+	if !conf.AllowRemoteDebug && isBlockedRequest(r) {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "admin endpoints only accept POST", http.StatusMethodNotAllowed)
+		return
+	}
+	switch r.URL.Path {
+	case "/admin/revoke":
+		as.revoke(w, r, conf)
+	case "/admin/reset-backoff":
+		as.resetBackoff(w, r, conf)
+	case "/admin/account-rollover":
+		as.accountRollover(w, r, conf)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// revoke revokes the cert in the given slot of the secret, tls.crt if it's not
+// given, and then immediately orders a new one to replace it.
+func (as *adminServer) revoke(w http.ResponseWriter, r *http.Request, conf *allConf) {
+	secName := r.FormValue("secret")
+	secConf := findSecretConf(conf, secName)
+	if secConf == nil {
+		http.Error(w, fmt.Sprintf("no secret %#v in the config", secName), http.StatusBadRequest)
+		return
+	}
+	slot, ok := findCertSlot(secConf, r.FormValue("cert_data_key"))
+	if !ok {
+		http.Error(w, fmt.Sprintf("secret %s has no cert data key %#v in the config", secConf.FullName(), r.FormValue("cert_data_key")), http.StatusBadRequest)
+		return
+	}
+	reason, err := parseRevocationReason(r.FormValue("reason"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	withCertKey := r.FormValue("with_cert_key") == "true"
+
+	// The caller going away shouldn't leave the secret with a revoked cert
+	// in it.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), as.leTimeout+20*time.Second)
+	defer cancel()
+	ctx, span := tracer.Start(ctx, "lekube/admin-revoke")
+	defer span.End()
+	span.SetAttributes(attribute.String("secret.name", secConf.Name), attribute.String("secret.namespace", secConf.Namespace))
+
+	as.workMu.Lock()
+	defer as.workMu.Unlock()
+
+	tlsSec, err := fetchK8SSecret(ctx, as.client.Secrets(secConf.Namespace), secConf)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		http.Error(w, fmt.Sprintf("unable to fetch secret %s: %s", secConf.FullName(), err), http.StatusInternalServerError)
+		return
+	}
+	var revoked *x509.Certificate
+	if tlsSec != nil {
+		revoked = tlsSec.slotCert(slot)
+	}
+	if revoked == nil {
+		http.Error(w, fmt.Sprintf("no certificate found in %s in secret %s", slot.CertDataKey, secConf.FullName()), http.StatusNotFound)
+		return
+	}
+	// The cert is revoked at the CA that issued it, but, with it revoked,
+	// any of the secret's CAs may issue its replacement.
+	cas := conf.casFor(secConf)
+	issuer := issuerCA(cas, tlsSec, slot)
+	lc, err := as.lcm.Make(ctx, issuer)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		http.Error(w, fmt.Sprintf("unable to get client for ACME API: %s", err), http.StatusInternalServerError)
+		return
+	}
+	err = revokeCert(ctx, lc, secConf, revoked, tlsSec.Data[slot.KeyDataKey], reason, withCertKey)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tlsSec = recordRevocation(ctx, as.client.Secrets(secConf.Namespace), secConf, tlsSec, slot, revoked)
+
+	var dns01 *dns01Solver
+	if conf.DNS01 != nil {
+		dns01, err = newDNS01Solver(ctx, as.client, conf.DNS01)
+		if err != nil {
+			log.Printf("unable to set up the dns01 provider: %s", err)
+		}
+	}
+	_, err = workOn(ctx, tlsSec, secConf, slot, cas, as.lcm, as.client, conf, dns01, as.leTimeout)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		http.Error(w, fmt.Sprintf("revoked cert with serial %x in %s in secret %s, but unable to replace it yet, later runs will keep trying to: %s", revoked.SerialNumber, slot.CertDataKey, secConf.FullName(), err), http.StatusInternalServerError)
+		return
+	}
+	span.SetStatus(codes.Ok, "")
+	fmt.Fprintf(w, "revoked cert with serial %x in %s in secret %s and stored a new one\n", revoked.SerialNumber, slot.CertDataKey, secConf.FullName())
+}
+
+// resetBackoff forgets the failures of the given secret so that the next run
+// tries to get a cert for it again.
+func (as *adminServer) resetBackoff(w http.ResponseWriter, r *http.Request, conf *allConf) {
+	secName := r.FormValue("secret")
+	secConf := findSecretConf(conf, secName)
+	if secConf == nil {
+		http.Error(w, fmt.Sprintf("no secret %#v in the config", secName), http.StatusBadRequest)
+		return
+	}
+	as.workMu.Lock()
+	defer as.workMu.Unlock()
+	err := resetFailures(r.Context(), as.lcm, as.client.Secrets(secConf.Namespace), secConf)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to remove failure backoff from secret %s: %s", secConf.FullName(), err), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("reset failure backoff of secret %s", secConf.FullName())
+	fmt.Fprintf(w, "reset failure backoff of secret %s\n", secConf.FullName())
+}
+
+// accountRollover changes the ACME account key to a new one.
+func (as *adminServer) accountRollover(w http.ResponseWriter, r *http.Request, conf *allConf) {
+	// A rollover the CA has finished has to be stored, even if the caller
+	// has gone away.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 2*time.Minute)
+	defer cancel()
+	ctx, span := tracer.Start(ctx, "lekube/admin-account-rollover")
+	defer span.End()
+
+	// Holding workMu keeps the rollover from happening while an order is
+	// in flight.
+	as.workMu.Lock()
+	defer as.workMu.Unlock()
+	err := as.lcm.RolloverAccountKey(ctx, dirURLFromConf(conf))
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	span.SetStatus(codes.Ok, "")
+	fmt.Fprintf(w, "rolled over ACME account key\n")
+}
+
+func findSecretConf(conf *allConf, name string) *secretConf {
+	for _, secConf := range conf.Secrets {
+		if secConf.FullName().String() == name {
+			return secConf
+		}
+	}
+	return nil
+}
+
+// findCertSlot returns the secret's slot whose cert is stored under
+// certDataKey, or tls.crt's if certDataKey is empty.
+func findCertSlot(secConf *secretConf, certDataKey string) (certSlot, bool) {
+	if certDataKey == "" {
+		certDataKey = "tls.crt"
+	}
+	for _, slot := range secConf.certSlots() {
+		if slot.CertDataKey == certDataKey {
+			return slot, true
+		}
+	}
+	return certSlot{}, false
+}
+
+// revokeCert revokes the cert from the secret. The revocation request is signed
+// with the ACME account key unless withCertKey is true, in which case the
+// cert's own private key, keyPEM, is used.
+func revokeCert(ctx context.Context, lc *leClient, secConf *secretConf, cert *x509.Certificate, keyPEM []byte, reason acme.CRLReasonCode, withCertKey bool) error {
+	revokeCertAttempts.Add(ctx, 1)
+	var key crypto.Signer
+	if withCertKey {
+		var err error
+		key, err = parsePrivateKey(keyPEM)
+		if err != nil {
+			recordErrorMetric(ctx, revokeCertStage, "unable to parse private key in secret %s to revoke with: %s", secConf.FullName(), err)
+			return err
+		}
+	}
+	log.Printf("revoking cert with serial %x in secret %s (reason: %d, signed with cert key: %t)", cert.SerialNumber, secConf.FullName(), reason, withCertKey)
+	err := lc.cl.RevokeCert(ctx, key, cert.Raw, reason)
+	if isAlreadyRevoked(err) {
+		// An earlier attempt got the cert revoked but didn't get to
+		// record it or replace the cert.
+		log.Printf("cert with serial %x in secret %s was already revoked", cert.SerialNumber, secConf.FullName())
+		err = nil
+	}
+	if err != nil {
+		recordErrorMetric(ctx, revokeCertStage, "unable to revoke cert with serial %x in secret %s: %s", cert.SerialNumber, secConf.FullName(), err)
+		return fmt.Errorf("unable to revoke cert with serial %x in secret %s: %s", cert.SerialNumber, secConf.FullName(), err)
+	}
+	revokeCertSuccesses.Add(ctx, 1)
+	log.Printf("revoked cert with serial %x in secret %s", cert.SerialNumber, secConf.FullName())
+	return nil
+}
+
+func isAlreadyRevoked(err error) bool {
+	var aerr *acme.Error
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	return aerr.ProblemType == "urn:ietf:params:acme:error:alreadyRevoked"
+}
+
+// revokedSerialAnnotation records on a Secret the serial of the cert lekube
+// revoked in it, so that every run after knows the cert has to be replaced even
+// when replacing it right after the revocation failed.
+const revokedSerialAnnotation = "lekube.jmhodges.com/revoked-serial"
+
+// revokedSerialAnnotation returns the annotation that records the serial of the
+// slot's revoked cert. The dual_key slot's is suffixed with its data key.
+func (slot certSlot) revokedSerialAnnotation() string {
+	if slot.CertDataKey == "tls.crt" {
+		return revokedSerialAnnotation
+	}
+	return revokedSerialAnnotation + "." + slot.CertDataKey
+}
+
+// wasRevoked returns true if the cert is the one recorded as revoked in the
+// slot of the secret.
+func wasRevoked(tlsSec *tlsSecret, slot certSlot, cert *x509.Certificate) bool {
+	if tlsSec == nil || cert == nil {
+		return false
+	}
+	s, ok := tlsSec.Annotations[slot.revokedSerialAnnotation()]
+	if !ok {
+		return false
+	}
+	serial, err := parseSerial(s)
+	return err == nil && serial.Cmp(cert.SerialNumber) == 0
+}
+
+// recordRevocation records the revocation of the cert in the slot of the secret
+// on the Secret and returns the secret with it recorded. Failing to store it is
+// only logged, since revoking the cert again returns alreadyRevoked, which
+// revokeCert treats as a success, and the returned secret still has the
+// revocation recorded so that the cert's replacement doesn't reuse its key.
+func recordRevocation(ctx context.Context, cl corev1.SecretInterface, secConf *secretConf, tlsSec *tlsSecret, slot certSlot, cert *x509.Certificate) *tlsSecret {
+	sec := tlsSec.Secret.DeepCopy()
+	if sec.Annotations == nil {
+		sec.Annotations = make(map[string]string)
+	}
+	sec.Annotations[slot.revokedSerialAnnotation()] = fmt.Sprintf("%x", cert.SerialNumber)
+	stored, err := cl.Update(ctx, sec, metav1.UpdateOptions{})
+	if err != nil {
+		log.Printf("unable to record the revocation of cert with serial %x on secret %s: %s", cert.SerialNumber, secConf.FullName(), err)
+		return newTLSSecret(sec)
+	}
+	return newTLSSecret(stored)
+}
+
+// revocationReasons are the RFC 5280 reason codes that ACME CAs accept.
+var revocationReasons = map[string]acme.CRLReasonCode{
+	"unspecified":          acme.CRLReasonUnspecified,
+	"keyCompromise":        acme.CRLReasonKeyCompromise,
+	"affiliationChanged":   acme.CRLReasonAffiliationChanged,
+	"superseded":           acme.CRLReasonSuperseded,
+	"cessationOfOperation": acme.CRLReasonCessationOfOperation,
+	"privilegeWithdrawn":   acme.CRLReasonPrivilegeWithdrawn,
+}
+
+func parseRevocationReason(s string) (acme.CRLReasonCode, error) {
+	if s == "" {
+		return acme.CRLReasonUnspecified, nil
+	}
+	reason, ok := revocationReasons[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown revocation reason %#v", s)
+	}
+	return reason, nil
+}
+
+// parseSerial parses a cert serial number written in hex, with or without
+// colons between the bytes.
+func parseSerial(s string) (*big.Int, error) {
+	n, ok := new(big.Int).SetString(strings.ReplaceAll(s, ":", ""), 16)
+	if !ok {
+		return nil, fmt.Errorf("serial %#v is not a hex number", s)
+	}
+	return n, nil
+}
+
+// parsePrivateKey parses the PEM encoded RSA or ECDSA private key in the form
+// lekube stores keys in Secrets, or in PKCS #8 form.
+func parsePrivateKey(b []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("private key is not valid PEM")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch k := k.(type) {
+		case *rsa.PrivateKey:
+			return k, nil
+		case *ecdsa.PrivateKey:
+			return k, nil
+		}
+		return nil, fmt.Errorf("unsupported private key type %T", k)
+	}
+	return nil, fmt.Errorf("unsupported private key PEM type %#v", block.Type)
+}
+
+// revokeCommand is the `lekube revoke` subcommand. It asks the lekube running
+// at -addr to revoke and replace a cert, so it's meant to be run with something
+// like `kubectl exec`.
+func revokeCommand(args []string) int {
+	fs := flag.NewFlagSet("revoke", flag.ExitOnError)
+	secret := fs.String("secret", "", "namespace:name of the secret in the config whose cert should be revoked")
+	reason := fs.String("reason", "unspecified", "revocation reason: one of unspecified, keyCompromise, affiliationChanged, superseded, cessationOfOperation, or privilegeWithdrawn")
+	certDataKey := fs.String("certDataKey", "tls.crt", "data key of the cert in the secret to revoke, like the dual_key's cert_data_key")
+	withCertKey := fs.Bool("withCertKey", false, "sign the revocation request with the cert's private key instead of the ACME account key")
+	fs.Parse(args)
+	if *secret == "" {
+		log.Printf("-secret flag is required")
+		fs.Usage()
+		return 2
+	}
+	if _, err := parseRevocationReason(*reason); err != nil {
+		log.Print(err)
+		return 2
+	}
+	form := url.Values{
+		"secret":        {*secret},
+		"cert_data_key": {*certDataKey},
+		"reason":        {*reason},
+		"with_cert_key": {fmt.Sprint(*withCertKey)},
+	}
+	return postAdminCommand("/admin/revoke", form)
+}
+
+// resetBackoffCommand is the `lekube reset-backoff` subcommand. It asks the
+// lekube running at -addr to try a secret it's been failing to get certs for
+// again on its next run.
+func resetBackoffCommand(args []string) int {
+	fs := flag.NewFlagSet("reset-backoff", flag.ExitOnError)
+	secret := fs.String("secret", "", "namespace:name of the secret in the config whose failure backoff should be reset")
+	fs.Parse(args)
+	if *secret == "" {
+		log.Printf("-secret flag is required")
+		fs.Usage()
+		return 2
+	}
+	return postAdminCommand("/admin/reset-backoff", url.Values{"secret": {*secret}})
+}
+
+// accountCommand is the `lekube account` subcommand. `lekube account rollover`
+// asks the lekube running at -addr to change its ACME account key.
+func accountCommand(args []string) int {
+	fs := flag.NewFlagSet("account", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: lekube account rollover\n")
+	}
+	fs.Parse(args)
+	if fs.Arg(0) != "rollover" {
+		fs.Usage()
+		return 2
+	}
+	return postAdminCommand("/admin/account-rollover", url.Values{})
+}
+
+// postAdminCommand sends an admin request to the lekube running on this
+// machine at -addr and prints out its response.
+func postAdminCommand(path string, form url.Values) int {
+	host, port, err := net.SplitHostPort(*httpAddr)
+	if err != nil {
+		log.Printf("unable to parse -addr %#v: %s", *httpAddr, err)
+		return 2
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	u := "http://" + net.JoinHostPort(host, port) + path
+	resp, err := http.PostForm(u, form)
+	if err != nil {
+		log.Printf("unable to reach lekube at %s: %s", u, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	io.Copy(os.Stdout, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("lekube returned status %s", resp.Status)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ACME Renewal Information (ARI, RFC 9773) lets the CA tell us when to renew
+// a cert, including asking for early renewal when it has to revoke certs en
+// masse.
+
+const (
+	// ariDefaultPollInterval is how long to wait before asking for a cert's
+	// renewal info again when the CA doesn't send a Retry-After.
+	ariDefaultPollInterval = 6 * time.Hour
+	// ariMinPollInterval keeps a CA sending a tiny Retry-After from having us
+	// ask on every run.
+	ariMinPollInterval = 1 * time.Minute
+)
+
+// ariCertID returns the RFC 9773 identifier of the cert used in renewalInfo
+// requests and in the "replaces" field of new orders.
+func ariCertID(cert *x509.Certificate) (string, error) {
+	if len(cert.AuthorityKeyId) == 0 {
+		return "", errors.New("cert has no Authority Key Identifier")
+	}
+	if cert.SerialNumber == nil || cert.SerialNumber.Sign() <= 0 {
+		return "", errors.New("cert has no positive serial number")
+	}
+	// The serial is DER encoded, which means a leading zero byte is needed if
+	// the high bit of the first byte is set.
+	serial := cert.SerialNumber.Bytes()
+	if serial[0]&0x80 != 0 {
+		serial = append([]byte{0}, serial...)
+	}
+	return base64.RawURLEncoding.EncodeToString(cert.AuthorityKeyId) + "." + base64.RawURLEncoding.EncodeToString(serial), nil
+}
+
+// ariSchedule is the renewal time picked out of the window the CA suggested
+// for a cert and when the CA next wants to be asked about it.
+type ariSchedule struct {
+	windowStart    time.Time
+	windowEnd      time.Time
+	explanationURL string
+
+	renewAt  time.Time
+	nextPoll time.Time
+}
+
+// ariScheduler caches the ariSchedules for certs, keyed by ARI cert ID, so
+// that the time picked inside of the window is stable across runs and so that
+// we respect the CA's Retry-After between requests.
+type ariScheduler struct {
+	mu        sync.Mutex
+	schedules map[string]*ariSchedule
+}
+
+func newARIScheduler() *ariScheduler {
+	return &ariScheduler{schedules: make(map[string]*ariSchedule)}
+}
+
+// RenewalSchedule returns the ARI schedule for the cert, asking the CA for it
+// if the cached schedule is due to be refreshed. It returns a nil ariSchedule
+// and nil error if the CA doesn't support ARI.
+func (lc *leClient) RenewalSchedule(ctx context.Context, cert *x509.Certificate) (*ariSchedule, error) {
+	if lc.dirExtras.RenewalInfo == "" {
+		return nil, nil
+	}
+	certID, err := ariCertID(cert)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+
+	lc.ari.mu.Lock()
+	sched, ok := lc.ari.schedules[certID]
+	lc.ari.mu.Unlock()
+	if ok && now.Before(sched.nextPoll) {
+		return sched, nil
+	}
+
+	ri, retryAfter, err := lc.cl.GetRenewalInfo(ctx, lc.dirExtras.RenewalInfo, certID)
+	if err != nil {
+		return nil, err
+	}
+	start, end := ri.SuggestedWindow.Start, ri.SuggestedWindow.End
+	if !end.After(start) {
+		return nil, fmt.Errorf("CA returned an invalid suggested window for cert %s: start %s, end %s", certID, start, end)
+	}
+
+	newSched := &ariSchedule{
+		windowStart:    start,
+		windowEnd:      end,
+		explanationURL: ri.ExplanationURL,
+		nextPoll:       now.Add(max(retryAfter, ariMinPollInterval)),
+	}
+	if ok && sched.windowStart.Equal(start) && sched.windowEnd.Equal(end) {
+		// Keep the time we already picked so that each poll doesn't roll
+		// the dice again.
+		newSched.renewAt = sched.renewAt
+	} else {
+		newSched.renewAt = start.Add(rand.N(end.Sub(start)))
+	}
+	lc.ari.mu.Lock()
+	lc.ari.schedules[certID] = newSched
+	lc.ari.mu.Unlock()
+	return newSched, nil
+}
+
+type renewalInfo struct {
+	SuggestedWindow struct {
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
+	} `json:"suggestedWindow"`
+	ExplanationURL string `json:"explanationURL"`
+}
+
+// GetRenewalInfo fetches the ARI renewal info of the cert and how long the CA
+// wants us to wait before asking again.
+func (lac *limitedACMEClient) GetRenewalInfo(ctx context.Context, renewalInfoURL, certID string) (*renewalInfo, time.Duration, error) {
+	if err := lac.limit.Wait(ctx); err != nil {
+		return nil, 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimRight(renewalInfoURL, "/")+"/"+certID, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	res, err := lac.httpClient().Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, 0, responseProblem(res)
+	}
+	ri := &renewalInfo{}
+	err = json.NewDecoder(res.Body).Decode(ri)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to parse renewal info for cert %s: %s", certID, err)
+	}
+	return ri, parseRetryAfter(res.Header.Get("Retry-After"), ariDefaultPollInterval), nil
+}
+
+// parseRetryAfter parses a Retry-After header in either of its seconds or
+// HTTP-date forms, returning def if it's missing or malformed.
+func parseRetryAfter(v string, def time.Duration) time.Duration {
+	if v == "" {
+		return def
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return def
+}
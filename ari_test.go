@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/time/rate"
+)
+
+func TestARICertID(t *testing.T) {
+	// The example from RFC 9773, section 4.1.
+	serial, _ := new(big.Int).SetString("0087654321", 16)
+	cert := &x509.Certificate{
+		AuthorityKeyId: []byte{0x69, 0x88, 0x5B, 0x6B, 0x87, 0x46, 0x40, 0x41, 0xE1, 0xB3, 0x7B, 0x84, 0x7B, 0xA0, 0xAE, 0x2C, 0xDE, 0x01, 0xC8, 0xD4},
+		SerialNumber:   serial,
+	}
+	id, err := ariCertID(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE"
+	if id != expected {
+		t.Errorf("want %#v, got %#v", expected, id)
+	}
+
+	_, err = ariCertID(&x509.Certificate{SerialNumber: serial})
+	if err == nil {
+		t.Errorf("cert without an AKI should have errored")
+	}
+}
+
+func TestRenewalScheduleKeepsPickedTime(t *testing.T) {
+	start := time.Now().Add(-1 * time.Hour).Truncate(time.Second)
+	end := start.Add(2 * time.Hour)
+	requests := new(atomic.Int64)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path != "/renewal-info/aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", "0")
+		fmt.Fprintf(w, `{"suggestedWindow": {"start": %q, "end": %q}, "explanationURL": "https://example.com/incident"}`, start.Format(time.RFC3339), end.Format(time.RFC3339))
+	}))
+	defer srv.Close()
+
+	lc := &leClient{
+		cl:        &limitedACMEClient{limit: rate.NewLimiter(rate.Inf, 1), cl: &acme.Client{HTTPClient: srv.Client()}},
+		dirExtras: directoryExtras{RenewalInfo: srv.URL + "/renewal-info"},
+		ari:       newARIScheduler(),
+	}
+	serial, _ := new(big.Int).SetString("0087654321", 16)
+	cert := &x509.Certificate{
+		AuthorityKeyId: []byte{0x69, 0x88, 0x5B, 0x6B, 0x87, 0x46, 0x40, 0x41, 0xE1, 0xB3, 0x7B, 0x84, 0x7B, 0xA0, 0xAE, 0x2C, 0xDE, 0x01, 0xC8, 0xD4},
+		SerialNumber:   serial,
+	}
+	sched, err := lc.RenewalSchedule(context.Background(), cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sched.renewAt.Before(start) || !sched.renewAt.Before(end) {
+		t.Errorf("renewAt %s is not inside of window %s to %s", sched.renewAt, start, end)
+	}
+	if sched.explanationURL != "https://example.com/incident" {
+		t.Errorf("explanationURL: want %#v, got %#v", "https://example.com/incident", sched.explanationURL)
+	}
+
+	// The Retry-After of 0 is bumped up to the minimum poll interval, so this
+	// shouldn't cause another request.
+	sched2, err := lc.RenewalSchedule(context.Background(), cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests.Load() != 1 {
+		t.Errorf("want 1 renewal info request, got %d", requests.Load())
+	}
+	if !sched2.renewAt.Equal(sched.renewAt) {
+		t.Errorf("renewAt changed between polls from %s to %s", sched.renewAt, sched2.renewAt)
+	}
+
+	// Force a poll. The window is the same, so the picked time should be, too.
+	lc.ari.schedules["aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE"].nextPoll = time.Now().Add(-1 * time.Second)
+	sched3, err := lc.RenewalSchedule(context.Background(), cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests.Load() != 2 {
+		t.Errorf("want 2 renewal info requests, got %d", requests.Load())
+	}
+	if !sched3.renewAt.Equal(sched.renewAt) {
+		t.Errorf("renewAt changed between polls of the same window from %s to %s", sched.renewAt, sched3.renewAt)
+	}
+}
+
+func TestAuthorizeOrderWithExtras(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var srvURL string
+	var gotPayload map[string]interface{}
+	var gotHeader jose.Header
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce-1")
+		switch r.URL.Path {
+		case "/directory":
+			fmt.Fprintf(w, `{"newNonce": %q, "newAccount": %q, "newOrder": %q, "renewalInfo": %q, "meta": {"profiles": {"classic": "The same profile you're accustomed to", "shortlived": "Short-lived certs"}}}`, srvURL+"/nonce", srvURL+"/account", srvURL+"/order", srvURL+"/renewal-info")
+		case "/nonce":
+		case "/order":
+			b, _ := io.ReadAll(r.Body)
+			jws, err := jose.ParseSigned(string(b), []jose.SignatureAlgorithm{jose.RS256})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			payload, err := jws.Verify(&key.PublicKey)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			gotHeader = jws.Signatures[0].Protected
+			json.Unmarshal(payload, &gotPayload)
+			w.Header().Set("Location", srvURL+"/order/1")
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"status": "pending", "identifiers": [{"type": "dns", "value": "example.com"}], "authorizations": [%q], "finalize": %q}`, srvURL+"/authz/1", srvURL+"/finalize/1")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	srvURL = srv.URL
+
+	lac := &limitedACMEClient{
+		limit: rate.NewLimiter(rate.Inf, 1),
+		cl: &acme.Client{
+			Key:          key,
+			KID:          acme.KeyID(srv.URL + "/account/1"),
+			HTTPClient:   srv.Client(),
+			DirectoryURL: srv.URL + "/directory",
+		},
+	}
+	extras, err := lac.DiscoverExtras(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extras.RenewalInfo != srv.URL+"/renewal-info" {
+		t.Errorf("renewalInfo: want %#v, got %#v", srv.URL+"/renewal-info", extras.RenewalInfo)
+	}
+	if len(extras.Meta.Profiles) != 2 || extras.Meta.Profiles["shortlived"] != "Short-lived certs" {
+		t.Errorf("unexpected profiles %#v", extras.Meta.Profiles)
+	}
+
+	order, err := lac.AuthorizeOrderWithExtras(context.Background(), []acme.AuthzID{{Type: "dns", Value: "example.com"}}, orderExtras{Replaces: "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE", Profile: "shortlived"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotPayload["replaces"] != "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE" {
+		t.Errorf("replaces: want %#v, got %#v", "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE", gotPayload["replaces"])
+	}
+	if gotPayload["profile"] != "shortlived" {
+		t.Errorf("profile: want %#v, got %#v", "shortlived", gotPayload["profile"])
+	}
+	if gotHeader.KeyID != srv.URL+"/account/1" || gotHeader.Nonce != "nonce-1" || gotHeader.ExtraHeaders["url"] != srv.URL+"/order" {
+		t.Errorf("unexpected JWS protected header: %#v", gotHeader)
+	}
+	if order.URI != srv.URL+"/order/1" || order.FinalizeURL != srv.URL+"/finalize/1" || len(order.AuthzURLs) != 1 {
+		t.Errorf("unexpected order: %#v", order)
+	}
+	if !strings.HasPrefix(order.AuthzURLs[0], srv.URL) {
+		t.Errorf("unexpected authz URL %#v", order.AuthzURLs[0])
+	}
+}
+
+func TestIsAlreadyReplaced(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&acme.Error{StatusCode: http.StatusConflict, ProblemType: "urn:ietf:params:acme:error:alreadyReplaced"}, true},
+		{fmt.Errorf("failed to order: %w", &acme.Error{StatusCode: http.StatusConflict, ProblemType: "urn:ietf:params:acme:error:alreadyReplaced"}), true},
+		{&acme.Error{StatusCode: http.StatusConflict, ProblemType: "urn:ietf:params:acme:error:malformed"}, false},
+		{&acme.Error{StatusCode: http.StatusConflict}, false},
+		{errors.New("alreadyReplaced"), false},
+	}
+	for i, tc := range tests {
+		if got := isAlreadyReplaced(tc.err); got != tc.want {
+			t.Errorf("#%d: isAlreadyReplaced(%v) = %t, want %t", i, tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestValidateProfile(t *testing.T) {
+	lac := &limitedACMEClient{limit: rate.NewLimiter(rate.Inf, 1), cl: &acme.Client{DirectoryURL: "https://ca.example.com/directory"}}
+	noProfiles := &leClient{cl: lac}
+	withProfiles := &leClient{cl: lac}
+	withProfiles.dirExtras.Meta.Profiles = map[string]string{"classic": "", "tlsserver": ""}
+
+	if err := noProfiles.validateProfile(""); err != nil {
+		t.Errorf("no profile requested from CA without profiles: %s", err)
+	}
+	err := noProfiles.validateProfile("tlsserver")
+	if err == nil || !strings.Contains(err.Error(), "doesn't offer any certificate profiles") {
+		t.Errorf("profile requested from CA without profiles: want error, got %v", err)
+	}
+	if err := withProfiles.validateProfile("tlsserver"); err != nil {
+		t.Errorf("advertised profile: %s", err)
+	}
+	err = withProfiles.validateProfile("shortlived")
+	if err == nil || !strings.Contains(err.Error(), "only offers the profiles classic, tlsserver") {
+		t.Errorf("unadvertised profile: want error listing the offered profiles, got %v", err)
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/publicsuffix"
+	kubeapi "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// defaultRateLimitBackoff is how long to hold off on a secret when the CA
+// rate limits it without saying for how long.
+const defaultRateLimitBackoff = 1 * time.Hour
+
+// rateLimitedUntilAnnotation records on a Secret when lekube may next order a
+// cert for it after the CA rate limited it, so that restarting lekube doesn't
+// have it run into the limit again.
+const rateLimitedUntilAnnotation = "lekube.jmhodges.com/rate-limited-until"
+
+// rateLimitBackoff tracks the secrets the CA has rate limited, and the
+// registered domains (like "example.com" for "www.example.com") of their
+// domains, so that lekube doesn't keep ordering certs for them and extend the
+// limit. Let's Encrypt's certificates-per-registered-domain limit means one
+// secret being rate limited is likely to mean others sharing its registered
+// domain will be, too.
+type rateLimitBackoff struct {
+	mu      sync.Mutex
+	secrets map[nsSecName]time.Time
+	domains map[string]time.Time
+}
+
+func newRateLimitBackoff() *rateLimitBackoff {
+	return &rateLimitBackoff{
+		secrets: make(map[nsSecName]time.Time),
+		domains: make(map[string]time.Time),
+	}
+}
+
+// Add holds off on ordering certs for the secret and its registered domains
+// until the given time.
+func (b *rateLimitBackoff) Add(secConf *secretConf, until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if until.After(b.secrets[secConf.FullName()]) {
+		b.secrets[secConf.FullName()] = until
+	}
+	for _, d := range registeredDomains(secConf.Domains) {
+		if until.After(b.domains[d]) {
+			b.domains[d] = until
+		}
+	}
+	b.updateGauge()
+}
+
+// Until returns the time lekube may next order a cert for the secret and the
+// secret or registered domain whose rate limit is the reason why. It returns
+// false if the secret isn't being held off on.
+func (b *rateLimitBackoff) Until(secConf *secretConf) (time.Time, string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.prune(now)
+	var until time.Time
+	reason := ""
+	if t, ok := b.secrets[secConf.FullName()]; ok {
+		until, reason = t, "secret "+secConf.FullName().String()
+	}
+	for _, d := range registeredDomains(secConf.Domains) {
+		if t, ok := b.domains[d]; ok && t.After(until) {
+			until, reason = t, "registered domain "+d
+		}
+	}
+	return until, reason, reason != ""
+}
+
+func (b *rateLimitBackoff) prune(now time.Time) {
+	for name, t := range b.secrets {
+		if !now.Before(t) {
+			delete(b.secrets, name)
+		}
+	}
+	for d, t := range b.domains {
+		if !now.Before(t) {
+			delete(b.domains, d)
+		}
+	}
+	b.updateGauge()
+}
+
+func (b *rateLimitBackoff) updateGauge() {
+	rateLimitedSecrets.Store(int64(len(b.secrets)))
+}
+
+// registeredDomains returns the unique registered domains (eTLD+1s) of the
+// domains. Domains that are themselves public suffixes are returned as-is.
+func registeredDomains(domains []string) []string {
+	seen := make(map[string]bool)
+	regs := []string{}
+	for _, d := range domains {
+		d = normalizeDomain(strings.TrimPrefix(d, "*."))
+		reg, err := publicsuffix.EffectiveTLDPlusOne(d)
+		if err != nil {
+			reg = d
+		}
+		if !seen[reg] {
+			seen[reg] = true
+			regs = append(regs, reg)
+		}
+	}
+	return regs
+}
+
+// rateLimitedUntil returns when the CA said to try again if err is, or wraps, a
+// rateLimited problem from it.
+func rateLimitedUntil(err error) (time.Time, bool) {
+	var aerr *acme.Error
+	var oerr *acme.OrderError
+	switch {
+	case errors.As(err, &aerr):
+	case errors.As(err, &oerr) && oerr.Problem != nil:
+		aerr = oerr.Problem
+	default:
+		return time.Time{}, false
+	}
+	retryAfter, ok := acme.RateLimit(aerr)
+	if !ok {
+		return time.Time{}, false
+	}
+	if retryAfter <= 0 {
+		retryAfter = defaultRateLimitBackoff
+	}
+	return time.Now().Add(retryAfter), true
+}
+
+// rateLimitedUntilFromSecret returns the time recorded in the Secret's
+// rate-limited-until annotation, or the zero time if there isn't a valid one.
+func rateLimitedUntilFromSecret(sec *kubeapi.Secret) time.Time {
+	t, err := time.Parse(time.RFC3339, sec.Annotations[rateLimitedUntilAnnotation])
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// maxACMERetryWait is the longest the ACME clients wait before retrying a
+// request.
+const maxACMERetryWait = 10 * time.Second
+
+// acmeRetryBackoff is the ACME clients' RetryBackoff. Like the acme package's
+// default, it backs off exponentially and waits out the CA's Retry-After, but
+// it gives up on rate limits that last longer than maxACMERetryWait. Those
+// are usually hours long, and waiting on one would use up the time the
+// secret's fallback CAs have to issue its cert. rateLimitBackoff holds off on
+// them instead.
+func acmeRetryBackoff(n int, r *http.Request, res *http.Response) time.Duration {
+	jitter := time.Duration(1+rand.IntN(1000)) * time.Millisecond
+	wait := parseRetryAfter(res.Header.Get("Retry-After"), -1)
+	if res.StatusCode == http.StatusTooManyRequests && (wait < 0 || wait > maxACMERetryWait) {
+		return 0
+	}
+	if wait >= 0 {
+		return wait + jitter
+	}
+	n = min(max(n, 1), 30)
+	return min(time.Duration(1<<(n-1))*time.Second, maxACMERetryWait) + jitter
+}
+
+// persistRateLimit records the backoff on the Secret and returns the secret as
+// annotated. Secrets that don't exist yet are only held off on in memory.
+func persistRateLimit(ctx context.Context, cl corev1.SecretInterface, secConf *secretConf, tlsSec *tlsSecret, until time.Time) (*tlsSecret, error) {
+	return annotateSecret(ctx, cl, secConf, tlsSec, map[string]string{
+		rateLimitedUntilAnnotation: until.UTC().Format(time.RFC3339),
+	})
+}
+
+// annotateSecret sets the annotations on the Secret if it exists and returns
+// the secret as annotated, or tlsSec if it couldn't be. Only the annotations are
+// patched, so that they're recorded even if the Secret has changed since
+// tlsSec was fetched.
+func annotateSecret(ctx context.Context, cl corev1.SecretInterface, secConf *secretConf, tlsSec *tlsSecret, annos map[string]string) (*tlsSecret, error) {
+	if tlsSec == nil {
+		return nil, nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annos},
+	})
+	if err != nil {
+		return tlsSec, err
+	}
+	sec, err := cl.Patch(ctx, secConf.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return tlsSec, fmt.Errorf("unable to annotate secret %s: %s", secConf.FullName(), err)
+	}
+	return newTLSSecret(sec), nil
+}
+
+const (
+	// failureBackoffBase is how long lekube waits before trying a secret again
+	// after it first fails. Each failure after that doubles the wait, up to
+	// failureBackoffMax.
+	failureBackoffBase = 30 * time.Minute
+	failureBackoffMax  = 24 * time.Hour
+
+	// maxLastErrorLen keeps long CA error messages from bloating the
+	// Secret's annotations.
+	maxLastErrorLen = 1024
+)
+
+// The failure backoff annotations record on a Secret how many times in a row
+// lekube has failed to get a cert for it, the error it last failed with, and
+// when it may next try. Deleting them, or running `lekube reset-backoff`,
+// lets lekube try again on its next run.
+const (
+	failureCountAnnotation = "lekube.jmhodges.com/failure-count"
+	lastErrorAnnotation    = "lekube.jmhodges.com/last-error"
+	nextAttemptAnnotation  = "lekube.jmhodges.com/next-attempt"
+)
+
+// failureBackoffAnnotations are removed from a Secret when a new cert is stored
+// in it.
+var failureBackoffAnnotations = []string{failureCountAnnotation, lastErrorAnnotation, nextAttemptAnnotation}
+
+// secretFailures is the failure history of a secret lekube has been unable to
+// get a cert for.
+type secretFailures struct {
+	Count       int
+	LastError   string
+	NextAttempt time.Time
+}
+
+// failureBackoff tracks the secrets lekube has repeatedly failed to get certs
+// for so that one broken domain in the config isn't retried on every run,
+// filling the logs and using up the CA's failed validation limits. The
+// annotations on a Secret are the source of truth for it when it exists, and
+// the secrets that don't exist yet are only tracked in memory.
+type failureBackoff struct {
+	mu      sync.Mutex
+	secrets map[nsSecName]secretFailures
+}
+
+func newFailureBackoff() *failureBackoff {
+	return &failureBackoff{secrets: make(map[nsSecName]secretFailures)}
+}
+
+// Load sets the secret's failure history to the one recorded on its Secret.
+func (b *failureBackoff) Load(name nsSecName, sec *kubeapi.Secret) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, ok := failuresFromSecret(sec)
+	if !ok {
+		delete(b.secrets, name)
+		return
+	}
+	b.secrets[name] = f
+}
+
+// Until returns the secret's failure history if it shouldn't be tried again
+// yet.
+func (b *failureBackoff) Until(name nsSecName) (secretFailures, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, ok := b.secrets[name]
+	if !ok || !time.Now().Before(f.NextAttempt) {
+		return secretFailures{}, false
+	}
+	return f, true
+}
+
+// Count returns how many times in a row ordering the secret's certs has
+// failed, whether or not it's still being backed off from.
+func (b *failureBackoff) Count(name nsSecName) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.secrets[name].Count
+}
+
+// Failed records another failure for the secret and returns its updated
+// history.
+func (b *failureBackoff) Failed(name nsSecName, err error) secretFailures {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f := b.secrets[name]
+	f.Count++
+	f.LastError = err.Error()
+	if len(f.LastError) > maxLastErrorLen {
+		f.LastError = f.LastError[:maxLastErrorLen]
+	}
+	f.NextAttempt = time.Now().Add(failureBackoffDuration(f.Count))
+	b.secrets[name] = f
+	return f
+}
+
+// Reset forgets the secret's failures.
+func (b *failureBackoff) Reset(name nsSecName) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.secrets, name)
+}
+
+// failureBackoffDuration returns how long to wait after the given number of
+// failures in a row. It's jittered to between half and all of the exponential
+// backoff so that secrets that broke together don't all retry together.
+func failureBackoffDuration(count int) time.Duration {
+	d := failureBackoffMax
+	if count < 1 {
+		count = 1
+	}
+	// Shifting by more than this would overflow past failureBackoffMax
+	// anyway.
+	if count <= 32 {
+		d = min(failureBackoffBase<<(count-1), failureBackoffMax)
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+func failuresFromSecret(sec *kubeapi.Secret) (secretFailures, bool) {
+	count, err := strconv.Atoi(sec.Annotations[failureCountAnnotation])
+	if err != nil || count < 1 {
+		return secretFailures{}, false
+	}
+	next, err := time.Parse(time.RFC3339, sec.Annotations[nextAttemptAnnotation])
+	if err != nil {
+		return secretFailures{}, false
+	}
+	return secretFailures{Count: count, LastError: sec.Annotations[lastErrorAnnotation], NextAttempt: next}, true
+}
+
+func (f secretFailures) annotations() map[string]string {
+	return map[string]string{
+		failureCountAnnotation: strconv.Itoa(f.Count),
+		lastErrorAnnotation:    f.LastError,
+		nextAttemptAnnotation:  f.NextAttempt.UTC().Format(time.RFC3339),
+	}
+}
+
+// recordFailure records that lekube failed to get a cert for the secret on the
+// secret's Secret. Rate limits are held off on separately by rateLimitBackoff
+// since they aren't a sign that anything is wrong with the secret. The failure
+// is held off on in memory even if it can't be recorded on the Secret.
+func recordFailure(ctx context.Context, lcm *leClientMaker, cl corev1.SecretInterface, secConf *secretConf, tlsSec *tlsSecret, err error) error {
+	if _, ok := rateLimitedUntil(err); ok {
+		return nil
+	}
+	f := lcm.failures.Failed(secConf.FullName(), err)
+	log.Printf("failed to get a cert for secret %s %d time(s) in a row, not trying again until %s", secConf.FullName(), f.Count, f.NextAttempt.Format(time.RFC3339))
+	_, err = annotateSecret(ctx, cl, secConf, tlsSec, f.annotations())
+	return err
+}
+
+// resetFailures forgets the secret's failures and removes them from its Secret
+// so that the next run tries it again.
+func resetFailures(ctx context.Context, lcm *leClientMaker, cl corev1.SecretInterface, secConf *secretConf) error {
+	lcm.failures.Reset(secConf.FullName())
+	sec, err := cl.Get(ctx, secConf.Name, metav1.GetOptions{})
+	if err != nil {
+		if kerrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	changed := false
+	for _, a := range failureBackoffAnnotations {
+		if _, ok := sec.Annotations[a]; ok {
+			delete(sec.Annotations, a)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	_, err = cl.Update(ctx, sec, metav1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	kubeapi "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestRateLimitedUntil(t *testing.T) {
+	rateLimited := &acme.Error{
+		StatusCode:  http.StatusTooManyRequests,
+		ProblemType: "urn:ietf:params:acme:error:rateLimited",
+		Header:      http.Header{"Retry-After": {"600"}},
+	}
+	noRetryAfter := &acme.Error{
+		StatusCode:  http.StatusTooManyRequests,
+		ProblemType: "urn:ietf:params:acme:error:rateLimited",
+	}
+	tests := []struct {
+		err  error
+		want time.Duration
+		ok   bool
+	}{
+		{rateLimited, 10 * time.Minute, true},
+		{fmt.Errorf("in secret foo:bar, failed to authorize order of names [a.example.com]: %w", rateLimited), 10 * time.Minute, true},
+		{&acme.OrderError{Status: acme.StatusInvalid, Problem: rateLimited}, 10 * time.Minute, true},
+		{noRetryAfter, defaultRateLimitBackoff, true},
+		{&acme.Error{StatusCode: http.StatusForbidden, ProblemType: "urn:ietf:params:acme:error:unauthorized"}, 0, false},
+		{&acme.OrderError{Status: acme.StatusInvalid}, 0, false},
+		{errors.New("rateLimited"), 0, false},
+	}
+	for i, tc := range tests {
+		start := time.Now()
+		until, ok := rateLimitedUntil(tc.err)
+		if ok != tc.ok {
+			t.Errorf("#%d: rateLimitedUntil(%v) ok = %t, want %t", i, tc.err, ok, tc.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if until.Before(start.Add(tc.want)) || until.After(time.Now().Add(tc.want)) {
+			t.Errorf("#%d: rateLimitedUntil(%v) = %s, want about %s from now", i, tc.err, until, tc.want)
+		}
+	}
+}
+
+func TestRateLimitBackoffByRegisteredDomain(t *testing.T) {
+	b := newRateLimitBackoff()
+	limited := &secretConf{Namespace: "default", Name: "limited", Domains: []string{"www.example.com", "*.example.co.uk"}}
+	sibling := &secretConf{Namespace: "other", Name: "sibling", Domains: []string{"api.EXAMPLE.com."}}
+	unrelated := &secretConf{Namespace: "default", Name: "unrelated", Domains: []string{"example.net"}}
+
+	until := time.Now().Add(time.Hour).Truncate(time.Second)
+	b.Add(limited, until)
+
+	got, reason, ok := b.Until(limited)
+	if !ok || !got.Equal(until) || reason != "secret default:limited" {
+		t.Errorf("Until(limited) = %s, %#v, %t; want %s, \"secret default:limited\", true", got, reason, ok, until)
+	}
+	got, reason, ok = b.Until(sibling)
+	if !ok || !got.Equal(until) || reason != "registered domain example.com" {
+		t.Errorf("Until(sibling) = %s, %#v, %t; want %s, \"registered domain example.com\", true", got, reason, ok, until)
+	}
+	if _, _, ok := b.Until(unrelated); ok {
+		t.Errorf("Until(unrelated) was rate limited but shouldn't be")
+	}
+	if n := rateLimitedSecrets.Load(); n != 1 {
+		t.Errorf("rate-limited-secrets gauge = %d, want 1", n)
+	}
+
+	b.Add(unrelated, time.Now().Add(-time.Minute))
+	if _, _, ok := b.Until(unrelated); ok {
+		t.Errorf("Until(unrelated) was rate limited after its backoff passed")
+	}
+	if n := rateLimitedSecrets.Load(); n != 1 {
+		t.Errorf("rate-limited-secrets gauge after expiry = %d, want 1", n)
+	}
+}
+
+func TestACMERetryBackoff(t *testing.T) {
+	tests := []struct {
+		status     int
+		retryAfter string
+		n          int
+		min, max   time.Duration
+	}{
+		{http.StatusTooManyRequests, "3600", 1, 0, 0},
+		{http.StatusTooManyRequests, "", 1, 0, 0},
+		{http.StatusTooManyRequests, "2", 1, 2 * time.Second, 3 * time.Second},
+		{http.StatusServiceUnavailable, "", 1, time.Second, 2 * time.Second},
+		{http.StatusServiceUnavailable, "", 20, maxACMERetryWait, maxACMERetryWait + time.Second},
+		{http.StatusServiceUnavailable, "60", 1, time.Minute, time.Minute + time.Second},
+	}
+	for _, tc := range tests {
+		res := &http.Response{StatusCode: tc.status, Header: http.Header{}}
+		if tc.retryAfter != "" {
+			res.Header.Set("Retry-After", tc.retryAfter)
+		}
+		d := acmeRetryBackoff(tc.n, nil, res)
+		if d < tc.min || d > tc.max {
+			t.Errorf("acmeRetryBackoff(%d) of %d response with Retry-After %#v = %s, want between %s and %s", tc.n, tc.status, tc.retryAfter, d, tc.min, tc.max)
+		}
+	}
+}
+
+func TestACMEClientDoesNotWaitOutRateLimits(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"type":"urn:ietf:params:acme:error:rateLimited","detail":"too many certificates"}`))
+	}))
+	defer srv.Close()
+	cl := &acme.Client{DirectoryURL: srv.URL, HTTPClient: srv.Client(), RetryBackoff: acmeRetryBackoff}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := cl.Discover(ctx)
+	if ctx.Err() != nil {
+		t.Fatalf("client waited out the rate limit")
+	}
+	if _, ok := rateLimitedUntil(err); !ok {
+		t.Errorf("error from rate limited request isn't a rate limit: %v", err)
+	}
+}
+
+func TestRateLimitPersistedOnSecret(t *testing.T) {
+	ctx := context.Background()
+	kube := fake.NewClientset(&kubeapi.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "limited"},
+		Data:       map[string][]byte{"tls.crt": []byte("old cert"), "tls.key": []byte("old key")},
+	})
+	secrets := kube.CoreV1().Secrets("default")
+	secConf := &secretConf{Namespace: "default", Name: "limited", Domains: []string{"www.example.com"}}
+	slot := secConf.certSlots()[0]
+
+	tlsSec, err := fetchK8SSecret(ctx, secrets, secConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The Secret changing after it was fetched doesn't keep the backoff
+	// from being recorded.
+	changed := tlsSec.Secret.DeepCopy()
+	changed.Labels = map[string]string{"app": "web"}
+	_, err = secrets.Update(ctx, changed, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	until := time.Now().Add(time.Hour).Truncate(time.Second)
+	tlsSec, err = persistRateLimit(ctx, secrets, secConf, tlsSec, until)
+	if err != nil {
+		t.Fatalf("persistRateLimit: %s", err)
+	}
+	if got := rateLimitedUntilFromSecret(tlsSec.Secret); !got.Equal(until) {
+		t.Errorf("rate limit annotation on returned secret = %s, want %s", got, until)
+	}
+
+	fetched, err := fetchK8SSecret(ctx, secrets, secConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rateLimitedUntilFromSecret(fetched.Secret); !got.Equal(until) {
+		t.Errorf("rate limit annotation = %s, want %s", got, until)
+	}
+	if fetched.Secret.Labels["app"] != "web" {
+		t.Errorf("labels = %#v, want the change made after fetching kept", fetched.Secret.Labels)
+	}
+
+	// A newly stored cert clears the backoff.
+	sec, err := storeK8SSecret(ctx, secrets, secConf, slot, tlsSec.Secret, &newCert{Cert: []byte("new cert"), Key: []byte("new key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rateLimitedUntilFromSecret(sec); !got.IsZero() {
+		t.Errorf("rate limit annotation after storing a new cert = %s, want none", got)
+	}
+}
+
+func TestFailureBackoffDuration(t *testing.T) {
+	tests := []struct {
+		count int
+		max   time.Duration
+	}{
+		{1, failureBackoffBase},
+		{2, 2 * failureBackoffBase},
+		{3, 4 * failureBackoffBase},
+		{10, failureBackoffMax},
+		{1000, failureBackoffMax},
+	}
+	for _, tc := range tests {
+		for i := 0; i < 20; i++ {
+			d := failureBackoffDuration(tc.count)
+			if d < tc.max/2 || d > tc.max {
+				t.Errorf("failureBackoffDuration(%d) = %s, want between %s and %s", tc.count, d, tc.max/2, tc.max)
+			}
+		}
+	}
+}
+
+func TestFailureBackoffPersistedOnSecret(t *testing.T) {
+	ctx := context.Background()
+	kube := fake.NewClientset(&kubeapi.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "broken"},
+		Data:       map[string][]byte{"tls.crt": []byte("old cert"), "tls.key": []byte("old key")},
+	})
+	secrets := kube.CoreV1().Secrets("default")
+	secConf := &secretConf{Namespace: "default", Name: "broken", Domains: []string{"www.example.com"}}
+	lcm := &leClientMaker{failures: newFailureBackoff()}
+
+	tlsSec, err := fetchK8SSecret(ctx, secrets, secConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = recordFailure(ctx, lcm, secrets, secConf, tlsSec, errors.New("authz failed"))
+	if err != nil {
+		t.Fatalf("recordFailure: %s", err)
+	}
+	if _, ok := lcm.failures.Until(secConf.FullName()); !ok {
+		t.Fatalf("secret wasn't backed off from after failing")
+	}
+
+	// A restarted lekube picks the failures back up from the Secret.
+	tlsSec, err = fetchK8SSecret(ctx, secrets, secConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted := &leClientMaker{failures: newFailureBackoff()}
+	restarted.failures.Load(secConf.FullName(), tlsSec.Secret)
+	f, ok := restarted.failures.Until(secConf.FullName())
+	if !ok {
+		t.Fatalf("secret wasn't backed off from after loading its failures")
+	}
+	if f.Count != 1 || f.LastError != "authz failed" {
+		t.Errorf("loaded failures = %#v, want count 1 and last error \"authz failed\"", f)
+	}
+	err = recordFailure(ctx, restarted, secrets, secConf, tlsSec, errors.New("authz failed again"))
+	if err != nil {
+		t.Fatalf("recordFailure: %s", err)
+	}
+	sec, err := secrets.Get(ctx, "broken", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sec.Annotations[failureCountAnnotation]; got != "2" {
+		t.Errorf("failure count annotation = %#v, want \"2\"", got)
+	}
+
+	err = resetFailures(ctx, restarted, secrets, secConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restarted.failures.Until(secConf.FullName()); ok {
+		t.Errorf("secret was still backed off from after resetting")
+	}
+	sec, err = secrets.Get(ctx, "broken", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range failureBackoffAnnotations {
+		if _, ok := sec.Annotations[a]; ok {
+			t.Errorf("annotation %s still on the Secret after resetting", a)
+		}
+	}
+}
+
+func TestRecordFailureIgnoresRateLimits(t *testing.T) {
+	secConf := &secretConf{Namespace: "default", Name: "limited", Domains: []string{"www.example.com"}}
+	lcm := &leClientMaker{failures: newFailureBackoff()}
+	err := fmt.Errorf("failed to authorize: %w", &acme.Error{
+		StatusCode:  http.StatusTooManyRequests,
+		ProblemType: "urn:ietf:params:acme:error:rateLimited",
+	})
+	recordFailure(context.Background(), lcm, nil, secConf, nil, err)
+	if _, ok := lcm.failures.Until(secConf.FullName()); ok {
+		t.Errorf("rate limit was recorded as a failure")
+	}
+}
+
+func TestRecordFailureReturnsAnnotationErrors(t *testing.T) {
+	ctx := context.Background()
+	kube := fake.NewClientset(&kubeapi.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "unpatchable"},
+		Data:       map[string][]byte{"tls.crt": []byte("old cert"), "tls.key": []byte("old key")},
+	})
+	kube.PrependReactor("patch", "secrets", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("apiserver unavailable")
+	})
+	secrets := kube.CoreV1().Secrets("default")
+	secConf := &secretConf{Namespace: "default", Name: "unpatchable", Domains: []string{"www.example.com"}}
+	lcm := &leClientMaker{failures: newFailureBackoff()}
+
+	tlsSec, err := fetchK8SSecret(ctx, secrets, secConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = recordFailure(ctx, lcm, secrets, secConf, tlsSec, errors.New("authz failed"))
+	if err == nil {
+		t.Errorf("recordFailure returned no error when the Secret couldn't be annotated")
+	}
+	if _, ok := lcm.failures.Until(secConf.FullName()); !ok {
+		t.Errorf("secret wasn't backed off from in memory when its Secret couldn't be annotated")
+	}
+}
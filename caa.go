@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// caaResolver looks up the CAA records at a name. It's an interface so that
+// tests can point it at their own nameserver.
+type caaResolver interface {
+	LookupCAA(ctx context.Context, name string) ([]*dns.CAA, error)
+}
+
+// dnsCAAResolver sends CAA queries to recursive resolvers.
+type dnsCAAResolver struct {
+	nameservers []string // host:port
+}
+
+// newSystemCAAResolver returns a resolver using the nameservers in
+// /etc/resolv.conf, or nil if it can't be read.
+func newSystemCAAResolver() caaResolver {
+	cc, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		log.Printf("unable to read /etc/resolv.conf, not checking CAA records before ordering certs: %s", err)
+		return nil
+	}
+	r := &dnsCAAResolver{}
+	for _, s := range cc.Servers {
+		r.nameservers = append(r.nameservers, net.JoinHostPort(s, cc.Port))
+	}
+	return r
+}
+
+func (r *dnsCAAResolver) LookupCAA(ctx context.Context, name string) ([]*dns.CAA, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeCAA)
+	var lastErr error
+	for _, ns := range r.nameservers {
+		resp, _, err := new(dns.Client).ExchangeContext(ctx, m, ns)
+		if err != nil {
+			lastErr = fmt.Errorf("nameserver %s: %s", ns, err)
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			lastErr = fmt.Errorf("nameserver %s: unexpected response code %s", ns, dns.RcodeToString[resp.Rcode])
+			continue
+		}
+		// A CNAME at the name is followed by the resolver and the CAA
+		// records of its target are returned alongside it.
+		caas := []*dns.CAA{}
+		for _, rr := range resp.Answer {
+			if caa, ok := rr.(*dns.CAA); ok {
+				caas = append(caas, caa)
+			}
+		}
+		return caas, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no nameservers to ask")
+	}
+	return nil, lastErr
+}
+
+// checkCAA returns an error if the CAA records of any of the domains don't
+// allow the CA to issue for them. The CA only checks CAA records after every
+// authorization has been validated, and its error then doesn't say much, so
+// this fails the order before any of that is done. Domains whose CAA records
+// can't be looked up are let through for the CA to decide on.
+func (lc *leClient) checkCAA(ctx context.Context, domains []string) error {
+	if lc.caa == nil {
+		return nil
+	}
+	if len(lc.dir.CAA) == 0 {
+		log.Printf("the CA at %s doesn't list its caaIdentities, not checking CAA records", lc.cl.cl.DirectoryURL)
+		return nil
+	}
+	for _, d := range domains {
+		err := checkDomainCAA(ctx, lc.caa, d, lc.dir.CAA)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDomainCAA finds the relevant CAA record set of the domain by walking up
+// the tree from it, as RFC 8659 describes, and checks that it allows one of the
+// CA's identities to issue for the domain.
+func checkDomainCAA(ctx context.Context, r caaResolver, domain string, identities []string) error {
+	wildcard := strings.HasPrefix(domain, "*.")
+	name := normalizeDomain(strings.TrimPrefix(domain, "*."))
+	for name != "" {
+		caas, err := r.LookupCAA(ctx, name)
+		if err != nil {
+			log.Printf("unable to look up CAA records for %s at %s, leaving the check to the CA: %s", domain, name, err)
+			return nil
+		}
+		if len(caas) != 0 {
+			return caaPermits(domain, name, caas, wildcard, identities)
+		}
+		_, rest, _ := strings.Cut(name, ".")
+		name = rest
+	}
+	return nil
+}
+
+func caaPermits(domain, name string, caas []*dns.CAA, wildcard bool, identities []string) error {
+	issue := []string{}
+	issueWild := []string{}
+	for _, caa := range caas {
+		switch strings.ToLower(caa.Tag) {
+		case "issue":
+			issue = append(issue, caa.Value)
+		case "issuewild":
+			issueWild = append(issueWild, caa.Value)
+		case "iodef":
+		default:
+			if caa.Flag&128 != 0 {
+				return fmt.Errorf("CAA records for %s at %s have the critical tag %#v that CAs must refuse to issue for", domain, name, caa.Tag)
+			}
+		}
+	}
+	values := issue
+	if wildcard && len(issueWild) != 0 {
+		values = issueWild
+	}
+	if len(values) == 0 {
+		// Neither issue nor issuewild records restrict who may issue.
+		return nil
+	}
+	allowed := []string{}
+	for _, v := range values {
+		issuer, _, _ := strings.Cut(v, ";")
+		issuer = strings.TrimSpace(issuer)
+		if issuer == "" {
+			continue
+		}
+		allowed = append(allowed, issuer)
+		for _, id := range identities {
+			if strings.EqualFold(issuer, id) {
+				return nil
+			}
+		}
+	}
+	if len(allowed) == 0 {
+		return fmt.Errorf("CAA records for %s at %s don't allow any CA to issue certificates for it", domain, name)
+	}
+	return fmt.Errorf("CAA records for %s at %s only allow %s to issue certificates for it, not this CA (%s)", domain, name, strings.Join(allowed, ", "), strings.Join(identities, ", "))
+}
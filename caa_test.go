@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/acme"
+)
+
+func TestCheckCAA(t *testing.T) {
+	ts := startTestDNSServer(t, "example.com")
+	ts.SetCAA("example.com.", []*dns.CAA{
+		{Tag: "issue", Value: "letsencrypt.org"},
+		{Tag: "issuewild", Value: ";"},
+		{Tag: "iodef", Value: "mailto:security@example.com"},
+	})
+	ts.SetCAA("other.example.com.", []*dns.CAA{
+		{Tag: "issue", Value: "pki.goog; cansignhttpexchanges=yes"},
+	})
+	ts.SetCAA("critical.example.com.", []*dns.CAA{
+		{Tag: "issue", Value: "letsencrypt.org"},
+		{Flag: 128, Tag: "tbs", Value: "unknown"},
+	})
+	lc := &leClient{
+		cl:  &limitedACMEClient{cl: &acme.Client{DirectoryURL: "https://ca.example.com/directory"}},
+		dir: acme.Directory{CAA: []string{"LetsEncrypt.org"}},
+		caa: &dnsCAAResolver{nameservers: []string{ts.addr}},
+	}
+
+	tests := []struct {
+		domain  string
+		wantErr string
+	}{
+		// Walks up to the records at example.com.
+		{"www.example.com", ""},
+		{"a.b.example.com", ""},
+		{"*.example.com", "don't allow any CA"},
+		{"other.example.com", "only allow pki.goog"},
+		// The records closest to the domain are the only ones that count.
+		{"www.other.example.com", "only allow pki.goog"},
+		{"critical.example.com", `critical tag "tbs"`},
+		// Names outside of the test server's zone are refused and left to
+		// the CA.
+		{"www.example.net", ""},
+	}
+	for _, tc := range tests {
+		err := lc.checkCAA(context.Background(), []string{tc.domain})
+		switch {
+		case tc.wantErr == "" && err != nil:
+			t.Errorf("%s: want no error, got %s", tc.domain, err)
+		case tc.wantErr != "" && err == nil:
+			t.Errorf("%s: want error containing %#v, got none", tc.domain, tc.wantErr)
+		case tc.wantErr != "" && !strings.Contains(err.Error(), tc.wantErr):
+			t.Errorf("%s: want error containing %#v, got %s", tc.domain, tc.wantErr, err)
+		}
+	}
+
+	// CAs that don't say what their CAA identities are can't be checked.
+	lc.dir.CAA = nil
+	if err := lc.checkCAA(context.Background(), []string{"other.example.com"}); err != nil {
+		t.Errorf("CA without caaIdentities: want no error, got %s", err)
+	}
+}
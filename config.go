@@ -3,16 +3,23 @@ package main
 import (
 	"context"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"regexp"
 	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"golang.org/x/crypto/acme"
 )
 
 // newConfLoader does I/O immediately to validate the config file at the given
@@ -68,14 +75,36 @@ func (cl *confLoader) Get() *allConf {
 	cl.confMu.Lock()
 	defer cl.confMu.Unlock()
 	conf := &allConf{
-		Email:                cl.conf.Email,
+		Emails:               slices.Clone(cl.conf.Emails),
 		UseProd:              cl.conf.UseProd != nil && *cl.conf.UseProd,
+		DirectoryURL:         cl.conf.DirectoryURL,
+		EAB:                  cl.conf.EAB.DeepCopy(),
 		AllowRemoteDebug:     cl.conf.AllowRemoteDebug,
 		Secrets:              []*secretConf{},
 		TLSDir:               cl.conf.TLSDir,
 		ConfigCheckInterval:  time.Duration(cl.conf.ConfigCheckInterval),
 		ConfigCheckBootDelay: time.Duration(cl.conf.ConfigCheckBootDelay),
 		StartRenewDur:        time.Duration(cl.conf.StartRenewDur),
+		AccountSecret:        *cl.conf.AccountSecret,
+
+		HTTP01SelfCheckTimeout: time.Duration(cl.conf.HTTP01SelfCheckTimeout),
+		AccountKeyMaxAge:       time.Duration(cl.conf.AccountKeyMaxAge),
+
+		ACMECAs:                     make([]*acmeCAConf, len(cl.conf.ACMECAs)),
+		CAFallbackFailures:          cl.conf.CAFallbackFailures,
+		CAFallbackRemainingLifetime: time.Duration(cl.conf.CAFallbackRemainingLifetime),
+		Concurrency:                 cl.conf.Concurrency,
+	}
+	for i, c := range cl.conf.ACMECAs {
+		conf.ACMECAs[i] = c.DeepCopy()
+	}
+	if cl.conf.DNS01 != nil {
+		conf.DNS01 = &dns01Conf{
+			RFC2136:                *cl.conf.DNS01.RFC2136,
+			PropagationTimeout:     time.Duration(cl.conf.DNS01.PropagationTimeout),
+			PropagationNameservers: slices.Clone(cl.conf.DNS01.PropagationNameservers),
+		}
+		conf.DNS01.RFC2136.TSIGSecret = cl.conf.DNS01.RFC2136.TSIGSecret.DeepCopy()
 	}
 	conf.Secrets = make([]*secretConf, len(cl.conf.Secrets))
 	for i, s := range cl.conf.Secrets {
@@ -165,8 +194,15 @@ func (cl *confLoader) load() error {
 }
 
 type internalAllConf struct {
-	Email               string        `json:"email"`
-	UseProd             *bool         `json:"use_prod"`
+	Email string `json:"email"`
+	// Emails are the contact addresses of the ACME account, for when there's
+	// more than one. It can't be set at the same time as Email.
+	Emails  []string `json:"emails"`
+	UseProd *bool    `json:"use_prod"`
+	// DirectoryURL is the ACME directory of a CA other than Let's Encrypt. It
+	// can't be set at the same time as UseProd.
+	DirectoryURL        string        `json:"acme_directory_url"`
+	EAB                 *eabConf      `json:"external_account_binding"`
 	AllowRemoteDebug    bool          `json:"allow_remote_debug"`
 	Secrets             []*secretConf `json:"secrets"`
 	TLSDir              string        `json:"tls_dir"`
@@ -177,11 +213,67 @@ type internalAllConf struct {
 	// requests from Let's Encrypt before Let's Encrypt can see the node. It
 	// defaults to 1 minute.
 	ConfigCheckBootDelay jsonDuration `json:"config_check_boot_delay"`
+	// AccountSecret is the Secret the ACME account key and its registrations
+	// are kept in. It's only read at boot, so changing it requires a restart.
+	AccountSecret *secretRef `json:"account_secret"`
+	// DNS01 configures how the TXT records for secrets using the dns-01
+	// challenge type are published.
+	DNS01 *internalDNS01Conf `json:"dns01"`
+	// HTTP01SelfCheckTimeout is how long lekube tries to fetch each http-01
+	// challenge response itself before asking the CA to validate it, aborting
+	// the order if it can't. The self-check is off if it's not set.
+	HTTP01SelfCheckTimeout jsonDuration `json:"http01_self_check_timeout"`
+	// AccountKeyMaxAge is how old the ACME account key may get before lekube
+	// rolls it over to a new one. The account key is never rolled over
+	// automatically if it's not set.
+	AccountKeyMaxAge jsonDuration `json:"account_key_max_age"`
+	// ACMECAs are the CAs to order a secret's certs from, in order, when its
+	// usual CA fails and either it's failed ca_fallback_failures times in a
+	// row or the cert expires within ca_fallback_remaining_lifetime. Their
+	// accounts use the top-level emails.
+	ACMECAs []*acmeCAConf `json:"acme_cas"`
+	// CAFallbackFailures defaults to 3.
+	CAFallbackFailures int `json:"ca_fallback_failures"`
+	// CAFallbackRemainingLifetime defaults to 7 days.
+	CAFallbackRemainingLifetime jsonDuration `json:"ca_fallback_remaining_lifetime"`
+	// Concurrency is how many secrets are fetched and have their certs
+	// ordered at once. It defaults to 1.
+	Concurrency int `json:"concurrency"`
+}
+
+// acmeCAConf is a fallback CA from acme_cas.
+type acmeCAConf struct {
+	DirectoryURL string   `json:"acme_directory_url"`
+	EAB          *eabConf `json:"external_account_binding"`
+}
+
+func (ac *acmeCAConf) DeepCopy() *acmeCAConf {
+	return &acmeCAConf{
+		DirectoryURL: ac.DirectoryURL,
+		EAB:          ac.EAB.DeepCopy(),
+	}
+}
+
+type internalDNS01Conf struct {
+	RFC2136 *rfc2136Conf `json:"rfc2136"`
+	// PropagationTimeout is how long to wait for a TXT record to be visible
+	// on all of the PropagationNameservers before giving up on the order. It
+	// defaults to 2 minutes.
+	PropagationTimeout jsonDuration `json:"propagation_timeout"`
+	// PropagationNameservers are the nameservers (as host:port) that must
+	// all return a challenge's TXT record before lekube asks the CA to
+	// validate it. It defaults to the RFC 2136 nameserver.
+	PropagationNameservers []string `json:"propagation_nameservers"`
 }
 
 type allConf struct {
-	Email               string
-	UseProd             bool
+	// Emails are the ACME account's contact addresses. It always has at
+	// least one.
+	Emails       []string
+	UseProd      bool
+	DirectoryURL string
+	// EAB is nil if the CA doesn't need an external account binding.
+	EAB                 *eabConf
 	AllowRemoteDebug    bool
 	Secrets             []*secretConf
 	TLSDir              string
@@ -194,26 +286,236 @@ type allConf struct {
 	ConfigCheckBootDelay time.Duration
 
 	StartRenewDur time.Duration
+
+	// AccountSecret is the Secret the ACME account key and the account URIs
+	// registered with it are stored in.
+	AccountSecret secretRef
+
+	// DNS01 is nil if no DNS provider was configured.
+	DNS01 *dns01Conf
+
+	// HTTP01SelfCheckTimeout is zero if http-01 challenges aren't
+	// self-checked.
+	HTTP01SelfCheckTimeout time.Duration
+
+	// AccountKeyMaxAge is zero if the account key isn't rolled over by age.
+	AccountKeyMaxAge time.Duration
+
+	// ACMECAs are the fallback CAs. It's empty if there are none.
+	ACMECAs                     []*acmeCAConf
+	CAFallbackFailures          int
+	CAFallbackRemainingLifetime time.Duration
+
+	// Concurrency is always at least 1.
+	Concurrency int
+}
+
+type dns01Conf struct {
+	RFC2136                rfc2136Conf
+	PropagationTimeout     time.Duration
+	PropagationNameservers []string
+}
+
+// rfc2136Conf configures the RFC 2136 dynamic update DNS provider.
+type rfc2136Conf struct {
+	// Nameserver is the host:port of the authoritative nameserver to send
+	// updates to. The port defaults to 53.
+	Nameserver    string `json:"nameserver"`
+	TSIGKeyName   string `json:"tsig_key_name"`
+	TSIGAlgorithm string `json:"tsig_algorithm"`
+	// TSIGSecret is the Secret holding the base64 encoded TSIG key.
+	TSIGSecret *secretKeyRef `json:"tsig_secret"`
 }
 
 type secretConf struct {
 	Namespace string   `json:"namespace"`
 	Name      string   `json:"name"`
 	Domains   []string `json:"domains"`
-	UseRSA    bool     `json:"use_rsa"` // use ECDSA if not set or if set to false, RSA for certs
+	// IPAddresses are put in the cert as IP SANs. They can only be validated
+	// with http-01 challenges.
+	IPAddresses []string `json:"ip_addresses"`
+	KeyType     string   `json:"key_type"` // "ecdsa-p256" if not set, "ecdsa-p384", "rsa-2048", "rsa-3072", or "rsa-4096"
+	UseRSA      bool     `json:"use_rsa"`  // deprecated alias for a key_type of "rsa-2048"
+	// ReuseKey keeps the private key already in the secret across renewals
+	// so that SPKI pins and DANE records don't break. MaxKeyAge, if set,
+	// makes a new key be generated once the old one is that old.
+	ReuseKey      bool         `json:"reuse_key"`
+	MaxKeyAge     jsonDuration `json:"max_key_age"`
+	ChallengeType string       `json:"challenge_type"` // "http-01" if not set, "dns-01", or "tls-alpn-01"
+	// RevokeSerials are the hex serial numbers of certs that should be
+	// revoked and replaced if they're found in the secret.
+	RevokeSerials []string `json:"revoke_serials"`
+	RevokeReason  string   `json:"revoke_reason"` // "unspecified" if not set, or another RFC 5280 reason like "keyCompromise"
+	// DualKey, if set, has a second cert with a different key type ordered
+	// for the same domains and stored alongside tls.crt and tls.key.
+	DualKey *dualKeyConf `json:"dual_key"`
+	// Profile is the name of the ACME certificate profile, like "tlsserver"
+	// or "shortlived", to order the cert under. It must be one the CA
+	// advertises in its directory. The CA's default profile is used if not
+	// set.
+	Profile string `json:"profile"`
+	// PreferredChain is the CommonName of the root that the stored chain
+	// should lead to, if the CA offers such a chain. The CA's default chain is
+	// used if not set or if no chain matches.
+	PreferredChain string `json:"preferred_chain"`
+	// Email, Emails, UseProd, and DirectoryURL override the top-level
+	// settings of the same names to order the secret's certs from another CA
+	// or under an account with other contacts. A secret with emails other
+	// than the top-level ones gets an account of its own, with a key of its
+	// own, at its CA.
+	Email        string   `json:"email"`
+	Emails       []string `json:"emails"`
+	UseProd      *bool    `json:"use_prod"`
+	DirectoryURL string   `json:"acme_directory_url"`
 }
 
+const (
+	keyTypeECDSAP256 = "ecdsa-p256"
+	keyTypeECDSAP384 = "ecdsa-p384"
+	keyTypeRSA2048   = "rsa-2048"
+	keyTypeRSA3072   = "rsa-3072"
+	keyTypeRSA4096   = "rsa-4096"
+)
+
+var keyTypes = []string{keyTypeECDSAP256, keyTypeECDSAP384, keyTypeRSA2048, keyTypeRSA3072, keyTypeRSA4096}
+
+const (
+	challengeHTTP01    = "http-01"
+	challengeDNS01     = "dns-01"
+	challengeTLSALPN01 = "tls-alpn-01"
+)
+
 func (sconf *secretConf) FullName() nsSecName {
 	return nsSecName{sconf.Namespace, sconf.Name}
 }
 
 func (sconf *secretConf) DeepCopy() *secretConf {
 	return &secretConf{
-		Namespace: sconf.Namespace,
-		Name:      sconf.Name,
-		Domains:   slices.Clone(sconf.Domains),
-		UseRSA:    sconf.UseRSA,
+		Namespace:      sconf.Namespace,
+		Name:           sconf.Name,
+		Domains:        slices.Clone(sconf.Domains),
+		IPAddresses:    slices.Clone(sconf.IPAddresses),
+		KeyType:        sconf.KeyType,
+		UseRSA:         sconf.UseRSA,
+		ReuseKey:       sconf.ReuseKey,
+		MaxKeyAge:      sconf.MaxKeyAge,
+		ChallengeType:  sconf.ChallengeType,
+		RevokeSerials:  slices.Clone(sconf.RevokeSerials),
+		RevokeReason:   sconf.RevokeReason,
+		DualKey:        sconf.DualKey.DeepCopy(),
+		Profile:        sconf.Profile,
+		PreferredChain: sconf.PreferredChain,
+		Email:          sconf.Email,
+		Emails:         slices.Clone(sconf.Emails),
+		UseProd:        copyBoolPtr(sconf.UseProd),
+		DirectoryURL:   sconf.DirectoryURL,
+	}
+}
+
+func copyBoolPtr(b *bool) *bool {
+	if b == nil {
+		return nil
+	}
+	b2 := *b
+	return &b2
+}
+
+// dualKeyConf is the second cert of a secret in dual_key mode, for serving
+// ECDSA certs to modern clients and RSA certs to legacy ones out of the same
+// Secret.
+type dualKeyConf struct {
+	KeyType     string `json:"key_type"`      // "rsa-2048" if not set
+	CertDataKey string `json:"cert_data_key"` // "tls-rsa.crt" if not set
+	KeyDataKey  string `json:"key_data_key"`  // "tls-rsa.key" if not set
+}
+
+func (dk *dualKeyConf) DeepCopy() *dualKeyConf {
+	if dk == nil {
+		return nil
+	}
+	dk2 := *dk
+	return &dk2
+}
+
+// certSlot is where in a Secret a cert and its private key are stored and the
+// type of key they're made with. Every secret has the tls.crt and tls.key
+// slot, and secrets with dual_key set have a second one.
+type certSlot struct {
+	CertDataKey string
+	KeyDataKey  string
+	KeyType     string
+}
+
+func (sconf *secretConf) certSlots() []certSlot {
+	slots := []certSlot{{CertDataKey: "tls.crt", KeyDataKey: "tls.key", KeyType: sconf.KeyType}}
+	if sconf.DualKey != nil {
+		slots = append(slots, certSlot{CertDataKey: sconf.DualKey.CertDataKey, KeyDataKey: sconf.DualKey.KeyDataKey, KeyType: sconf.DualKey.KeyType})
+	}
+	return slots
+}
+
+// shouldRevoke returns true if the cert's serial is in the secret's
+// revoke_serials.
+func (sconf *secretConf) shouldRevoke(cert *x509.Certificate) bool {
+	for _, s := range sconf.RevokeSerials {
+		serial, err := parseSerial(s)
+		if err == nil && serial.Cmp(cert.SerialNumber) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// revokeReason returns the revoke_reason of the secret. It's been checked by
+// validateConf.
+func (sconf *secretConf) revokeReason() acme.CRLReasonCode {
+	reason, _ := parseRevocationReason(sconf.RevokeReason)
+	return reason
+}
+
+// eabConf is the External Account Binding that CAs like ZeroSSL and Google
+// Trust Services require to be attached to new ACME accounts.
+type eabConf struct {
+	KeyID string `json:"key_id"`
+	// HMACKey is the Secret holding the base64url encoded HMAC key the CA
+	// handed out with KeyID.
+	HMACKey *secretKeyRef `json:"hmac_key"`
+}
+
+func (ec *eabConf) DeepCopy() *eabConf {
+	if ec == nil {
+		return nil
+	}
+	return &eabConf{
+		KeyID:   ec.KeyID,
+		HMACKey: ec.HMACKey.DeepCopy(),
+	}
+}
+
+// secretRef points to a Secret that isn't managed as a TLS certificate by
+// lekube.
+type secretRef struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+func (sr *secretRef) FullName() nsSecName {
+	return nsSecName{sr.Namespace, sr.Name}
+}
+
+// secretKeyRef points to a single value inside of a Secret.
+type secretKeyRef struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Key       string `json:"key"`
+}
+
+func (sr *secretKeyRef) DeepCopy() *secretKeyRef {
+	if sr == nil {
+		return nil
 	}
+	c := *sr
+	return &c
 }
 
 type nsSecName struct {
@@ -253,12 +555,51 @@ func (d jsonDuration) String() string {
 }
 
 func dirURLFromConf(conf *allConf) string {
-	if conf.UseProd {
+	return directoryURL(conf.DirectoryURL, conf.UseProd)
+}
+
+// directoryURL returns dirURL if it's set, and otherwise the Let's Encrypt
+// production or staging directory.
+func directoryURL(dirURL string, useProd bool) string {
+	if dirURL != "" {
+		return strings.TrimRight(dirURL, "/")
+	}
+	if useProd {
 		return "https://acme-v02.api.letsencrypt.org/directory"
 	}
 	return "https://acme-staging-v02.api.letsencrypt.org/directory"
 }
 
+// secretDirectoryURL returns the ACME directory the secret's certs are ordered
+// from, given the top-level one.
+func secretDirectoryURL(secConf *secretConf, topDirURL string) string {
+	if secConf.DirectoryURL != "" {
+		return directoryURL(secConf.DirectoryURL, false)
+	}
+	if secConf.UseProd != nil {
+		return directoryURL("", *secConf.UseProd)
+	}
+	return topDirURL
+}
+
+// accountFor returns the ACME directory and contact emails of the account the
+// secret's certs are ordered under. The top-level external account binding is
+// only returned for secrets using the top-level directory, and is nil
+// otherwise.
+func (conf *allConf) accountFor(secConf *secretConf) (string, []string, *eabConf) {
+	topDirURL := dirURLFromConf(conf)
+	dirURL := secretDirectoryURL(secConf, topDirURL)
+	emails := conf.Emails
+	if len(secConf.Emails) != 0 {
+		emails = secConf.Emails
+	}
+	var eab *eabConf
+	if dirURL == topDirURL {
+		eab = conf.EAB
+	}
+	return dirURL, emails, eab
+}
+
 func unmarshalConf(jsonData []byte) (*internalAllConf, error) {
 	conf := &internalAllConf{}
 	err := json.Unmarshal(jsonData, conf)
@@ -274,18 +615,110 @@ func unmarshalConf(jsonData []byte) (*internalAllConf, error) {
 	if conf.ConfigCheckBootDelay == jsonDuration(0) {
 		conf.ConfigCheckBootDelay = jsonDuration(1 * time.Minute)
 	}
+	if conf.AccountSecret == nil {
+		conf.AccountSecret = &secretRef{Namespace: "default", Name: "lekube-account"}
+	}
+	if conf.CAFallbackFailures == 0 {
+		conf.CAFallbackFailures = 3
+	}
+	if conf.CAFallbackRemainingLifetime == jsonDuration(0) {
+		conf.CAFallbackRemainingLifetime = jsonDuration(7 * 24 * time.Hour)
+	}
+	if conf.Concurrency == 0 {
+		conf.Concurrency = 1
+	}
+	if conf.DNS01 != nil {
+		if conf.DNS01.PropagationTimeout == jsonDuration(0) {
+			conf.DNS01.PropagationTimeout = jsonDuration(2 * time.Minute)
+		}
+		if conf.DNS01.RFC2136 != nil {
+			ns := conf.DNS01.RFC2136.Nameserver
+			if _, _, err := net.SplitHostPort(ns); err != nil && ns != "" {
+				conf.DNS01.RFC2136.Nameserver = net.JoinHostPort(ns, "53")
+			}
+			if len(conf.DNS01.PropagationNameservers) == 0 {
+				conf.DNS01.PropagationNameservers = []string{conf.DNS01.RFC2136.Nameserver}
+			}
+		}
+	}
 	return conf, err
 }
 
 func validateConf(conf *internalAllConf) error {
-	if conf.Email == "" {
+	if conf.Email == "" && len(conf.Emails) == 0 {
 		return fmt.Errorf("'email' must be set in the config file %#v", *confPath)
 	}
+	emails, err := normalizeEmails(conf.Email, conf.Emails)
+	if err != nil {
+		return fmt.Errorf("in the config file %#v, %s", *confPath, err)
+	}
+	conf.Emails = emails
 
-	if conf.UseProd == nil {
+	if conf.DirectoryURL != "" {
+		if conf.UseProd != nil {
+			return fmt.Errorf("'use_prod' and 'acme_directory_url' can't both be set. 'use_prod' picks between the Let's Encrypt production and staging APIs, while 'acme_directory_url' is for using another CA")
+		}
+		if err := validateDirectoryURL(conf.DirectoryURL); err != nil {
+			return err
+		}
+	} else if conf.UseProd == nil {
 		return fmt.Errorf("'use_prod' must be set to `false` or `true`. `false will mean use the staging Let's Encrypt API (which has untrusted certs and higher rate limits), and `true` means use the production Let's Encrypt API with working certs but much lower rate limits. lekube strongly recommends setting this to `false` until you've seen your staging certs be successfully created")
 	}
 
+	if conf.AccountSecret.Name == "" || conf.AccountSecret.Namespace == "" {
+		return fmt.Errorf("'account_secret' must have both a namespace and a name set")
+	}
+
+	if conf.EAB != nil {
+		if err := validateEAB(conf.EAB); err != nil {
+			return err
+		}
+	}
+
+	if conf.HTTP01SelfCheckTimeout < 0 {
+		return fmt.Errorf("'http01_self_check_timeout' must not be negative")
+	}
+	if conf.AccountKeyMaxAge < 0 {
+		return fmt.Errorf("'account_key_max_age' must not be negative")
+	}
+
+	if conf.DNS01 != nil {
+		if err := validateDNS01Conf(conf.DNS01); err != nil {
+			return err
+		}
+	}
+
+	if conf.CAFallbackFailures < 0 {
+		return fmt.Errorf("'ca_fallback_failures' must not be negative")
+	}
+	if conf.CAFallbackRemainingLifetime < 0 {
+		return fmt.Errorf("'ca_fallback_remaining_lifetime' must not be negative")
+	}
+	if conf.Concurrency < 0 {
+		return fmt.Errorf("'concurrency' must not be negative")
+	}
+
+	topDirURL := directoryURL(conf.DirectoryURL, conf.UseProd != nil && *conf.UseProd)
+	// dirsFrom is the part of the config each CA's directory is set by.
+	dirsFrom := map[string]string{topDirURL: "the top-level config"}
+	for i, c := range conf.ACMECAs {
+		if c == nil || c.DirectoryURL == "" {
+			return fmt.Errorf("no 'acme_directory_url' given for the CA at index %d in 'acme_cas'", i)
+		}
+		if err := validateDirectoryURL(c.DirectoryURL); err != nil {
+			return fmt.Errorf("in 'acme_cas', %s", err)
+		}
+		if c.EAB != nil {
+			if err := validateEAB(c.EAB); err != nil {
+				return fmt.Errorf("in 'acme_cas', %s", err)
+			}
+		}
+		dirURL := directoryURL(c.DirectoryURL, false)
+		if from, ok := dirsFrom[dirURL]; ok {
+			return fmt.Errorf("the ACME directory %s in 'acme_cas' is already used by %s", dirURL, from)
+		}
+		dirsFrom[dirURL] = "'acme_cas'"
+	}
 	secs := make(map[nsSecName]bool)
 	for i, secConf := range conf.Secrets {
 		if secConf.Name == "" {
@@ -299,16 +732,208 @@ func validateConf(conf *internalAllConf) error {
 			return fmt.Errorf("duplicate config for secret %s", secConf.Name)
 		}
 		secs[name] = true
-		if len(secConf.Domains) == 0 {
-			return fmt.Errorf("no domains given for secret %s", secConf.Name)
+		if name == conf.AccountSecret.FullName() {
+			return fmt.Errorf("secret %s is used as the 'account_secret' and cannot also hold a certificate", name)
+		}
+		if len(secConf.Domains) == 0 && len(secConf.IPAddresses) == 0 {
+			return fmt.Errorf("no domains or ip_addresses given for secret %s", secConf.Name)
 		}
 		for j, d := range secConf.Domains {
 			d = strings.TrimSpace(d)
 			if d == "" {
 				return fmt.Errorf("empty string in domains of secret config at index %d in \"secrets\"", j)
 			}
+			if strings.Contains(d, "*") {
+				if err := validateWildcard(d); err != nil {
+					return fmt.Errorf("invalid wildcard domain %#v in secret %s: %s", d, secConf.Name, err)
+				}
+				if conf.DNS01 == nil {
+					return fmt.Errorf("wildcard domain %#v in secret %s can only be validated with a dns-01 challenge but no \"dns01\" provider is configured", d, secConf.Name)
+				}
+			}
 			secConf.Domains[j] = d
 		}
+		switch secConf.ChallengeType {
+		case "":
+			secConf.ChallengeType = challengeHTTP01
+		case challengeHTTP01:
+		case challengeDNS01:
+			if conf.DNS01 == nil {
+				return fmt.Errorf("secret %s uses challenge_type %#v but no \"dns01\" provider is configured", secConf.Name, challengeDNS01)
+			}
+		case challengeTLSALPN01:
+			if conf.TLSDir == "" {
+				return fmt.Errorf("secret %s uses challenge_type %#v but 'tls_dir' isn't set, so the HTTPS server the challenge is served on won't be booted", secConf.Name, challengeTLSALPN01)
+			}
+		default:
+			return fmt.Errorf("unknown challenge_type %#v for secret %s, must be %#v, %#v, or %#v", secConf.ChallengeType, secConf.Name, challengeHTTP01, challengeDNS01, challengeTLSALPN01)
+		}
+		for j, ip := range secConf.IPAddresses {
+			addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+			if err != nil {
+				return fmt.Errorf("invalid IP address %#v in ip_addresses of secret %s: %s", ip, secConf.Name, err)
+			}
+			if addr.Zone() != "" {
+				return fmt.Errorf("IP address %#v in ip_addresses of secret %s must not have a zone", ip, secConf.Name)
+			}
+			// RFC 8738 identifiers are in the canonical form, and so is how
+			// domainMismatch compares them to the cert's.
+			secConf.IPAddresses[j] = addr.Unmap().String()
+		}
+		if len(secConf.IPAddresses) != 0 && secConf.ChallengeType != challengeHTTP01 {
+			return fmt.Errorf("secret %s has ip_addresses, which can only be validated with %#v challenges, but uses challenge_type %#v", secConf.Name, challengeHTTP01, secConf.ChallengeType)
+		}
+		switch {
+		case secConf.KeyType == "" && secConf.UseRSA:
+			log.Printf("'use_rsa' in secret %s is deprecated, set 'key_type' to %#v instead", secConf.Name, keyTypeRSA2048)
+			secConf.KeyType = keyTypeRSA2048
+		case secConf.KeyType == "":
+			secConf.KeyType = keyTypeECDSAP256
+		case !slices.Contains(keyTypes, secConf.KeyType):
+			return fmt.Errorf("unknown key_type %#v for secret %s, must be one of %s", secConf.KeyType, secConf.Name, strings.Join(keyTypes, ", "))
+		case secConf.UseRSA && !strings.HasPrefix(secConf.KeyType, "rsa-"):
+			return fmt.Errorf("secret %s sets 'use_rsa' but also sets 'key_type' to %#v", secConf.Name, secConf.KeyType)
+		}
+		if secConf.MaxKeyAge < 0 {
+			return fmt.Errorf("'max_key_age' in secret %s must not be negative", secConf.Name)
+		}
+		if secConf.MaxKeyAge != 0 && !secConf.ReuseKey {
+			return fmt.Errorf("secret %s sets 'max_key_age' but a new key is generated for every cert unless 'reuse_key' is set", secConf.Name)
+		}
+		if secConf.DualKey != nil {
+			if err := validateDualKey(secConf); err != nil {
+				return err
+			}
+		}
+		for _, serial := range secConf.RevokeSerials {
+			if _, err := parseSerial(serial); err != nil {
+				return fmt.Errorf("bad 'revoke_serials' in secret %s: %s", secConf.Name, err)
+			}
+		}
+		if _, err := parseRevocationReason(secConf.RevokeReason); err != nil {
+			return fmt.Errorf("bad 'revoke_reason' in secret %s: %s", secConf.Name, err)
+		}
+		if secConf.Email != "" || len(secConf.Emails) != 0 {
+			secConf.Emails, err = normalizeEmails(secConf.Email, secConf.Emails)
+			if err != nil {
+				return fmt.Errorf("in secret %s, %s", secConf.Name, err)
+			}
+		}
+		if secConf.DirectoryURL != "" {
+			if secConf.UseProd != nil {
+				return fmt.Errorf("secret %s sets both 'use_prod' and 'acme_directory_url'", secConf.Name)
+			}
+			if err := validateDirectoryURL(secConf.DirectoryURL); err != nil {
+				return fmt.Errorf("in secret %s, %s", secConf.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func validateEAB(eab *eabConf) error {
+	if eab.KeyID == "" {
+		return fmt.Errorf("'external_account_binding' must have a key_id set")
+	}
+	ref := eab.HMACKey
+	if ref == nil || ref.Namespace == "" || ref.Name == "" || ref.Key == "" {
+		return fmt.Errorf("'external_account_binding' must have an hmac_key with a namespace, name, and key of the Secret holding the HMAC key")
+	}
+	return nil
+}
+
+// normalizeEmails returns the contact emails given by the 'email' and 'emails'
+// settings, which can't both be set.
+func normalizeEmails(email string, emails []string) ([]string, error) {
+	if email != "" {
+		if len(emails) != 0 {
+			return nil, fmt.Errorf("'email' and 'emails' can't both be set")
+		}
+		emails = []string{email}
+	}
+	normed := []string{}
+	for _, e := range emails {
+		n := strings.TrimPrefix(strings.TrimSpace(e), "mailto:")
+		if n == "" || strings.ContainsAny(n, " ,") {
+			return nil, fmt.Errorf("email %#v is not a single email address", e)
+		}
+		normed = append(normed, n)
+	}
+	return normed, nil
+}
+
+// secretDataKeyRE is the set of keys Kubernetes allows in a Secret's data.
+var secretDataKeyRE = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+
+func validateDualKey(secConf *secretConf) error {
+	dk := secConf.DualKey
+	if dk.KeyType == "" {
+		dk.KeyType = keyTypeRSA2048
+	}
+	if dk.CertDataKey == "" {
+		dk.CertDataKey = "tls-rsa.crt"
+	}
+	if dk.KeyDataKey == "" {
+		dk.KeyDataKey = "tls-rsa.key"
+	}
+	if !slices.Contains(keyTypes, dk.KeyType) {
+		return fmt.Errorf("unknown 'dual_key' key_type %#v for secret %s, must be one of %s", dk.KeyType, secConf.Name, strings.Join(keyTypes, ", "))
+	}
+	if dk.KeyType == secConf.KeyType {
+		return fmt.Errorf("'dual_key' key_type in secret %s is %#v, the same as the secret's own key_type", secConf.Name, dk.KeyType)
+	}
+	for _, k := range []string{dk.CertDataKey, dk.KeyDataKey} {
+		if !secretDataKeyRE.MatchString(k) {
+			return fmt.Errorf("'dual_key' data key %#v in secret %s isn't a valid Secret data key", k, secConf.Name)
+		}
+		if k == "tls.crt" || k == "tls.key" {
+			return fmt.Errorf("'dual_key' data key %#v in secret %s would overwrite the secret's primary cert", k, secConf.Name)
+		}
+	}
+	if dk.CertDataKey == dk.KeyDataKey {
+		return fmt.Errorf("'dual_key' cert_data_key and key_data_key in secret %s must be different", secConf.Name)
+	}
+	return nil
+}
+
+func validateDirectoryURL(dirURL string) error {
+	u, err := url.Parse(dirURL)
+	if err != nil {
+		return fmt.Errorf("unable to parse 'acme_directory_url' %#v: %s", dirURL, err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("'acme_directory_url' %#v must be an https URL", dirURL)
+	}
+	return nil
+}
+
+// validateWildcard checks that the only wildcard in the domain is the entire
+// leftmost label, and that it's not a wildcard for an entire TLD.
+func validateWildcard(d string) error {
+	if !strings.HasPrefix(d, "*.") || strings.Count(d, "*") != 1 {
+		return errors.New("wildcards must be the entire leftmost label, like \"*.example.com\"")
+	}
+	if strings.Count(strings.TrimSuffix(d, "."), ".") < 2 {
+		return errors.New("wildcards must be under a registered domain, not a top-level domain")
+	}
+	return nil
+}
+
+func validateDNS01Conf(conf *internalDNS01Conf) error {
+	if conf.RFC2136 == nil {
+		return fmt.Errorf("\"dns01\" must have a DNS provider configured in it, like \"rfc2136\"")
+	}
+	if conf.RFC2136.Nameserver == "" {
+		return fmt.Errorf("\"rfc2136\" in \"dns01\" must have a nameserver set")
+	}
+	if conf.RFC2136.TSIGKeyName != "" {
+		ref := conf.RFC2136.TSIGSecret
+		if ref == nil || ref.Namespace == "" || ref.Name == "" || ref.Key == "" {
+			return fmt.Errorf("\"rfc2136\" in \"dns01\" has a tsig_key_name set and so must have a tsig_secret with a namespace, name, and key")
+		}
+		if conf.RFC2136.TSIGAlgorithm == "" {
+			conf.RFC2136.TSIGAlgorithm = "hmac-sha256."
+		}
 	}
 	return nil
 }
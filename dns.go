@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnsProvider publishes and removes the TXT records used to solve ACME DNS-01
+// challenges.
+type dnsProvider interface {
+	// Present adds a TXT record with the given value at fqdn without removing
+	// any other TXT records at fqdn.
+	Present(ctx context.Context, fqdn, value string) error
+	// CleanUp removes the TXT record with the given value at fqdn that was
+	// added by Present.
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// dns01Solver publishes DNS-01 challenge records with its provider and waits
+// for them to be visible on the given nameservers before lekube asks the CA to
+// validate them.
+type dns01Solver struct {
+	provider           dnsProvider
+	nameservers        []string
+	propagationTimeout time.Duration
+}
+
+func newDNS01SolverFromConf(conf *dns01Conf, tsigSecret string) *dns01Solver {
+	return &dns01Solver{
+		provider: &rfc2136Provider{
+			nameserver:    conf.RFC2136.Nameserver,
+			tsigKeyName:   conf.RFC2136.TSIGKeyName,
+			tsigAlgorithm: conf.RFC2136.TSIGAlgorithm,
+			tsigSecret:    tsigSecret,
+			ttl:           60,
+		},
+		nameservers:        conf.PropagationNameservers,
+		propagationTimeout: conf.PropagationTimeout,
+	}
+}
+
+// challengeFQDN returns the name of the TXT record the CA will look up to
+// validate a DNS-01 challenge for the given domain.
+func challengeFQDN(domain string) string {
+	return dns.Fqdn("_acme-challenge." + strings.TrimPrefix(domain, "*."))
+}
+
+// WaitForPropagation blocks until every one of the solver's nameservers
+// returns a TXT record at fqdn with the given value or the propagation timeout
+// passes.
+func (s *dns01Solver) WaitForPropagation(ctx context.Context, fqdn, value string) error {
+	ctx, cancel := context.WithTimeout(ctx, s.propagationTimeout)
+	defer cancel()
+	var lastErr error
+	for {
+		lastErr = nil
+		for _, ns := range s.nameservers {
+			vals, err := lookupTXT(ctx, ns, fqdn)
+			if err != nil {
+				lastErr = fmt.Errorf("nameserver %s: %s", ns, err)
+				break
+			}
+			if !slices.Contains(vals, value) {
+				lastErr = fmt.Errorf("nameserver %s returned TXT values %#v", ns, vals)
+				break
+			}
+		}
+		if lastErr == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("TXT record %s with value %#v did not propagate within %s: %s", fqdn, value, s.propagationTimeout, lastErr)
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+func lookupTXT(ctx context.Context, nameserver, fqdn string) ([]string, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(fqdn, dns.TypeTXT)
+	m.RecursionDesired = false
+	resp, _, err := new(dns.Client).ExchangeContext(ctx, m, nameserver)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("unexpected response code %s", dns.RcodeToString[resp.Rcode])
+	}
+	vals := []string{}
+	for _, rr := range resp.Answer {
+		if txt, ok := rr.(*dns.TXT); ok {
+			vals = append(vals, strings.Join(txt.Txt, ""))
+		}
+	}
+	return vals, nil
+}
+
+// rfc2136Provider publishes TXT records with RFC 2136 dynamic updates sent to
+// an authoritative nameserver, optionally signed with TSIG.
+type rfc2136Provider struct {
+	nameserver    string // host:port
+	tsigKeyName   string
+	tsigAlgorithm string
+	tsigSecret    string // base64 encoded
+	ttl           uint32
+}
+
+func (p *rfc2136Provider) Present(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, true)
+}
+
+func (p *rfc2136Provider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, false)
+}
+
+func (p *rfc2136Provider) update(ctx context.Context, fqdn, value string, insert bool) error {
+	zone, err := p.findZone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	rr := &dns.TXT{
+		Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: p.ttl},
+		Txt: []string{value},
+	}
+	m := new(dns.Msg)
+	m.SetUpdate(zone)
+	if insert {
+		m.Insert([]dns.RR{rr})
+	} else {
+		m.Remove([]dns.RR{rr})
+	}
+	c := new(dns.Client)
+	if p.tsigKeyName != "" {
+		keyName := dns.Fqdn(p.tsigKeyName)
+		m.SetTsig(keyName, dns.Fqdn(p.tsigAlgorithm), 300, time.Now().Unix())
+		c.TsigSecret = map[string]string{keyName: p.tsigSecret}
+	}
+	resp, _, err := c.ExchangeContext(ctx, m, p.nameserver)
+	if err != nil {
+		return fmt.Errorf("unable to send DNS update for %s in zone %s to %s: %s", fqdn, zone, p.nameserver, err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("DNS update for %s in zone %s rejected by %s with %s", fqdn, zone, p.nameserver, dns.RcodeToString[resp.Rcode])
+	}
+	log.Printf("rfc2136: updated TXT record %s in zone %s (insert: %t)", fqdn, zone, insert)
+	return nil
+}
+
+// findZone asks the nameserver for the SOA of fqdn, which an authoritative
+// server returns in either the answer or authority section, to learn what
+// zone the record has to be updated in.
+func (p *rfc2136Provider) findZone(ctx context.Context, fqdn string) (string, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(fqdn, dns.TypeSOA)
+	m.RecursionDesired = false
+	resp, _, err := new(dns.Client).ExchangeContext(ctx, m, p.nameserver)
+	if err != nil {
+		return "", fmt.Errorf("unable to look up zone of %s at %s: %s", fqdn, p.nameserver, err)
+	}
+	for _, rr := range append(resp.Answer, resp.Ns...) {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Hdr.Name, nil
+		}
+	}
+	return "", fmt.Errorf("no SOA record for the zone of %s found at %s", fqdn, p.nameserver)
+}
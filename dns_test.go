@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	testTSIGKeyName = "lekube."
+	testTSIGSecret  = "c2VjcmV0LXNlY3JldC1zZWNyZXQtc2VjcmV0IQ=="
+)
+
+// testDNSServer is a tiny authoritative nameserver for a single zone that
+// accepts TSIG signed RFC 2136 updates of TXT records.
+type testDNSServer struct {
+	zone string
+	addr string
+
+	mu  sync.Mutex
+	txt map[string][]string
+	caa map[string][]*dns.CAA
+}
+
+func startTestDNSServer(t *testing.T, zone string) *testDNSServer {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &testDNSServer{
+		zone: dns.Fqdn(zone),
+		addr: pc.LocalAddr().String(),
+		txt:  make(map[string][]string),
+		caa:  make(map[string][]*dns.CAA),
+	}
+	started := make(chan struct{})
+	srv := &dns.Server{
+		PacketConn:        pc,
+		Handler:           ts,
+		TsigSecret:        map[string]string{testTSIGKeyName: testTSIGSecret},
+		NotifyStartedFunc: func() { close(started) },
+		// The default accept func turns away UPDATE messages.
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return ts
+}
+
+// SetCAA sets the CAA records served for the name. The server's goroutines
+// read them, so they're only set with ts.mu held.
+func (ts *testDNSServer) SetCAA(name string, records []*dns.CAA) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.caa[strings.ToLower(name)] = records
+}
+
+func (ts *testDNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	q := r.Question[0]
+	switch {
+	case r.Opcode == dns.OpcodeUpdate:
+		if r.IsTsig() == nil || w.TsigStatus() != nil {
+			m.Rcode = dns.RcodeRefused
+			break
+		}
+		for _, rr := range r.Ns {
+			txt, ok := rr.(*dns.TXT)
+			if !ok {
+				continue
+			}
+			val := strings.Join(txt.Txt, "")
+			name := strings.ToLower(txt.Hdr.Name)
+			if txt.Hdr.Class == dns.ClassNONE {
+				ts.txt[name] = slices.DeleteFunc(ts.txt[name], func(v string) bool { return v == val })
+			} else {
+				ts.txt[name] = append(ts.txt[name], val)
+			}
+		}
+		m.SetTsig(testTSIGKeyName, dns.HmacSHA256, 300, time.Now().Unix())
+	case !dns.IsSubDomain(ts.zone, q.Name):
+		m.Rcode = dns.RcodeRefused
+	case q.Qtype == dns.TypeTXT && len(ts.txt[strings.ToLower(q.Name)]) != 0:
+		for _, v := range ts.txt[strings.ToLower(q.Name)] {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{v},
+			})
+		}
+	case q.Qtype == dns.TypeCAA && len(ts.caa[strings.ToLower(q.Name)]) != 0:
+		for _, caa := range ts.caa[strings.ToLower(q.Name)] {
+			rr := *caa
+			rr.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCAA, Class: dns.ClassINET, Ttl: 60}
+			m.Answer = append(m.Answer, &rr)
+		}
+	default:
+		m.Ns = append(m.Ns, &dns.SOA{
+			Hdr:    dns.RR_Header{Name: ts.zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+			Ns:     "ns1." + ts.zone,
+			Mbox:   "hostmaster." + ts.zone,
+			Serial: 1,
+		})
+	}
+	w.WriteMsg(m)
+}
+
+func TestRFC2136ProviderPresentAndCleanUp(t *testing.T) {
+	ts := startTestDNSServer(t, "example.com")
+	solver := &dns01Solver{
+		provider: &rfc2136Provider{
+			nameserver:    ts.addr,
+			tsigKeyName:   "lekube",
+			tsigAlgorithm: dns.HmacSHA256,
+			tsigSecret:    testTSIGSecret,
+			ttl:           60,
+		},
+		nameservers:        []string{ts.addr},
+		propagationTimeout: 5 * time.Second,
+	}
+	ctx := context.Background()
+	fqdn := challengeFQDN("www.example.com")
+	if fqdn != "_acme-challenge.www.example.com." {
+		t.Fatalf("challengeFQDN: want %#v, got %#v", "_acme-challenge.www.example.com.", fqdn)
+	}
+
+	err := solver.provider.Present(ctx, fqdn, "first")
+	if err != nil {
+		t.Fatalf("Present: %s", err)
+	}
+	err = solver.provider.Present(ctx, fqdn, "second")
+	if err != nil {
+		t.Fatalf("Present: %s", err)
+	}
+	err = solver.WaitForPropagation(ctx, fqdn, "second")
+	if err != nil {
+		t.Fatalf("WaitForPropagation: %s", err)
+	}
+
+	err = solver.provider.CleanUp(ctx, fqdn, "second")
+	if err != nil {
+		t.Fatalf("CleanUp: %s", err)
+	}
+	vals, err := lookupTXT(ctx, ts.addr, fqdn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(vals, []string{"first"}) {
+		t.Errorf("TXT values after CleanUp: want %#v, got %#v", []string{"first"}, vals)
+	}
+}
+
+func TestRFC2136ProviderBadTSIG(t *testing.T) {
+	ts := startTestDNSServer(t, "example.com")
+	p := &rfc2136Provider{
+		nameserver:    ts.addr,
+		tsigKeyName:   "lekube",
+		tsigAlgorithm: dns.HmacSHA256,
+		tsigSecret:    "bm90LXRoZS1yaWdodC1zZWNyZXQ=",
+		ttl:           60,
+	}
+	err := p.Present(context.Background(), challengeFQDN("www.example.com"), "value")
+	if err == nil || !strings.Contains(err.Error(), "REFUSED") {
+		t.Fatalf("Present with the wrong TSIG secret: want REFUSED error, got %v", err)
+	}
+}
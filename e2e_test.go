@@ -0,0 +1,1131 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/time/rate"
+	kubeapi "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// testCA is an in-process stand-in for an ACME CA like Pebble. It only offers
+// http-01 challenges, which it validates by asking the responder directly
+// instead of over the network, and issues certs from its own root that last
+// for certLifetime. Certs are only revoked with the account key.
+type testCA struct {
+	srv       *httptest.Server
+	responder http.Handler
+
+	rootKey *ecdsa.PrivateKey
+	root    *x509.Certificate
+
+	mu           sync.Mutex
+	certLifetime time.Duration
+	nextID       int
+	nonce        int
+	accounts     map[string]*testAccount // by account URL
+	orders       map[string]*testOrder   // by order URL
+	authzs       map[string]*testAuthz   // by authz URL
+	chals        map[string]*testAuthz   // by challenge URL
+	certs        map[string][]byte       // PEM chains by cert URL
+	// issued are the certs issued so far, oldest first.
+	issued []*x509.Certificate
+	// revoked are the hex serials of the certs revoked so far.
+	revoked map[string]bool
+	// revokeRequests counts the revocation requests, including the ones
+	// for certs that were already revoked.
+	revokeRequests int
+	// rejectOrders makes new-order requests fail if it's set.
+	rejectOrders bool
+	// rateLimitOrders makes new-order requests fail with a rate limit if
+	// it's set.
+	rateLimitOrders bool
+	// challengeThumbprint, if set, is the thumbprint new authzs expect key
+	// authorizations for instead of the ordering account's.
+	challengeThumbprint string
+}
+
+type testAccount struct {
+	url        string
+	key        *jose.JSONWebKey
+	thumbprint string
+	contact    []string
+}
+
+type testOrder struct {
+	url         string
+	account     string
+	status      string
+	identifiers []string
+	authzURLs   []string
+	finalizeURL string
+	certURL     string
+}
+
+type testAuthz struct {
+	url     string
+	domain  string
+	status  string
+	token   string
+	chalURL string
+	order   *testOrder
+	chalErr string
+	// thumbprint is of the key of the account the authz is for.
+	thumbprint string
+}
+
+func newTestCA(t *testing.T, responder http.Handler) *testCA {
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "lekube test root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{
+		responder:    responder,
+		rootKey:      rootKey,
+		root:         root,
+		certLifetime: 90 * 24 * time.Hour,
+		accounts:     make(map[string]*testAccount),
+		orders:       make(map[string]*testOrder),
+		authzs:       make(map[string]*testAuthz),
+		chals:        make(map[string]*testAuthz),
+		certs:        make(map[string][]byte),
+		revoked:      make(map[string]bool),
+	}
+	ca.srv = httptest.NewTLSServer(ca)
+	t.Cleanup(ca.srv.Close)
+	return ca
+}
+
+func (ca *testCA) DirectoryURL() string {
+	return ca.srv.URL + "/directory"
+}
+
+// Issued returns the certs the CA has issued, oldest first.
+func (ca *testCA) Issued() []*x509.Certificate {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	return slices.Clone(ca.issued)
+}
+
+// RevokeRequests returns how many revocation requests the CA has been sent.
+func (ca *testCA) RevokeRequests() int {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	return ca.revokeRequests
+}
+
+// IsRevoked returns true if the cert was revoked.
+func (ca *testCA) IsRevoked(cert *x509.Certificate) bool {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	return ca.revoked[cert.SerialNumber.Text(16)]
+}
+
+// AccountContacts returns the contacts of each account registered so far, by
+// account URL.
+func (ca *testCA) AccountContacts() map[string][]string {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	contacts := make(map[string][]string)
+	for u, acct := range ca.accounts {
+		contacts[u] = acct.contact
+	}
+	return contacts
+}
+
+// SetRejectOrders makes the CA fail new orders, or go back to accepting them.
+func (ca *testCA) SetRejectOrders(reject bool) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.rejectOrders = reject
+}
+
+// SetRateLimitOrders makes the CA rate limit new orders for an hour, or go back
+// to accepting them.
+func (ca *testCA) SetRateLimitOrders(limit bool) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.rateLimitOrders = limit
+}
+
+// SetChallengeThumbprint makes the challenges of new orders only validate with
+// key authorizations made with the account key of the thumbprint.
+func (ca *testCA) SetChallengeThumbprint(thumbprint string) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.challengeThumbprint = thumbprint
+}
+
+// SetCertLifetime changes how long the certs issued after it's called last.
+func (ca *testCA) SetCertLifetime(d time.Duration) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.certLifetime = d
+}
+
+func (ca *testCA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.nonce++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", ca.nonce))
+	switch r.URL.Path {
+	case "/directory":
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   ca.srv.URL + "/nonce",
+			"newAccount": ca.srv.URL + "/new-account",
+			"newOrder":   ca.srv.URL + "/new-order",
+			"revokeCert": ca.srv.URL + "/revoke-cert",
+			"keyChange":  ca.srv.URL + "/key-change",
+		})
+		return
+	case "/nonce":
+		return
+	}
+	if r.Method != "POST" {
+		ca.problem(w, http.StatusMethodNotAllowed, "malformed", "only POST is allowed")
+		return
+	}
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		ca.problem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	jws, err := jose.ParseSigned(string(b), []jose.SignatureAlgorithm{jose.RS256, jose.ES256, jose.ES384})
+	if err != nil || len(jws.Signatures) != 1 {
+		ca.problem(w, http.StatusBadRequest, "malformed", fmt.Sprintf("unable to parse JWS: %v", err))
+		return
+	}
+	hdr := jws.Signatures[0].Protected
+	if r.URL.Path == "/new-account" {
+		if hdr.JSONWebKey == nil {
+			ca.problem(w, http.StatusBadRequest, "malformed", "new-account requests must have a jwk")
+			return
+		}
+		payload, err := jws.Verify(hdr.JSONWebKey)
+		if err != nil {
+			ca.problem(w, http.StatusUnauthorized, "malformed", err.Error())
+			return
+		}
+		ca.newAccount(w, hdr.JSONWebKey, payload)
+		return
+	}
+	acct, ok := ca.accounts[hdr.KeyID]
+	if !ok {
+		ca.problem(w, http.StatusBadRequest, "accountDoesNotExist", fmt.Sprintf("no account %#v", hdr.KeyID))
+		return
+	}
+	payload, err := jws.Verify(acct.key)
+	if err != nil {
+		ca.problem(w, http.StatusUnauthorized, "malformed", err.Error())
+		return
+	}
+	u := ca.srv.URL + r.URL.Path
+	switch {
+	case u == acct.url:
+		var req struct {
+			Contact []string `json:"contact"`
+		}
+		if len(payload) != 0 {
+			json.Unmarshal(payload, &req)
+		}
+		if req.Contact != nil {
+			acct.contact = req.Contact
+		}
+		ca.writeAccount(w, http.StatusOK, acct)
+	case r.URL.Path == "/new-order":
+		ca.newOrder(w, acct, payload)
+	case r.URL.Path == "/revoke-cert":
+		ca.revoke(w, payload)
+	case ca.orders[u] != nil:
+		ca.writeOrder(w, http.StatusOK, ca.orders[u])
+	case ca.authzs[u] != nil:
+		ca.writeAuthz(w, ca.authzs[u])
+	case ca.chals[u] != nil:
+		ca.validate(ca.chals[u])
+		ca.writeChallenge(w, ca.chals[u])
+	case strings.HasPrefix(r.URL.Path, "/finalize/"):
+		ca.finalize(w, acct, strings.TrimPrefix(u, ca.srv.URL+"/finalize/"), payload)
+	case ca.certs[u] != nil:
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(ca.certs[u])
+	default:
+		ca.problem(w, http.StatusNotFound, "malformed", fmt.Sprintf("no resource at %s", u))
+	}
+}
+
+func (ca *testCA) problem(w http.ResponseWriter, status int, typ, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"type": "urn:ietf:params:acme:error:" + typ, "detail": detail})
+}
+
+func (ca *testCA) newID() int {
+	ca.nextID++
+	return ca.nextID
+}
+
+func (ca *testCA) newAccount(w http.ResponseWriter, key *jose.JSONWebKey, payload []byte) {
+	var req struct {
+		Contact            []string `json:"contact"`
+		OnlyReturnExisting bool     `json:"onlyReturnExisting"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		ca.problem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	tp, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		ca.problem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	thumbprint := base64.RawURLEncoding.EncodeToString(tp)
+	for _, acct := range ca.accounts {
+		if acct.thumbprint == thumbprint {
+			ca.writeAccount(w, http.StatusOK, acct)
+			return
+		}
+	}
+	if req.OnlyReturnExisting {
+		ca.problem(w, http.StatusBadRequest, "accountDoesNotExist", "no account with that key")
+		return
+	}
+	acct := &testAccount{
+		url:        fmt.Sprintf("%s/account/%d", ca.srv.URL, ca.newID()),
+		key:        key,
+		thumbprint: thumbprint,
+		contact:    req.Contact,
+	}
+	ca.accounts[acct.url] = acct
+	ca.writeAccount(w, http.StatusCreated, acct)
+}
+
+func (ca *testCA) writeAccount(w http.ResponseWriter, status int, acct *testAccount) {
+	w.Header().Set("Location", acct.url)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "valid", "contact": acct.contact})
+}
+
+func (ca *testCA) newOrder(w http.ResponseWriter, acct *testAccount, payload []byte) {
+	if ca.rejectOrders {
+		ca.problem(w, http.StatusForbidden, "unauthorized", "the test CA is rejecting orders")
+		return
+	}
+	if ca.rateLimitOrders {
+		w.Header().Set("Retry-After", "3600")
+		ca.problem(w, http.StatusTooManyRequests, "rateLimited", "the test CA is rate limiting orders")
+		return
+	}
+	var req struct {
+		Identifiers []struct {
+			Type  string `json:"type"`
+			Value string `json:"value"`
+		} `json:"identifiers"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil || len(req.Identifiers) == 0 {
+		ca.problem(w, http.StatusBadRequest, "malformed", "no identifiers in new-order request")
+		return
+	}
+	id := ca.newID()
+	o := &testOrder{
+		url:         fmt.Sprintf("%s/order/%d", ca.srv.URL, id),
+		account:     acct.url,
+		status:      "pending",
+		finalizeURL: fmt.Sprintf("%s/finalize/%d", ca.srv.URL, id),
+	}
+	for _, ident := range req.Identifiers {
+		if ident.Type != "dns" {
+			ca.problem(w, http.StatusBadRequest, "rejectedIdentifier", fmt.Sprintf("the test CA only issues for dns identifiers, not %#v", ident.Type))
+			return
+		}
+		aid := ca.newID()
+		a := &testAuthz{
+			url:        fmt.Sprintf("%s/authz/%d", ca.srv.URL, aid),
+			domain:     ident.Value,
+			status:     "pending",
+			token:      fmt.Sprintf("token-%d", aid),
+			chalURL:    fmt.Sprintf("%s/chal/%d", ca.srv.URL, aid),
+			order:      o,
+			thumbprint: acct.thumbprint,
+		}
+		if ca.challengeThumbprint != "" {
+			a.thumbprint = ca.challengeThumbprint
+		}
+		ca.authzs[a.url] = a
+		ca.chals[a.chalURL] = a
+		o.identifiers = append(o.identifiers, ident.Value)
+		o.authzURLs = append(o.authzURLs, a.url)
+	}
+	ca.orders[o.url] = o
+	ca.writeOrder(w, http.StatusCreated, o)
+}
+
+func (ca *testCA) revoke(w http.ResponseWriter, payload []byte) {
+	ca.revokeRequests++
+	var req struct {
+		Certificate string `json:"certificate"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		ca.problem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	der, err := base64.RawURLEncoding.DecodeString(req.Certificate)
+	if err != nil {
+		ca.problem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		ca.problem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	serial := cert.SerialNumber.Text(16)
+	if ca.revoked[serial] {
+		ca.problem(w, http.StatusBadRequest, "alreadyRevoked", fmt.Sprintf("cert with serial %s is already revoked", serial))
+		return
+	}
+	ca.revoked[serial] = true
+}
+
+func (ca *testCA) writeOrder(w http.ResponseWriter, status int, o *testOrder) {
+	ids := []map[string]string{}
+	for _, d := range o.identifiers {
+		ids = append(ids, map[string]string{"type": "dns", "value": d})
+	}
+	body := map[string]interface{}{
+		"status":         o.status,
+		"identifiers":    ids,
+		"authorizations": o.authzURLs,
+		"finalize":       o.finalizeURL,
+	}
+	if o.certURL != "" {
+		body["certificate"] = o.certURL
+	}
+	w.Header().Set("Location", o.url)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func (ca *testCA) challengeJSON(a *testAuthz) map[string]interface{} {
+	status := "pending"
+	switch a.status {
+	case "valid":
+		status = "valid"
+	case "invalid":
+		status = "invalid"
+	}
+	ch := map[string]interface{}{"type": "http-01", "url": a.chalURL, "token": a.token, "status": status}
+	if a.chalErr != "" {
+		ch["error"] = map[string]string{"type": "urn:ietf:params:acme:error:unauthorized", "detail": a.chalErr}
+	}
+	return ch
+}
+
+func (ca *testCA) writeAuthz(w http.ResponseWriter, a *testAuthz) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":     a.status,
+		"identifier": map[string]string{"type": "dns", "value": a.domain},
+		"challenges": []interface{}{ca.challengeJSON(a)},
+		"expires":    time.Now().Add(24 * time.Hour).Format(time.RFC3339),
+	})
+}
+
+func (ca *testCA) writeChallenge(w http.ResponseWriter, a *testAuthz) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Link", fmt.Sprintf("<%s>;rel=\"up\"", a.url))
+	json.NewEncoder(w).Encode(ca.challengeJSON(a))
+}
+
+// validate fetches the http-01 challenge response for the authz from the
+// responder and marks the authz, and its order, valid or invalid.
+func (ca *testCA) validate(a *testAuthz) {
+	if a.status != "pending" {
+		return
+	}
+	req := httptest.NewRequest("GET", challengeURL(a.domain, a.token), nil)
+	rec := httptest.NewRecorder()
+	ca.responder.ServeHTTP(rec, req)
+	want := a.token + "." + a.thumbprint
+	if rec.Code != http.StatusOK || rec.Body.String() != want {
+		a.status = "invalid"
+		a.chalErr = fmt.Sprintf("got status %d and body %#v from %s, want %#v", rec.Code, rec.Body.String(), req.URL, want)
+		a.order.status = "invalid"
+		return
+	}
+	a.status = "valid"
+	for _, u := range a.order.authzURLs {
+		if ca.authzs[u].status != "valid" {
+			return
+		}
+	}
+	a.order.status = "ready"
+}
+
+func (ca *testCA) finalize(w http.ResponseWriter, acct *testAccount, id string, payload []byte) {
+	o, ok := ca.orders[ca.srv.URL+"/order/"+id]
+	if !ok || o.account != acct.url {
+		ca.problem(w, http.StatusNotFound, "malformed", "no such order")
+		return
+	}
+	if o.status != "ready" {
+		ca.problem(w, http.StatusForbidden, "orderNotReady", fmt.Sprintf("order is %s", o.status))
+		return
+	}
+	var req struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		ca.problem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	der, err := base64.RawURLEncoding.DecodeString(req.CSR)
+	if err != nil {
+		ca.problem(w, http.StatusBadRequest, "badCSR", err.Error())
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		ca.problem(w, http.StatusBadRequest, "badCSR", err.Error())
+		return
+	}
+	if !slices.Equal(slices.Sorted(slices.Values(csr.DNSNames)), slices.Sorted(slices.Values(o.identifiers))) {
+		ca.problem(w, http.StatusBadRequest, "badCSR", fmt.Sprintf("CSR names %s don't match the order's %s", csr.DNSNames, o.identifiers))
+		return
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		ca.problem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(ca.certLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, tmpl, ca.root, csr.PublicKey, ca.rootKey)
+	if err != nil {
+		ca.problem(w, http.StatusBadRequest, "badCSR", err.Error())
+		return
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		ca.problem(w, http.StatusBadRequest, "badCSR", err.Error())
+		return
+	}
+	ca.issued = append(ca.issued, cert)
+	o.status = "valid"
+	o.certURL = fmt.Sprintf("%s/cert/%s", ca.srv.URL, id)
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.root.Raw})...)
+	ca.certs[o.certURL] = chain
+	ca.writeOrder(w, http.StatusOK, o)
+}
+
+// e2eHarness runs lekube against a testCA and a fake Kubernetes API.
+type e2eHarness struct {
+	t    *testing.T
+	ca   *testCA
+	kube *fake.Clientset
+	lcm  *leClientMaker
+	// fallbackCA is only in acme_cas if useFallback is set.
+	fallbackCA  *testCA
+	useFallback bool
+	secret      *secretConf
+}
+
+// newE2EHarness boots lekube the way main does, but with the fake Kubernetes
+// API and an HTTP client that trusts the testCA's HTTPS server by way of the
+// -acmeRoots flag's code path.
+func newE2EHarness(t *testing.T) *e2eHarness {
+	var responder *leResponder
+	// The CA is made before the responder exists, since the responder is
+	// made by setUpACME along with the account it's registered with.
+	respond := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		responder.ServeHTTP(w, r)
+	})
+	ca := newTestCA(t, respond)
+
+	rootsPath := filepath.Join(t.TempDir(), "roots.pem")
+	err := os.WriteFile(rootsPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.srv.Certificate().Raw}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpClient, err := newACMEHTTPClient(rootsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kube := fake.NewClientset()
+	enforceResourceVersions(kube)
+	h := &e2eHarness{
+		t:          t,
+		ca:         ca,
+		kube:       kube,
+		fallbackCA: newTestCA(t, respond),
+		secret: &secretConf{
+			Namespace: "default",
+			Name:      "e2e",
+			Domains:   []string{"www.example.com"},
+		},
+	}
+	conf := h.conf()
+	h.lcm, responder, err = setUpACME(context.Background(), conf, kube.CoreV1(), httpClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only what the test CA is asked counts against the limit.
+	h.lcm.limit.SetLimit(rate.Inf)
+	return h
+}
+
+// enforceResourceVersions makes the fake Kubernetes API give Secrets a new
+// resourceVersion on every write and reject updates made with an old one, the
+// way the real one does.
+func enforceResourceVersions(kube *fake.Clientset) {
+	// Reactors are called with the Clientset locked.
+	version := 0
+	kube.PrependReactor("*", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		switch action.GetVerb() {
+		case "update":
+			sec := action.(k8stesting.UpdateAction).GetObject().(*kubeapi.Secret)
+			cur, err := kube.Tracker().Get(action.GetResource(), action.GetNamespace(), sec.Name)
+			if err == nil && sec.ResourceVersion != "" && sec.ResourceVersion != cur.(*kubeapi.Secret).ResourceVersion {
+				return true, nil, kerrors.NewConflict(action.GetResource().GroupResource(), sec.Name, errors.New("the object has been modified"))
+			}
+		case "create", "patch":
+		default:
+			return false, nil, nil
+		}
+		_, obj, err := k8stesting.ObjectReaction(kube.Tracker())(action)
+		if err != nil {
+			return true, nil, err
+		}
+		sec := obj.(*kubeapi.Secret).DeepCopy()
+		version++
+		sec.ResourceVersion = strconv.Itoa(version)
+		return true, sec, kube.Tracker().Update(action.GetResource(), sec, sec.Namespace)
+	})
+}
+
+// conf returns the config lekube is run with, validated the way the config
+// file is.
+func (h *e2eHarness) conf() *allConf {
+	return h.confLoader().Get()
+}
+
+func (h *e2eHarness) confLoader() *confLoader {
+	sec := map[string]interface{}{
+		"namespace":      h.secret.Namespace,
+		"name":           h.secret.Name,
+		"domains":        h.secret.Domains,
+		"key_type":       h.secret.KeyType,
+		"reuse_key":      h.secret.ReuseKey,
+		"revoke_serials": h.secret.RevokeSerials,
+	}
+	if h.secret.DualKey != nil {
+		sec["dual_key"] = h.secret.DualKey
+	}
+	if len(h.secret.Emails) != 0 {
+		sec["emails"] = h.secret.Emails
+	}
+	conf := map[string]interface{}{
+		"email":              "e2e@example.com",
+		"acme_directory_url": h.ca.DirectoryURL(),
+		"secrets":            []map[string]interface{}{sec},
+	}
+	if h.useFallback {
+		conf["acme_cas"] = []map[string]string{{"acme_directory_url": h.fallbackCA.DirectoryURL()}}
+	}
+	b, err := json.Marshal(conf)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	ic, err := unmarshalConf(b)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	if err := validateConf(ic); err != nil {
+		h.t.Fatal(err)
+	}
+	return &confLoader{conf: ic}
+}
+
+func (h *e2eHarness) run() {
+	run(h.lcm, h.kube.CoreV1(), h.conf(), time.Minute)
+}
+
+// adminRevoke asks lekube's /admin/revoke endpoint to revoke a cert in the
+// secret and returns the status code it responded with.
+func (h *e2eHarness) adminRevoke(form url.Values) int {
+	as := &adminServer{
+		cLoader:   h.confLoader(),
+		lcm:       h.lcm,
+		client:    h.kube.CoreV1(),
+		leTimeout: time.Minute,
+		workMu:    new(sync.Mutex),
+	}
+	form.Set("secret", h.secret.FullName().String())
+	req := httptest.NewRequest("POST", "/admin/revoke", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = "127.0.0.1:1234"
+	rec := httptest.NewRecorder()
+	as.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+// stored returns the Secret lekube stored and the leaf cert in it.
+func (h *e2eHarness) stored() (*kubeapi.Secret, *x509.Certificate) {
+	sec, err := h.kube.CoreV1().Secrets(h.secret.Namespace).Get(context.Background(), h.secret.Name, metav1.GetOptions{})
+	if err != nil {
+		h.t.Fatalf("unable to get the stored Secret: %s", err)
+	}
+	cert := leafCert(sec.Data["tls.crt"])
+	if cert == nil {
+		h.t.Fatalf("no parseable cert in the stored Secret")
+	}
+	return sec, cert
+}
+
+// checkStored checks that the Secret holds a cert for the domains, chaining to
+// the test CA's root, with the key of the given type next to it.
+func (h *e2eHarness) checkStored(domains []string, keyType string) *x509.Certificate {
+	h.t.Helper()
+	sec, cert := h.stored()
+	if !slices.Equal(cert.DNSNames, domains) {
+		h.t.Errorf("stored cert is for %s, want %s", cert.DNSNames, domains)
+	}
+	if got := certKeyType(cert); got != keyType {
+		h.t.Errorf("stored cert has key type %#v, want %#v", got, keyType)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(h.ca.root)
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, DNSName: domains[0]}); err != nil {
+		h.t.Errorf("stored cert doesn't chain to the test CA: %s", err)
+	}
+	key, err := parsePrivateKey(sec.Data["tls.key"])
+	if err != nil {
+		h.t.Fatalf("unable to parse the stored key: %s", err)
+	}
+	if !key.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(cert.PublicKey) {
+		h.t.Errorf("stored key doesn't match the stored cert")
+	}
+	if got := sec.Annotations[issuerDirectoryAnnotation]; got != h.ca.DirectoryURL() {
+		h.t.Errorf("issuer annotation = %#v, want %#v", got, h.ca.DirectoryURL())
+	}
+	return cert
+}
+
+func (h *e2eHarness) checkIssued(n int) {
+	h.t.Helper()
+	if got := len(h.ca.Issued()); got != n {
+		h.t.Fatalf("test CA has issued %d certs, want %d", got, n)
+	}
+}
+
+func TestE2ELifecycle(t *testing.T) {
+	h := newE2EHarness(t)
+
+	// The Secret is created with a cert for its domains.
+	h.run()
+	h.checkIssued(1)
+	first := h.checkStored([]string{"www.example.com"}, keyTypeECDSAP256)
+
+	// Nothing is ordered while the cert is good.
+	h.run()
+	h.checkIssued(1)
+	if _, cert := h.stored(); cert.SerialNumber.Cmp(first.SerialNumber) != 0 {
+		t.Errorf("cert was replaced when no work was needed")
+	}
+
+	// Changing the domains gets a cert for the new ones. The CA issues it
+	// with only a day left on it.
+	h.ca.SetCertLifetime(24 * time.Hour)
+	h.secret.Domains = append(h.secret.Domains, "api.example.com")
+	h.run()
+	h.checkIssued(2)
+	short := h.checkStored([]string{"www.example.com", "api.example.com"}, keyTypeECDSAP256)
+
+	// A cert within start_renew_duration of expiring is renewed.
+	h.ca.SetCertLifetime(90 * 24 * time.Hour)
+	h.run()
+	h.checkIssued(3)
+	renewed := h.checkStored([]string{"www.example.com", "api.example.com"}, keyTypeECDSAP256)
+	if !renewed.NotAfter.After(short.NotAfter) {
+		t.Errorf("cert expiring at %s wasn't renewed", short.NotAfter)
+	}
+
+	// Changing the key type gets a cert with a key of the new type.
+	h.secret.KeyType = keyTypeRSA2048
+	h.run()
+	h.checkIssued(4)
+	h.checkStored([]string{"www.example.com", "api.example.com"}, keyTypeRSA2048)
+	h.run()
+	h.checkIssued(4)
+}
+
+func TestE2ESecretOwnEmails(t *testing.T) {
+	h := newE2EHarness(t)
+	h.secret.Emails = []string{"team@example.com"}
+	h.run()
+	h.checkIssued(1)
+	h.checkStored([]string{"www.example.com"}, keyTypeECDSAP256)
+	// The secret's own emails get an account of their own, and the top-level
+	// account keeps its emails.
+	var got [][]string
+	for _, c := range h.ca.AccountContacts() {
+		got = append(got, c)
+	}
+	slices.SortFunc(got, func(a, b []string) int { return strings.Compare(a[0], b[0]) })
+	want := [][]string{{"mailto:e2e@example.com"}, {"mailto:team@example.com"}}
+	if !cmp.Equal(got, want) {
+		t.Fatalf("account contacts at the CA: want %#v, got %#v", want, got)
+	}
+
+	// A restarted lekube reuses the account instead of registering another.
+	ctx := context.Background()
+	conf := h.conf()
+	store := newAccountStore(h.kube.CoreV1().Secrets(conf.AccountSecret.Namespace), conf.AccountSecret.Name)
+	acct, err := store.LoadOrCreate(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted := newLEClientMaker(h.lcm.httpClient, acct, store, h.kube.CoreV1(), h.lcm.responder, h.lcm.limit)
+	lc, err := restarted.Make(ctx, conf.casFor(conf.Secrets[0])[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := h.ca.AccountContacts()[lc.registrationURI]; !cmp.Equal(got, []string{"mailto:team@example.com"}) {
+		t.Errorf("restarted lekube used account %s with contacts %#v", lc.registrationURI, got)
+	}
+	if n := len(h.ca.AccountContacts()); n != 2 {
+		t.Errorf("restarted lekube registered another account: %d accounts at the CA, want 2", n)
+	}
+
+	// Changing the secret's emails updates the contacts of its account
+	// instead of registering another.
+	h.secret.Emails = []string{"ops@example.com"}
+	restarted.StartRun()
+	lc2, err := restarted.Make(ctx, h.conf().casFor(h.conf().Secrets[0])[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lc2.registrationURI != lc.registrationURI {
+		t.Errorf("changed emails got account %s, want %s", lc2.registrationURI, lc.registrationURI)
+	}
+	if got := h.ca.AccountContacts()[lc.registrationURI]; !cmp.Equal(got, []string{"mailto:ops@example.com"}) {
+		t.Errorf("contacts of the secret's account after changing its emails = %#v", got)
+	}
+	if n := len(h.ca.AccountContacts()); n != 2 {
+		t.Errorf("changed emails registered another account: %d accounts at the CA, want 2", n)
+	}
+}
+
+func TestE2EMakeDoesNotWaitOnHungCA(t *testing.T) {
+	h := newE2EHarness(t)
+	// The hung CA accepts connections and never answers on them.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { c.Close() })
+		}
+	}()
+	hungCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hung := acmeCA{DirectoryURL: "https://" + ln.Addr().String() + "/directory", Emails: []string{"e2e@example.com"}}
+	hungDone := make(chan error, 1)
+	go func() {
+		_, err := h.lcm.Make(hungCtx, hung)
+		hungDone <- err
+	}()
+	// Another goroutine waiting on the hung CA's account gives up with its
+	// deadline.
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer waitCancel()
+	time.Sleep(50 * time.Millisecond)
+	if _, err := h.lcm.Make(waitCtx, hung); err == nil {
+		t.Errorf("Make for the hung CA succeeded")
+	}
+
+	ctx, cancelOther := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelOther()
+	h.lcm.StartRun()
+	_, err = h.lcm.Make(ctx, h.conf().casFor(h.secret)[0])
+	if err != nil {
+		t.Errorf("Make for another CA waited on the hung one: %s", err)
+	}
+	cancel()
+	if err := <-hungDone; err == nil {
+		t.Errorf("Make for the hung CA succeeded")
+	}
+}
+
+func TestE2ERateLimitedFallback(t *testing.T) {
+	h := newE2EHarness(t)
+	h.useFallback = true
+	// A cert with only a day left is due to be ordered from the fallback CA
+	// if the usual one won't issue it.
+	h.ca.SetCertLifetime(24 * time.Hour)
+	h.run()
+	h.checkIssued(1)
+
+	// The rate limit is recorded on the Secret before the fallback CA's cert
+	// is stored into it.
+	h.ca.SetRateLimitOrders(true)
+	h.run()
+	h.checkIssued(1)
+	if n := len(h.fallbackCA.Issued()); n != 1 {
+		t.Fatalf("fallback CA has issued %d certs, want 1", n)
+	}
+	sec, cert := h.stored()
+	if cert.SerialNumber.Cmp(h.fallbackCA.Issued()[0].SerialNumber) != 0 {
+		t.Errorf("stored cert isn't the one the fallback CA issued")
+	}
+	if got := sec.Annotations[issuerDirectoryAnnotation]; got != h.fallbackCA.DirectoryURL() {
+		t.Errorf("issuer annotation = %#v, want %#v", got, h.fallbackCA.DirectoryURL())
+	}
+	if _, _, ok := h.lcm.backoff.Until(h.secret); !ok {
+		t.Errorf("secret wasn't backed off from after being rate limited")
+	}
+	if _, ok := h.lcm.failures.Until(h.secret.FullName()); ok {
+		t.Errorf("secret was backed off from as failing after the fallback CA issued its cert")
+	}
+}
+
+func TestE2EFailedValidation(t *testing.T) {
+	h := newE2EHarness(t)
+	// Challenge responses made with another account key don't validate.
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp, err := (&jose.JSONWebKey{Key: &otherKey.PublicKey}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.ca.SetChallengeThumbprint(base64.RawURLEncoding.EncodeToString(tp))
+	h.run()
+	h.checkIssued(0)
+	_, err = h.kube.CoreV1().Secrets("default").Get(context.Background(), "e2e", metav1.GetOptions{})
+	if err == nil {
+		t.Errorf("Secret was created without a cert being issued")
+	}
+	// The failure is backed off from in memory, since there's no Secret to
+	// record it on.
+	if f, ok := h.lcm.failures.Until(h.secret.FullName()); !ok || f.Count != 1 {
+		t.Errorf("failed order wasn't backed off from: %#v, %t", f, ok)
+	}
+}
+
+func TestE2ERevokeSerials(t *testing.T) {
+	h := newE2EHarness(t)
+	h.run()
+	h.checkIssued(1)
+	first := h.checkStored([]string{"www.example.com"}, keyTypeECDSAP256)
+	secrets := h.kube.CoreV1().Secrets(h.secret.Namespace)
+
+	// A secret that's being backed off from doesn't have its cert revoked,
+	// since it wouldn't be replaced.
+	h.ca.SetRejectOrders(true)
+	h.secret.Domains = []string{"www.example.com", "api.example.com"}
+	h.run()
+	h.checkIssued(1)
+	h.secret.RevokeSerials = []string{first.SerialNumber.Text(16)}
+	h.run()
+	if n := h.ca.RevokeRequests(); n != 0 {
+		t.Fatalf("cert was revoked while the secret was backed off from, %d revocation requests", n)
+	}
+
+	// Once the backoff is over, the cert is revoked, and that it was is
+	// recorded on the Secret even though replacing it fails.
+	if err := resetFailures(context.Background(), h.lcm, secrets, h.secret); err != nil {
+		t.Fatal(err)
+	}
+	h.run()
+	h.checkIssued(1)
+	if !h.ca.IsRevoked(first) {
+		t.Fatalf("cert in revoke_serials wasn't revoked")
+	}
+	sec, cert := h.stored()
+	if cert.SerialNumber.Cmp(first.SerialNumber) != 0 {
+		t.Fatalf("cert was replaced without the CA issuing one")
+	}
+	if got, want := sec.Annotations[revokedSerialAnnotation], first.SerialNumber.Text(16); got != want {
+		t.Errorf("revoked serial annotation = %#v, want %#v", got, want)
+	}
+
+	// A later run replaces the revoked cert without revoking it again.
+	if err := resetFailures(context.Background(), h.lcm, secrets, h.secret); err != nil {
+		t.Fatal(err)
+	}
+	h.ca.SetRejectOrders(false)
+	h.run()
+	h.checkIssued(2)
+	if n := h.ca.RevokeRequests(); n != 1 {
+		t.Errorf("want 1 revocation request, got %d", n)
+	}
+	second := h.checkStored([]string{"www.example.com", "api.example.com"}, keyTypeECDSAP256)
+	if sec, _ := h.stored(); sec.Annotations[revokedSerialAnnotation] != "" {
+		t.Errorf("revoked serial annotation %#v was left on the Secret after the cert was replaced", sec.Annotations[revokedSerialAnnotation])
+	}
+	h.run()
+	h.checkIssued(2)
+
+	// A revocation that wasn't recorded, say because the Secret couldn't
+	// be updated, is retried, and the CA saying the cert is already revoked
+	// doesn't keep it from being replaced.
+	h.secret.RevokeSerials = append(h.secret.RevokeSerials, second.SerialNumber.Text(16))
+	h.ca.SetRejectOrders(true)
+	h.run()
+	if !h.ca.IsRevoked(second) {
+		t.Fatalf("second cert in revoke_serials wasn't revoked")
+	}
+	sec, _ = h.stored()
+	delete(sec.Annotations, revokedSerialAnnotation)
+	if _, err := secrets.Update(context.Background(), sec, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := resetFailures(context.Background(), h.lcm, secrets, h.secret); err != nil {
+		t.Fatal(err)
+	}
+	h.ca.SetRejectOrders(false)
+	h.run()
+	h.checkIssued(3)
+	if n := h.ca.RevokeRequests(); n != 3 {
+		t.Errorf("want 3 revocation requests, got %d", n)
+	}
+	if _, cert := h.stored(); cert.SerialNumber.Cmp(second.SerialNumber) == 0 {
+		t.Errorf("already revoked cert wasn't replaced")
+	}
+}
+
+func TestE2EAdminRevoke(t *testing.T) {
+	h := newE2EHarness(t)
+	h.secret.ReuseKey = true
+	h.run()
+	h.checkIssued(1)
+	first := h.checkStored([]string{"www.example.com"}, keyTypeECDSAP256)
+
+	// The cert is revoked even though it can't be replaced right away.
+	h.ca.SetRejectOrders(true)
+	if code := h.adminRevoke(url.Values{"reason": {"keyCompromise"}}); code != http.StatusInternalServerError {
+		t.Fatalf("want status %d when the replacement fails, got %d", http.StatusInternalServerError, code)
+	}
+	if !h.ca.IsRevoked(first) {
+		t.Fatalf("cert wasn't revoked")
+	}
+
+	// A later run replaces it.
+	if err := resetFailures(context.Background(), h.lcm, h.kube.CoreV1().Secrets("default"), h.secret); err != nil {
+		t.Fatal(err)
+	}
+	h.ca.SetRejectOrders(false)
+	h.run()
+	h.checkIssued(2)
+	replacement := h.checkStored([]string{"www.example.com"}, keyTypeECDSAP256)
+	if replacement.SerialNumber.Cmp(first.SerialNumber) == 0 {
+		t.Errorf("revoked cert wasn't replaced")
+	}
+	// With reuse_key set, the revoked cert's key still isn't reused.
+	if first.PublicKey.(*ecdsa.PublicKey).Equal(replacement.PublicKey) {
+		t.Errorf("replacement of the revoked cert reuses its key")
+	}
+}
+
+func TestE2EAdminRevokeDualKey(t *testing.T) {
+	h := newE2EHarness(t)
+	h.secret.DualKey = &dualKeyConf{KeyType: keyTypeRSA2048}
+	h.run()
+	h.checkIssued(2)
+	sec, ecdsaCert := h.stored()
+	rsaCert := leafCert(sec.Data["tls-rsa.crt"])
+	if rsaCert == nil {
+		t.Fatalf("no dual_key cert in the stored Secret")
+	}
+
+	if code := h.adminRevoke(url.Values{"cert_data_key": {"tls-nope.crt"}}); code != http.StatusBadRequest {
+		t.Errorf("want status %d for an unknown cert data key, got %d", http.StatusBadRequest, code)
+	}
+	if code := h.adminRevoke(url.Values{"cert_data_key": {"tls-rsa.crt"}}); code != http.StatusOK {
+		t.Fatalf("want status %d, got %d", http.StatusOK, code)
+	}
+	h.checkIssued(3)
+	if !h.ca.IsRevoked(rsaCert) || h.ca.IsRevoked(ecdsaCert) {
+		t.Errorf("want only the dual_key cert revoked, rsa revoked %t, ecdsa revoked %t", h.ca.IsRevoked(rsaCert), h.ca.IsRevoked(ecdsaCert))
+	}
+	sec, cert := h.stored()
+	if cert.SerialNumber.Cmp(ecdsaCert.SerialNumber) != 0 {
+		t.Errorf("tls.crt was replaced when the dual_key cert was revoked")
+	}
+	replacement := leafCert(sec.Data["tls-rsa.crt"])
+	if replacement == nil || replacement.SerialNumber.Cmp(rsaCert.SerialNumber) == 0 {
+		t.Errorf("revoked dual_key cert wasn't replaced")
+	} else if got := certKeyType(replacement); got != keyTypeRSA2048 {
+		t.Errorf("dual_key cert was replaced with one of key type %#v", got)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/x509"
+	"strings"
+	"time"
+
+	kubeapi "k8s.io/api/core/v1"
+)
+
+// issuerDirectoryAnnotation records the ACME directory of the CA that issued
+// the cert in a Secret, so that lekube can tell the certs from fallback CAs
+// apart and ask the right CA about them.
+const issuerDirectoryAnnotation = "lekube.jmhodges.com/issuer-directory-url"
+
+// acmeCA is a CA a secret's certs can be ordered from and the account to order
+// them under.
+type acmeCA struct {
+	DirectoryURL string
+	Emails       []string
+	// EAB is nil if the CA doesn't need an external account binding.
+	EAB *eabConf
+	// Fallback is true for the CAs from acme_cas, which are only ordered
+	// from when the secret's usual CA isn't working out.
+	Fallback bool
+	// OwnAccountOf is the full name of the secret if the Emails are its own
+	// and not the top-level ones. A CA keeps one set of contacts per account,
+	// so the certs are then ordered under an account of the secret's own,
+	// with a key of its own, at the CA.
+	OwnAccountOf string
+}
+
+// account returns the name of the account at the CA the certs are ordered
+// under. The account with the top-level emails is named after the directory
+// URL, and the accounts of secrets with their own emails after the directory
+// URL and the secret, so that changing a secret's emails updates the contacts
+// of its account instead of registering another.
+func (ca acmeCA) account() string {
+	dirURL := strings.TrimRight(ca.DirectoryURL, "/")
+	if ca.OwnAccountOf == "" {
+		return dirURL
+	}
+	return dirURL + " " + ca.OwnAccountOf
+}
+
+// accountDirectory returns the ACME directory URL of the named account.
+func accountDirectory(name string) string {
+	dirURL, _, _ := strings.Cut(name, " ")
+	return dirURL
+}
+
+// isOwnAccount returns true if the named account is the account of a secret's
+// own emails and not the one with the top-level emails.
+func isOwnAccount(name string) bool {
+	return strings.Contains(name, " ")
+}
+
+// casFor returns the CAs the secret's certs may be ordered from, with its usual
+// CA first and the fallback CAs after it in the order they were configured.
+func (conf *allConf) casFor(secConf *secretConf) []acmeCA {
+	dirURL, emails, eab := conf.accountFor(secConf)
+	ownAccountOf := ""
+	if !sameContacts(emails, conf.Emails) {
+		ownAccountOf = secConf.FullName().String()
+	}
+	cas := []acmeCA{{DirectoryURL: dirURL, Emails: emails, EAB: eab, OwnAccountOf: ownAccountOf}}
+	for _, c := range conf.ACMECAs {
+		fbURL := directoryURL(c.DirectoryURL, false)
+		if fbURL == dirURL {
+			continue
+		}
+		cas = append(cas, acmeCA{DirectoryURL: fbURL, Emails: conf.Emails, EAB: c.EAB, Fallback: true})
+	}
+	return cas
+}
+
+// fallbackDue returns true if the fallback CAs should be ordered from when the
+// secret's usual CA fails, because it already failed ca_fallback_failures
+// times in a row or because the cert expires within
+// ca_fallback_remaining_lifetime. A missing cert has no lifetime left.
+func fallbackDue(conf *allConf, failures int, cert *x509.Certificate) bool {
+	if failures >= conf.CAFallbackFailures {
+		return true
+	}
+	return cert == nil || time.Until(cert.NotAfter) < conf.CAFallbackRemainingLifetime
+}
+
+// issuerAnnotation returns the annotation that records the ACME directory of
+// the CA that issued the slot's cert. The dual_key slot's is suffixed with its
+// data key.
+func (slot certSlot) issuerAnnotation() string {
+	if slot.CertDataKey == "tls.crt" {
+		return issuerDirectoryAnnotation
+	}
+	return issuerDirectoryAnnotation + "." + slot.CertDataKey
+}
+
+func setIssuerDirectory(sec *kubeapi.Secret, slot certSlot, dirURL string) {
+	if dirURL == "" {
+		delete(sec.Annotations, slot.issuerAnnotation())
+		return
+	}
+	if sec.Annotations == nil {
+		sec.Annotations = make(map[string]string)
+	}
+	sec.Annotations[slot.issuerAnnotation()] = dirURL
+}
+
+// issuedBy returns true if the cert in the slot of the secret was issued by the
+// CA. Certs stored before the issuer was recorded are taken to be from the
+// secret's usual CA.
+func issuedBy(tlsSec *tlsSecret, slot certSlot, ca acmeCA) bool {
+	dirURL := tlsSec.Annotations[slot.issuerAnnotation()]
+	if dirURL == "" {
+		return !ca.Fallback
+	}
+	return dirURL == ca.DirectoryURL
+}
+
+// issuerCA returns the CA in cas that issued the cert in the slot of the
+// secret. Certs stored before the issuer was recorded, or whose issuer is no
+// longer configured, are taken to be from the secret's usual CA.
+func issuerCA(cas []acmeCA, tlsSec *tlsSecret, slot certSlot) acmeCA {
+	if tlsSec == nil {
+		return cas[0]
+	}
+	for _, ca := range cas {
+		if issuedBy(tlsSec, slot, ca) {
+			return ca
+		}
+	}
+	return cas[0]
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	kubeapi "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCasFor(t *testing.T) {
+	eab := &eabConf{KeyID: "kid"}
+	conf := &allConf{
+		Emails:       []string{"a@example.com"},
+		DirectoryURL: "https://primary.example.com/directory",
+		ACMECAs: []*acmeCAConf{
+			{DirectoryURL: "https://fallback1.example.com/directory/", EAB: eab},
+			{DirectoryURL: "https://fallback2.example.com/directory"},
+		},
+	}
+	got := conf.casFor(&secretConf{})
+	want := []acmeCA{
+		{DirectoryURL: "https://primary.example.com/directory", Emails: []string{"a@example.com"}},
+		{DirectoryURL: "https://fallback1.example.com/directory", Emails: []string{"a@example.com"}, EAB: eab, Fallback: true},
+		{DirectoryURL: "https://fallback2.example.com/directory", Emails: []string{"a@example.com"}, Fallback: true},
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("casFor: %s", cmp.Diff(want, got))
+	}
+
+	// A secret using one of the fallbacks as its usual CA doesn't fall back
+	// to it again.
+	got = conf.casFor(&secretConf{DirectoryURL: "https://fallback2.example.com/directory"})
+	want = []acmeCA{
+		{DirectoryURL: "https://fallback2.example.com/directory", Emails: []string{"a@example.com"}},
+		{DirectoryURL: "https://fallback1.example.com/directory", Emails: []string{"a@example.com"}, EAB: eab, Fallback: true},
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("casFor with a fallback as the usual CA: %s", cmp.Diff(want, got))
+	}
+
+	// A secret with its own emails orders from its usual CA under an account
+	// of its own, but falls back under the top-level one.
+	got = conf.casFor(&secretConf{Namespace: "default", Name: "team", Emails: []string{"b@example.com"}})
+	want = []acmeCA{
+		{DirectoryURL: "https://primary.example.com/directory", Emails: []string{"b@example.com"}, OwnAccountOf: "default:team"},
+		{DirectoryURL: "https://fallback1.example.com/directory", Emails: []string{"a@example.com"}, EAB: eab, Fallback: true},
+		{DirectoryURL: "https://fallback2.example.com/directory", Emails: []string{"a@example.com"}, Fallback: true},
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("casFor with the secret's own emails: %s", cmp.Diff(want, got))
+	}
+	if got[0].account() == got[1].account() || accountDirectory(got[0].account()) != got[0].DirectoryURL {
+		t.Errorf("account of the secret's own emails is named %#v", got[0].account())
+	}
+}
+
+func TestAcmeCAAccount(t *testing.T) {
+	top := acmeCA{DirectoryURL: "https://acme.example.com/directory/", Emails: []string{"a@example.com"}}
+	own := acmeCA{DirectoryURL: "https://acme.example.com/directory", Emails: []string{"b@example.com"}, OwnAccountOf: "default:team"}
+	changed := acmeCA{DirectoryURL: "https://acme.example.com/directory/", Emails: []string{"c@example.com"}, OwnAccountOf: "default:team"}
+	other := acmeCA{DirectoryURL: "https://acme.example.com/directory", Emails: []string{"b@example.com"}, OwnAccountOf: "default:other"}
+	if got := top.account(); got != "https://acme.example.com/directory" || isOwnAccount(got) {
+		t.Errorf("account with the top-level emails is named %#v", got)
+	}
+	if own.account() != changed.account() {
+		t.Errorf("changing a secret's emails got it another account: %#v and %#v", own.account(), changed.account())
+	}
+	if own.account() == other.account() {
+		t.Errorf("another secret with the same emails got the same account %#v", own.account())
+	}
+	if !isOwnAccount(own.account()) || accountDirectory(own.account()) != "https://acme.example.com/directory" {
+		t.Errorf("account of a secret's own emails is named %#v", own.account())
+	}
+}
+
+func TestFallbackDue(t *testing.T) {
+	conf := &allConf{CAFallbackFailures: 3, CAFallbackRemainingLifetime: 7 * 24 * time.Hour}
+	fresh := &x509.Certificate{NotAfter: time.Now().Add(30 * 24 * time.Hour)}
+	expiring := &x509.Certificate{NotAfter: time.Now().Add(2 * 24 * time.Hour)}
+	tests := []struct {
+		failures int
+		cert     *x509.Certificate
+		want     bool
+	}{
+		{0, fresh, false},
+		{2, fresh, false},
+		{3, fresh, true},
+		{0, expiring, true},
+		{0, nil, true},
+	}
+	for i, tc := range tests {
+		if got := fallbackDue(conf, tc.failures, tc.cert); got != tc.want {
+			t.Errorf("#%d: fallbackDue(%d failures) = %t, want %t", i, tc.failures, got, tc.want)
+		}
+	}
+}
+
+func TestIssuerCA(t *testing.T) {
+	cas := []acmeCA{
+		{DirectoryURL: "https://primary.example.com/directory"},
+		{DirectoryURL: "https://fallback.example.com/directory", Fallback: true},
+	}
+	slot := certSlot{CertDataKey: "tls.crt", KeyDataKey: "tls.key"}
+	dualSlot := certSlot{CertDataKey: "tls-ecdsa.crt", KeyDataKey: "tls-ecdsa.key"}
+	sec := &kubeapi.Secret{ObjectMeta: metav1.ObjectMeta{Name: "test"}}
+	tlsSec := &tlsSecret{Secret: sec}
+
+	if got := issuerCA(cas, tlsSec, slot); got.DirectoryURL != cas[0].DirectoryURL {
+		t.Errorf("unannotated cert: want issuer %s, got %s", cas[0].DirectoryURL, got.DirectoryURL)
+	}
+	setIssuerDirectory(sec, dualSlot, cas[1].DirectoryURL)
+	if got := issuerCA(cas, tlsSec, dualSlot); got.DirectoryURL != cas[1].DirectoryURL {
+		t.Errorf("cert from the fallback: want issuer %s, got %s", cas[1].DirectoryURL, got.DirectoryURL)
+	}
+	if got := issuerCA(cas, tlsSec, slot); got.DirectoryURL != cas[0].DirectoryURL {
+		t.Errorf("other slot of the secret: want issuer %s, got %s", cas[0].DirectoryURL, got.DirectoryURL)
+	}
+	setIssuerDirectory(sec, slot, "https://gone.example.com/directory")
+	if got := issuerCA(cas, tlsSec, slot); got.DirectoryURL != cas[0].DirectoryURL {
+		t.Errorf("cert from an unconfigured CA: want issuer %s, got %s", cas[0].DirectoryURL, got.DirectoryURL)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"time"
+)
+
+// http01SelfChecker fetches http-01 challenge responses the way the CA will
+// before the CA is asked to validate them. A misrouted Ingress otherwise only
+// shows up as a failed validation at the CA, which counts against its failed
+// validation rate limits.
+type http01SelfChecker struct {
+	timeout  time.Duration
+	interval time.Duration
+	client   *http.Client
+}
+
+// newHTTP01SelfChecker returns nil if timeout is zero, meaning the self-check
+// is turned off.
+func newHTTP01SelfChecker(timeout time.Duration) *http01SelfChecker {
+	if timeout == 0 {
+		return nil
+	}
+	return &http01SelfChecker{
+		timeout:  timeout,
+		interval: 2 * time.Second,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				// A checker is made for every order and the domains it
+				// fetches from are rarely fetched from again, so
+				// connections aren't kept around to pile up.
+				DisableKeepAlives: true,
+				// The CA follows redirects to HTTPS without checking the
+				// cert it's given, so the self-check doesn't either.
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		},
+	}
+}
+
+// Check blocks until the challenge URL for the token on the domain returns the
+// key authorization or the self-check's timeout passes.
+func (hc *http01SelfChecker) Check(ctx context.Context, domain, token, keyAuth string) error {
+	ctx, cancel := context.WithTimeout(ctx, hc.timeout)
+	defer cancel()
+	u := challengeURL(domain, token)
+	var lastErr error
+	for {
+		err := hc.fetch(ctx, u, keyAuth)
+		if err == nil {
+			return nil
+		}
+		// The fetch cut off by the timeout doesn't say anything about
+		// what's being served.
+		if lastErr == nil || ctx.Err() == nil {
+			lastErr = err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("http-01 self-check of %s did not return the key authorization within %s: %s", u, hc.timeout, lastErr)
+		case <-time.After(hc.interval):
+		}
+	}
+}
+
+func (hc *http01SelfChecker) fetch(ctx context.Context, u, keyAuth string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Key authorizations are well under this, so anything longer is wrong
+	// anyway.
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if err != nil {
+		return fmt.Errorf("unable to read response body: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got status %s with body %#v", resp.Status, string(b))
+	}
+	if string(b) != keyAuth {
+		return fmt.Errorf("got body %#v, want %#v", string(b), keyAuth)
+	}
+	return nil
+}
+
+// challengeURL is the URL the CA fetches the http-01 challenge response for
+// the token from.
+func challengeURL(domain, token string) string {
+	host := domain
+	if ip, err := netip.ParseAddr(domain); err == nil && ip.Is6() {
+		host = "[" + domain + "]"
+	}
+	u := url.URL{Scheme: "http", Host: host, Path: acmePath + token}
+	return u.String()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testHTTP01SelfChecker returns a self-checker whose requests all go to the
+// given server no matter what domain they're for.
+func testHTTP01SelfChecker(srv *httptest.Server, timeout time.Duration) *http01SelfChecker {
+	hc := newHTTP01SelfChecker(timeout)
+	hc.interval = 10 * time.Millisecond
+	hc.client.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, network, srv.Listener.Addr().String())
+		},
+	}
+	return hc
+}
+
+func TestHTTP01SelfCheck(t *testing.T) {
+	lr := newLEResponser()
+	lr.AddAuthorization("www.example.com", "good-token", "good-token.thumbprint")
+	srv := httptest.NewServer(lr)
+	defer srv.Close()
+	hc := testHTTP01SelfChecker(srv, 200*time.Millisecond)
+
+	err := hc.Check(context.Background(), "www.example.com", "good-token", "good-token.thumbprint")
+	if err != nil {
+		t.Errorf("self-check of served token failed: %s", err)
+	}
+
+	err = hc.Check(context.Background(), "www.example.com", "missing-token", "missing-token.thumbprint")
+	if err == nil {
+		t.Fatalf("self-check of unserved token succeeded")
+	}
+	for _, want := range []string{"http://www.example.com/.well-known/acme-challenge/missing-token", "404 Not Found"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("self-check error %#v doesn't contain %#v", err.Error(), want)
+		}
+	}
+}
+
+func TestHTTP01SelfCheckMisrouted(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("default backend"))
+	}))
+	defer srv.Close()
+	hc := testHTTP01SelfChecker(srv, 100*time.Millisecond)
+
+	err := hc.Check(context.Background(), "www.example.com", "tok", "tok.thumbprint")
+	if err == nil {
+		t.Fatalf("self-check against the wrong backend succeeded")
+	}
+	if !strings.Contains(err.Error(), `got body "default backend"`) {
+		t.Errorf("self-check error %#v doesn't say what was returned", err.Error())
+	}
+}
+
+func TestChallengeURL(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   string
+	}{
+		{"www.example.com", "http://www.example.com/.well-known/acme-challenge/tok"},
+		{"192.0.2.1", "http://192.0.2.1/.well-known/acme-challenge/tok"},
+		{"2001:db8::1", "http://[2001:db8::1]/.well-known/acme-challenge/tok"},
+	}
+	for _, tc := range tests {
+		if got := challengeURL(tc.domain, "tok"); got != tc.want {
+			t.Errorf("challengeURL(%#v): want %#v, got %#v", tc.domain, tc.want, got)
+		}
+	}
+}
@@ -8,64 +8,75 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"log"
+	"maps"
+	"net"
 	"net/http"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/acme"
 	"golang.org/x/time/rate"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 )
 
 type leClient struct {
 	cl              *limitedACMEClient
 	dir             acme.Directory
+	dirExtras       directoryExtras
 	registrationURI string
 	responder       *leResponder
+	ari             *ariScheduler
+	// caa is nil if CAA records aren't checked before ordering.
+	caa caaResolver
 }
 
-func (lc *leClient) CreateCert(ctx context.Context, sconf *secretConf) (*newCert, error) {
-	if len(sconf.Domains) == 0 {
+// CreateCert orders a new certificate for the secret. If replaces is non-empty,
+// it's the ARI cert ID of the cert being renewed. If key is nil, a new private
+// key of keyType is generated for it. If http01Check is nil, http-01
+// challenges aren't self-checked before the CA is asked to validate them.
+func (lc *leClient) CreateCert(ctx context.Context, sconf *secretConf, keyType string, dns01 *dns01Solver, http01Check *http01SelfChecker, replaces string, key crypto.Signer) (*newCert, error) {
+	if len(sconf.Domains) == 0 && len(sconf.IPAddresses) == 0 {
 		return nil, fmt.Errorf("cannot request a certificate with no names")
 	}
 	domains := uniqueDomains(sconf.Domains)
+	ips := uniqueDomains(sconf.IPAddresses)
+	if err := lc.validateProfile(sconf.Profile); err != nil {
+		return nil, fmt.Errorf("in secret %s: %s", sconf.FullName(), err)
+	}
+	if err := lc.checkCAA(ctx, domains); err != nil {
+		return nil, fmt.Errorf("in secret %s: %w", sconf.FullName(), err)
+	}
 
-	log.Printf("attempting to authorize secret %s with domains %s", sconf.FullName(), domains)
-	order, err := lc.authorizeDomains(ctx, domains)
+	names := append(slices.Clone(domains), ips...)
+	log.Printf("attempting to authorize secret %s with names %s", sconf.FullName(), names)
+	order, err := lc.authorizeDomains(ctx, domains, ips, sconf.ChallengeType, dns01, http01Check, orderExtras{Replaces: replaces, Profile: sconf.Profile})
 	if err != nil {
-		err = fmt.Errorf("in secret %s, failed to authorize order of domains %s: %s", sconf.FullName(), domains, err)
+		err = fmt.Errorf("in secret %s, failed to authorize order of names %s: %w", sconf.FullName(), names, err)
 		return nil, err
 	}
 
-	var priv crypto.PrivateKey
-	var pblock *pem.Block
-	var sigAlg x509.SignatureAlgorithm
-	// If you adjust this UseRSA code, be sure to also adjust
-	// certPublicKeyAlgoDoesntMatch in main.go
-	if sconf.UseRSA {
-		k, err := rsa.GenerateKey(rand.Reader, 2048)
-		if err != nil {
-			return nil, err
-		}
-		pblock = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
-		priv = k
-		sigAlg = x509.SHA256WithRSA
-	} else {
-		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	priv := key
+	if priv == nil {
+		priv, err = generateCertKey(keyType)
 		if err != nil {
 			return nil, err
 		}
-		b, err := x509.MarshalECPrivateKey(k)
-		if err != nil {
-			return nil, err
-		}
-		pblock = &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}
-		priv = k
-		sigAlg = x509.ECDSAWithSHA256
+	}
+	pblock, sigAlg, err := encodeCertKey(priv)
+	if err != nil {
+		return nil, err
 	}
 	keyOut := &bytes.Buffer{}
 	err = pem.Encode(keyOut, pblock)
@@ -73,15 +84,18 @@ func (lc *leClient) CreateCert(ctx context.Context, sconf *secretConf) (*newCert
 		return nil, err
 	}
 
-	csrDER, err := createCSR(sconf.Domains, priv, sigAlg)
+	csrDER, err := createCSR(sconf.Domains, sconf.IPAddresses, priv, sigAlg)
 	if err != nil {
 		return nil, err
 	}
 
-	certDERs, _, err := lc.cl.CreateOrderCert(ctx, order.FinalizeURL, csrDER, true)
+	certDERs, certURL, err := lc.cl.CreateOrderCert(ctx, order.FinalizeURL, csrDER, true)
 	if err != nil {
 		return nil, err
 	}
+	if sconf.PreferredChain != "" {
+		certDERs = lc.preferredChain(ctx, sconf, certURL, certDERs)
+	}
 	pemCerts := [][]byte{}
 	for _, c := range certDERs {
 		block := &pem.Block{
@@ -97,30 +111,243 @@ func (lc *leClient) CreateCert(ctx context.Context, sconf *secretConf) (*newCert
 	return nc, nil
 }
 
-func (lc *leClient) authorizeDomains(ctx context.Context, domains []string) (*acme.Order, error) {
-	authzIDs := make([]acme.AuthzID, len(domains))
-	for i, dom := range domains {
-		authzIDs[i] = acme.AuthzID{Type: "dns", Value: dom}
+// generateCertKey returns a new private key of the given key type.
+// If you adjust this, be sure to also adjust publicKeyType in main.go.
+func generateCertKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case keyTypeRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case keyTypeRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case keyTypeRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case keyTypeECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case keyTypeECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	}
+	return nil, fmt.Errorf("unknown key type %#v", keyType)
+}
+
+// encodeCertKey returns the PEM block the private key is stored in the Secret
+// as and the signature algorithm to sign the CSR with.
+func encodeCertKey(priv crypto.Signer) (*pem.Block, x509.SignatureAlgorithm, error) {
+	switch k := priv.(type) {
+	case *rsa.PrivateKey:
+		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}, x509.SHA256WithRSA, nil
+	case *ecdsa.PrivateKey:
+		b, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, 0, err
+		}
+		sigAlg := x509.ECDSAWithSHA256
+		if k.Curve == elliptic.P384() {
+			sigAlg = x509.ECDSAWithSHA384
+		}
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}, sigAlg, nil
 	}
-	order, err := lc.cl.AuthorizeOrder(ctx, authzIDs)
+	return nil, 0, fmt.Errorf("unsupported private key type %T", priv)
+}
+
+// preferredChain returns the chain offered by the CA whose topmost issuer has
+// the secret's preferred_chain as its CommonName. The default chain is checked
+// first, then the alternates in the order the CA listed them. If none of them
+// match, or the alternates can't be fetched, the default chain is returned.
+func (lc *leClient) preferredChain(ctx context.Context, sconf *secretConf, certURL string, defaultChain [][]byte) [][]byte {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.String("chain.preferred", sconf.PreferredChain))
+	issuer, err := chainTopIssuer(defaultChain)
 	if err != nil {
-		return nil, fmt.Errorf("error during AuthorizeOrder call for domains %s: %w", domains, err)
+		log.Printf("unable to parse default chain for secret %s, using it anyway: %s", sconf.FullName(), err)
+		return defaultChain
 	}
+	if issuer == sconf.PreferredChain {
+		log.Printf("default chain for secret %s has preferred issuer %#v", sconf.FullName(), issuer)
+		span.SetAttributes(attribute.String("chain.issuer", issuer), attribute.Bool("chain.alternate", false))
+		return defaultChain
+	}
+	alts, err := lc.cl.ListCertAlternates(ctx, certURL)
+	if err != nil {
+		log.Printf("unable to list alternate chains for secret %s, using default chain with issuer %#v: %s", sconf.FullName(), issuer, err)
+		span.SetAttributes(attribute.String("chain.issuer", issuer), attribute.Bool("chain.alternate", false))
+		return defaultChain
+	}
+	for _, altURL := range alts {
+		chain, err := lc.cl.FetchCert(ctx, altURL, true)
+		if err != nil {
+			log.Printf("unable to fetch alternate chain %s for secret %s: %s", altURL, sconf.FullName(), err)
+			continue
+		}
+		if len(chain) == 0 || !bytes.Equal(chain[0], defaultChain[0]) {
+			log.Printf("alternate chain %s for secret %s doesn't contain the cert that was issued, skipping it", altURL, sconf.FullName())
+			continue
+		}
+		altIssuer, err := chainTopIssuer(chain)
+		if err != nil {
+			log.Printf("unable to parse alternate chain %s for secret %s: %s", altURL, sconf.FullName(), err)
+			continue
+		}
+		if altIssuer == sconf.PreferredChain {
+			log.Printf("using alternate chain %s with preferred issuer %#v for secret %s", altURL, altIssuer, sconf.FullName())
+			span.SetAttributes(attribute.String("chain.issuer", altIssuer), attribute.Bool("chain.alternate", true))
+			return chain
+		}
+	}
+	log.Printf("no chain offered for secret %s has preferred issuer %#v, using default chain with issuer %#v", sconf.FullName(), sconf.PreferredChain, issuer)
+	span.SetAttributes(attribute.String("chain.issuer", issuer), attribute.Bool("chain.alternate", false))
+	return defaultChain
+}
+
+// chainTopIssuer returns the CommonName of the issuer of the last cert in the
+// chain. That's the root the chain is meant to be validated up to.
+func chainTopIssuer(chain [][]byte) (string, error) {
+	if len(chain) == 0 {
+		return "", errors.New("chain is empty")
+	}
+	top, err := x509.ParseCertificate(chain[len(chain)-1])
+	if err != nil {
+		return "", err
+	}
+	return top.Issuer.CommonName, nil
+}
+
+// validateProfile returns an error if the profile is set but the CA doesn't
+// advertise it in its directory.
+func (lc *leClient) validateProfile(profile string) error {
+	if profile == "" {
+		return nil
+	}
+	if len(lc.dirExtras.Meta.Profiles) == 0 {
+		return fmt.Errorf("profile %#v was requested but the CA at %s doesn't offer any certificate profiles", profile, lc.cl.cl.DirectoryURL)
+	}
+	if _, ok := lc.dirExtras.Meta.Profiles[profile]; !ok {
+		profiles := slices.Sorted(maps.Keys(lc.dirExtras.Meta.Profiles))
+		return fmt.Errorf("profile %#v was requested but the CA at %s only offers the profiles %s", profile, lc.cl.cl.DirectoryURL, strings.Join(profiles, ", "))
+	}
+	return nil
+}
 
+// authorizeDomains orders a cert for the domains and IP addresses and completes
+// the challenges the CA gives for them.
+func (lc *leClient) authorizeDomains(ctx context.Context, domains, ips []string, chalType string, dns01 *dns01Solver, http01Check *http01SelfChecker, extras orderExtras) (_ *acme.Order, err error) {
+	authzIDs := []acme.AuthzID{}
+	for _, dom := range domains {
+		authzIDs = append(authzIDs, acme.AuthzID{Type: "dns", Value: dom})
+	}
+	for _, ip := range ips {
+		authzIDs = append(authzIDs, acme.AuthzID{Type: "ip", Value: ip})
+	}
+	domains = append(slices.Clone(domains), ips...)
+	order, err := lc.cl.AuthorizeOrderWithExtras(ctx, authzIDs, extras)
+	if isAlreadyReplaced(err) {
+		// An earlier order already replaced this cert (say, one whose cert we
+		// failed to store), so the CA won't let us claim it again.
+		log.Printf("cert %s was already replaced, ordering without marking this order as its replacement", extras.Replaces)
+		extras.Replaces = ""
+		order, err = lc.cl.AuthorizeOrderWithExtras(ctx, authzIDs, extras)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error during AuthorizeOrder call for domains %s: %w", domains, err)
+	}
+	defer func() {
+		if err != nil {
+			lc.cleanUpFailedOrder(ctx, order.AuthzURLs)
+		}
+	}()
+
+	// Set up every challenge before accepting any of them so that the waits
+	// for DNS propagation happen alongside each other instead of one after
+	// another.
+	pending := []*pendingChallenge{}
+	defer func() {
+		// The challenges are done with whether the order succeeded or not,
+		// and other orders' challenges are left alone.
+		for _, p := range pending {
+			switch p.chal.Type {
+			case challengeHTTP01:
+				lc.responder.RemoveAuthorization(p.chal.Token)
+			case challengeDNS01:
+				cleanUpTXT(ctx, dns01, p.fqdn, p.txtValue)
+			case challengeTLSALPN01:
+				lc.responder.RemoveTLSALPNCert(p.domain, p.alpnCert)
+			}
+		}
+	}()
 	for i, azURL := range order.AuthzURLs {
 		a, err := lc.cl.GetAuthorization(ctx, azURL)
 		if err != nil {
 			return nil, fmt.Errorf("error during GetAuthorization call for authz url %s (likely for domain %s): %w", azURL, domains[i], err)
 		}
-		ch, err := findChallenge(a)
+		if a.Status == acme.StatusValid {
+			// The account proved control of this domain recently enough that
+			// the CA is reusing the authorization.
+			log.Printf("authorization for %#v is already valid, authz url %s", a.Identifier.Value, a.URI)
+			continue
+		}
+		authzChalType := chalType
+		if a.Wildcard {
+			// Wildcard identifiers can only be validated with DNS-01.
+			authzChalType = challengeDNS01
+		}
+		ch, err := findChallenge(a, authzChalType)
 		if err != nil {
 			return nil, fmt.Errorf("unable to find matching challenge for authz of domain %s (authz URL %s): %w", a.Identifier.Value, azURL, err)
 		}
-		log.Printf("adding authorization for %#v, token %#v, authz url %s", a.Identifier.Value, ch.Token, a.URI)
-		lc.responder.AddAuthorization(a.Identifier.Value, ch.Token)
-		_, err = lc.cl.Accept(ctx, ch)
+		p := &pendingChallenge{chal: ch, domain: a.Identifier.Value}
+		switch ch.Type {
+		case challengeHTTP01:
+			p.keyAuth, err = lc.cl.HTTP01ChallengeResponse(ch.Token)
+			if err != nil {
+				return nil, fmt.Errorf("unable to compute http-01 key authorization for %s: %w", a.Identifier.Value, err)
+			}
+			log.Printf("adding authorization for %#v, token %#v, authz url %s", a.Identifier.Value, ch.Token, a.URI)
+			lc.responder.AddAuthorization(a.Identifier.Value, ch.Token, p.keyAuth)
+		case challengeDNS01:
+			if dns01 == nil {
+				return nil, fmt.Errorf("no DNS provider is available to solve the dns-01 challenge for %s", a.Identifier.Value)
+			}
+			p.txtValue, err = lc.cl.DNS01ChallengeRecord(ch.Token)
+			if err != nil {
+				return nil, fmt.Errorf("unable to compute dns-01 TXT record for %s: %w", a.Identifier.Value, err)
+			}
+			p.fqdn = challengeFQDN(a.Identifier.Value)
+			log.Printf("presenting dns-01 TXT record %s for %#v, authz url %s", p.fqdn, a.Identifier.Value, a.URI)
+			err = dns01.provider.Present(ctx, p.fqdn, p.txtValue)
+			if err != nil {
+				return nil, fmt.Errorf("unable to present dns-01 TXT record for %s: %w", a.Identifier.Value, err)
+			}
+		case challengeTLSALPN01:
+			cert, err := lc.cl.TLSALPN01ChallengeCert(ch.Token, a.Identifier.Value)
+			if err != nil {
+				return nil, fmt.Errorf("unable to create tls-alpn-01 challenge cert for %s: %w", a.Identifier.Value, err)
+			}
+			log.Printf("adding tls-alpn-01 cert for %#v, authz url %s", a.Identifier.Value, a.URI)
+			p.alpnCert = &cert
+			lc.responder.AddTLSALPNCert(a.Identifier.Value, p.alpnCert)
+		}
+		pending = append(pending, p)
+	}
+
+	for _, p := range pending {
+		if p.chal.Type == challengeDNS01 {
+			err = dns01.WaitForPropagation(ctx, p.fqdn, p.txtValue)
+			if err != nil {
+				return nil, fmt.Errorf("dns-01 challenge for %s: %w", p.domain, err)
+			}
+		}
+		if p.chal.Type == challengeHTTP01 && http01Check != nil {
+			log.Printf("self-checking http-01 challenge for %#v", p.domain)
+			err = http01Check.Check(ctx, p.domain, p.chal.Token, p.keyAuth)
+			if err != nil {
+				return nil, fmt.Errorf("http-01 challenge for %s: %w", p.domain, err)
+			}
+		}
+	}
+
+	for _, p := range pending {
+		_, err = lc.cl.Accept(ctx, p.chal)
 		if err != nil {
-			return nil, fmt.Errorf("error during Accept of challenge for %s: %w", a.Identifier.Value, err)
+			return nil, fmt.Errorf("error during Accept of challenge for %s: %w", p.domain, err)
 		}
 	}
 
@@ -137,26 +364,109 @@ func (lc *leClient) authorizeDomains(ctx context.Context, domains []string) (*ac
 	return afterOrder, nil
 }
 
-func createCSR(domains []string, priv crypto.PrivateKey, sigAlg x509.SignatureAlgorithm) ([]byte, error) {
+func createCSR(domains, ips []string, priv crypto.PrivateKey, sigAlg x509.SignatureAlgorithm) ([]byte, error) {
 	csr := &x509.CertificateRequest{
 		SignatureAlgorithm: sigAlg,
 
-		Subject:  pkix.Name{CommonName: domains[0]},
 		DNSNames: domains,
 	}
+	// IP addresses don't belong in the CommonName, so certs with only IP
+	// addresses go without one.
+	if len(domains) != 0 {
+		csr.Subject = pkix.Name{CommonName: domains[0]}
+	}
+	for _, ip := range ips {
+		csr.IPAddresses = append(csr.IPAddresses, net.ParseIP(ip))
+	}
 
 	return x509.CreateCertificateRequest(rand.Reader, csr, priv)
 }
 
-func findChallenge(a *acme.Authorization) (*acme.Challenge, error) {
+// isAlreadyReplaced returns true if err is, or wraps, the CA's alreadyReplaced
+// problem for an order that marked a cert as the one it replaces.
+func isAlreadyReplaced(err error) bool {
+	var aerr *acme.Error
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	return aerr.ProblemType == "urn:ietf:params:acme:error:alreadyReplaced"
+}
+
+// pendingChallenge is a challenge that's been set up to be validated by the CA
+// but that hasn't yet been accepted.
+type pendingChallenge struct {
+	chal   *acme.Challenge
+	domain string
+
+	// keyAuth is only set for http-01 challenges.
+	keyAuth string
+
+	// fqdn and txtValue are only set for dns-01 challenges.
+	fqdn     string
+	txtValue string
+
+	// alpnCert is only set for tls-alpn-01 challenges.
+	alpnCert *tls.Certificate
+}
+
+func findChallenge(a *acme.Authorization, chalType string) (*acme.Challenge, error) {
 	seen := make([]string, 0, len(a.Challenges))
 	for _, ch := range a.Challenges {
-		if ch.Type == "http-01" {
+		if ch.Type == chalType {
 			return ch, nil
 		}
 		seen = append(seen, ch.Type)
 	}
-	return nil, fmt.Errorf("no http-01 challenges in %#v", seen)
+	return nil, fmt.Errorf("no %s challenges in %#v", chalType, seen)
+}
+
+// cleanUpTXT removes a dns-01 challenge record. It's run after an order has
+// succeeded or failed, so the given Context may already be done.
+func cleanUpTXT(ctx context.Context, dns01 *dns01Solver, fqdn, value string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+	err := dns01.provider.CleanUp(ctx, fqdn, value)
+	if err != nil {
+		log.Printf("unable to clean up dns-01 TXT record %s: %s", fqdn, err)
+	}
+}
+
+// cleanUpFailedOrder deactivates the authorizations of a failed order that are
+// still pending so that they don't linger on the CA's side, and logs which of
+// the order's identifiers failed validation and why. Like cleanUpTXT, the
+// given Context may already be done.
+func (lc *leClient) cleanUpFailedOrder(ctx context.Context, authzURLs []string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+	for _, azURL := range authzURLs {
+		a, err := lc.cl.GetAuthorization(ctx, azURL)
+		if err != nil {
+			log.Printf("unable to fetch authorization %s of failed order: %s", azURL, err)
+			continue
+		}
+		switch a.Status {
+		case acme.StatusPending:
+			err = lc.cl.RevokeAuthorization(ctx, azURL)
+			if err != nil {
+				log.Printf("unable to deactivate pending authorization for %#v, authz url %s: %s", a.Identifier.Value, azURL, err)
+				continue
+			}
+			log.Printf("deactivated pending authorization for %#v, authz url %s", a.Identifier.Value, azURL)
+		case acme.StatusInvalid:
+			failed := false
+			for _, ch := range a.Challenges {
+				if ch.Error != nil {
+					failed = true
+					log.Printf("authorization for %#v failed its %s challenge, authz url %s: %s", a.Identifier.Value, ch.Type, azURL, ch.Error)
+				}
+			}
+			if !failed {
+				log.Printf("authorization for %#v is invalid without a challenge error, authz url %s", a.Identifier.Value, azURL)
+			}
+		default:
+			log.Printf("authorization for %#v is %s, authz url %s", a.Identifier.Value, a.Status, azURL)
+		}
+	}
 }
 
 // leClientMaker allows us to change the ACME (Let's Encrypt) API url and
@@ -172,84 +482,327 @@ type leClientMaker struct {
 	// Let's Encrypt put in place across all accounts and clients.
 	limit *rate.Limiter
 
-	infoToClient map[accountInfo]*leClient
+	// store is where new registrations are saved so that the next boot of
+	// lekube reuses them instead of registering the account again.
+	store *accountStore
+	// kube is used to fetch the External Account Binding HMAC keys when
+	// registering.
+	kube corev1.CoreV1Interface
+	// mu guards accountKey, registrations, keys, clients, upToDate, and
+	// accountLocks, since secrets are worked on concurrently. It's never
+	// held while talking to a CA outside of an account key rollover, so
+	// that a slow CA only holds up the secrets using it.
+	mu sync.Mutex
+	// registrations maps account names (see acmeCA.account) to the account
+	// URI registered at their CA, with the accountKey unless keys has
+	// another key for it.
+	registrations map[string]string
+	// keys maps the names of the accounts of secrets with their own emails,
+	// and of the accounts an account key rollover couldn't change the key
+	// of, to the key they're registered with.
+	keys map[string]*rsa.PrivateKey
+
+	// clients maps account names to the client for the account.
+	clients map[string]*leClient
+	// upToDate maps account names to the contacts the account was brought
+	// up to date with in the current run, so that the CA is only asked
+	// about each account once per run.
+	upToDate map[string][]string
+	// accountLocks makes sure only one client is made for each account at
+	// a time, so that it's not registered twice.
+	accountLocks map[string]chan struct{}
+
+	// backoff holds off on ordering certs for secrets the CA has rate
+	// limited.
+	backoff *rateLimitBackoff
+	// failures holds off on secrets lekube has repeatedly failed to get
+	// certs for.
+	failures *failureBackoff
+	// caa looks up the CAA records checked before ordering certs.
+	caa caaResolver
+	// accountKeyCreatedAt is the zero time if it's not known when the
+	// accountKey was generated.
+	accountKeyCreatedAt time.Time
 }
 
-func newLEClientMaker(c *http.Client, accountKey *rsa.PrivateKey, responder *leResponder, limiter *rate.Limiter) *leClientMaker {
+func newLEClientMaker(c *http.Client, acct *persistedAccount, store *accountStore, kube corev1.CoreV1Interface, responder *leResponder, limiter *rate.Limiter) *leClientMaker {
 	return &leClientMaker{
-		httpClient:   c,
-		accountKey:   accountKey,
-		responder:    responder,
-		limit:        limiter,
-		infoToClient: make(map[accountInfo]*leClient),
+		httpClient:          c,
+		accountKey:          acct.key,
+		accountKeyCreatedAt: acct.keyCreatedAt,
+		responder:           responder,
+		limit:               limiter,
+		store:               store,
+		kube:                kube,
+		registrations:       acct.registrations,
+		keys:                acct.keys,
+		clients:             make(map[string]*leClient),
+		upToDate:            make(map[string][]string),
+		accountLocks:        make(map[string]chan struct{}),
+		backoff:             newRateLimitBackoff(),
+		failures:            newFailureBackoff(),
+		caa:                 newSystemCAAResolver(),
 	}
 }
 
-type accountInfo struct {
-	directoryURL string
-	email        string
-}
-
-func (lcm *leClientMaker) Make(ctx context.Context, directoryURL, email string) (*leClient, error) {
-	if len(directoryURL) == 0 {
+// Make returns a leClient for the CA's account, registering it if need be and
+// updating the account's contact addresses to the CA's emails if they've
+// changed. The CA's EAB is only used if the account has to be registered and
+// may be nil.
+func (lcm *leClientMaker) Make(ctx context.Context, ca acmeCA) (*leClient, error) {
+	if len(ca.DirectoryURL) == 0 {
 		return nil, errors.New("directoryURL of Let's Encrypt API may not be blank")
 	}
 
 	// Trim trailing slashes off to prevent folks sliding it in and out of their
 	// configs and creating duplicate accounts that we don't need.
-	directoryURL = strings.TrimRight(directoryURL, "/")
-	info := accountInfo{directoryURL, email}
-	lc, ok := lcm.infoToClient[info]
+	directoryURL := strings.TrimRight(ca.DirectoryURL, "/")
+	name := ca.account()
+	contacts := contactURIs(ca.Emails)
+	eab := ca.EAB
+	unlock, err := lcm.lockAccount(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	lcm.mu.Lock()
+	lc, ok := lcm.clients[name]
+	synced, isUpToDate := lcm.upToDate[name]
+	key, hasOwnKey := lcm.keys[name]
+	if !hasOwnKey {
+		key = lcm.accountKey
+	}
+	regURI, registered := lcm.registrations[name]
+	lcm.mu.Unlock()
+
 	if ok {
-		return lc, ensureTermsOfUse(ctx, lc)
+		if isUpToDate && sameContacts(synced, contacts) {
+			return lc, nil
+		}
+		err = ensureAccountUpToDate(ctx, lc, contacts)
+		if err != nil {
+			return nil, err
+		}
+		return lcm.publish(name, key, lc, contacts)
 	}
 
 	cl := &limitedACMEClient{
 		limit: lcm.limit,
 		cl: &acme.Client{
-			Key:          lcm.accountKey,
+			Key:          key,
 			HTTPClient:   lcm.httpClient,
 			DirectoryURL: directoryURL,
+			RetryBackoff: acmeRetryBackoff,
 		},
 	}
 	dir, err := cl.Discover(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("unable to discover ACME endpoints at directory URL %s: %s", directoryURL, err)
 	}
+	dirExtras, err := cl.DiscoverExtras(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to discover ACME endpoints at directory URL %s: %s", directoryURL, err)
+	}
+
+	if registered {
+		cl.cl.KID = acme.KeyID(regURI)
+		leClient := &leClient{
+			cl:              cl,
+			dir:             dir,
+			dirExtras:       dirExtras,
+			responder:       lcm.responder,
+			registrationURI: regURI,
+			ari:             newARIScheduler(),
+			caa:             lcm.caa,
+		}
+		err = ensureAccountUpToDate(ctx, leClient, contacts)
+		if err != nil {
+			return nil, err
+		}
+		return lcm.publish(name, key, leClient, contacts)
+	}
 
+	if !hasOwnKey && ca.OwnAccountOf != "" {
+		// The CA tells accounts apart by their keys, so the account of the
+		// secret's own emails needs a key of its own. It's stored before
+		// registering so that the account isn't lost if its URI can't be.
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate private account key (not a TLS private key) for the ACME account with contacts %s: %s", contacts, err)
+		}
+		err = lcm.store.SaveRegistrationKey(ctx, name, key)
+		if err != nil {
+			return nil, err
+		}
+		lcm.mu.Lock()
+		if lcm.keys == nil {
+			lcm.keys = make(map[string]*rsa.PrivateKey)
+		}
+		lcm.keys[name] = key
+		lcm.mu.Unlock()
+		cl.cl.Key = key
+	}
 	acc := &acme.Account{
-		Contact: []string{"mailto:" + email},
+		Contact: contacts,
+	}
+	if eab != nil {
+		acc.ExternalAccountBinding, err = lcm.externalAccountBinding(ctx, eab)
+		if err != nil {
+			return nil, err
+		}
+	} else if dir.ExternalAccountRequired {
+		return nil, fmt.Errorf("the CA at %s requires an external account binding to register, but no 'external_account_binding' is configured", directoryURL)
 	}
 	acc, err = cl.Register(ctx, acc, acme.AcceptTOS)
+	alreadyExists := errors.Is(err, acme.ErrAccountAlreadyExists)
+	if alreadyExists {
+		// The account key was registered before but we failed to save the
+		// account URI. Register has already looked it up for us.
+		acc, err = &acme.Account{URI: string(cl.cl.KID)}, nil
+	}
 	if err != nil {
+		if eab != nil {
+			return nil, fmt.Errorf("unable to create new registration with external account binding key ID %#v (the CA may have rejected the binding): %s", eab.KeyID, err)
+		}
 		return nil, fmt.Errorf("unable to create new registration: %s", err)
 	}
+	lcm.mu.Lock()
+	lcm.registrations[name] = acc.URI
+	lcm.mu.Unlock()
+	err = lcm.store.SaveRegistration(ctx, name, acc.URI)
+	if err != nil {
+		// Not fatal. The next boot will find the account already exists.
+		log.Printf("unable to persist ACME account URI %s for directory %s: %s", acc.URI, directoryURL, err)
+	}
 	leClient := &leClient{
 		cl:              cl,
 		dir:             dir,
+		dirExtras:       dirExtras,
 		responder:       lcm.responder,
 		registrationURI: acc.URI,
+		ari:             newARIScheduler(),
+		caa:             lcm.caa,
+	}
+	if alreadyExists {
+		// The account may have been registered with other contacts.
+		err = ensureAccountUpToDate(ctx, leClient, contacts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return lcm.publish(name, key, leClient, contacts)
+}
+
+// lockAccount waits for any other client being made for the named account to
+// be done, or for the ctx to be done, and returns the func that lets the next
+// one go ahead.
+func (lcm *leClientMaker) lockAccount(ctx context.Context, name string) (func(), error) {
+	lcm.mu.Lock()
+	if lcm.accountLocks == nil {
+		lcm.accountLocks = make(map[string]chan struct{})
+	}
+	l, ok := lcm.accountLocks[name]
+	if !ok {
+		l = make(chan struct{}, 1)
+		lcm.accountLocks[name] = l
+	}
+	lcm.mu.Unlock()
+	select {
+	case l <- struct{}{}:
+		return func() { <-l }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("gave up waiting on another client for the ACME account at %s to be made: %w", accountDirectory(name), ctx.Err())
+	}
+}
+
+// publish caches and returns the client made with the key for the named
+// account, unless the account key was rolled over while it was being made.
+func (lcm *leClientMaker) publish(name string, key *rsa.PrivateKey, lc *leClient, contacts []string) (*leClient, error) {
+	lcm.mu.Lock()
+	defer lcm.mu.Unlock()
+	current, ok := lcm.keys[name]
+	if !ok {
+		current = lcm.accountKey
+	}
+	if !current.Equal(key) {
+		return nil, fmt.Errorf("the key of the ACME account at %s was rolled over while its client was being made", accountDirectory(name))
+	}
+	if lcm.clients == nil {
+		lcm.clients = make(map[string]*leClient)
+	}
+	if lcm.upToDate == nil {
+		lcm.upToDate = make(map[string][]string)
+	}
+	lcm.clients[name] = lc
+	lcm.upToDate[name] = contacts
+	return lc, nil
+}
+
+// StartRun makes the next Make for each account check it's up to date with
+// the CA again.
+func (lcm *leClientMaker) StartRun() {
+	lcm.mu.Lock()
+	defer lcm.mu.Unlock()
+	lcm.upToDate = make(map[string][]string)
+}
+
+func (lcm *leClientMaker) externalAccountBinding(ctx context.Context, eab *eabConf) (*acme.ExternalAccountBinding, error) {
+	b, err := fetchK8SSecretValue(ctx, lcm.kube, eab.HMACKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch the external account binding HMAC key: %s", err)
+	}
+	// CAs hand out the HMAC key base64url encoded, sometimes with padding.
+	hmacKey, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(string(b)), "="))
+	if err != nil {
+		return nil, fmt.Errorf("external account binding HMAC key in secret %s is not valid base64url: %s", nsSecName{eab.HMACKey.Namespace, eab.HMACKey.Name}, err)
 	}
-	lcm.infoToClient[info] = leClient
-	return leClient, nil
+	return &acme.ExternalAccountBinding{KID: eab.KeyID, Key: hmacKey}, nil
 }
 
-func ensureTermsOfUse(ctx context.Context, lc *leClient) error {
+// ensureAccountUpToDate updates the account to agree to the CA's current Terms
+// of Service and to have the given contacts, instead of registering a new
+// account when they change.
+func ensureAccountUpToDate(ctx context.Context, lc *leClient, contacts []string) error {
 	acc, err := lc.cl.GetReg(ctx, lc.registrationURI)
 	if err != nil {
 		return fmt.Errorf("unable to refresh account info while determining most recent Terms of Service: %s", err)
 	}
 
-	if acc.CurrentTerms != acc.AgreedTerms {
-		acc.AgreedTerms = acc.CurrentTerms
-		_, err := lc.cl.UpdateReg(ctx, acc)
-		if err != nil {
-			return fmt.Errorf("unable to update registration for new agreement terms: %s", err)
-		}
+	termsChanged := acc.CurrentTerms != acc.AgreedTerms
+	contactsChanged := !sameContacts(acc.Contact, contacts)
+	if !termsChanged && !contactsChanged {
+		return nil
+	}
+	acc.AgreedTerms = acc.CurrentTerms
+	if contactsChanged {
+		log.Printf("updating contacts of ACME account %s from %s to %s", lc.registrationURI, acc.Contact, contacts)
+		acc.Contact = contacts
+	}
+	_, err = lc.cl.UpdateReg(ctx, acc)
+	if err != nil {
+		return fmt.Errorf("unable to update registration for new agreement terms or contacts: %s", err)
 	}
 	return nil
 }
 
+func contactURIs(emails []string) []string {
+	contacts := []string{}
+	for _, e := range emails {
+		contacts = append(contacts, "mailto:"+e)
+	}
+	return contacts
+}
+
+// sameContacts returns true if the two contact lists have the same contacts in
+// any order.
+func sameContacts(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
+
 // uniqueDomains removes duplicate domains by removing any duplicates after the
 // first, avoiding accidental order changes that might affect the CN.
 func uniqueDomains(doms []string) []string {
@@ -298,6 +851,13 @@ func (lac *limitedACMEClient) Accept(ctx context.Context, chal *acme.Challenge)
 	return lac.cl.Accept(ctx, chal)
 }
 
+func (lac *limitedACMEClient) RevokeAuthorization(ctx context.Context, url string) error {
+	if err := lac.limit.Wait(ctx); err != nil {
+		return err
+	}
+	return lac.cl.RevokeAuthorization(ctx, url)
+}
+
 func (lac *limitedACMEClient) GetAuthorization(ctx context.Context, url string) (*acme.Authorization, error) {
 	if err := lac.limit.Wait(ctx); err != nil {
 		return nil, err
@@ -326,6 +886,52 @@ func (lac *limitedACMEClient) Register(ctx context.Context, a *acme.Account, pro
 	return lac.cl.Register(ctx, a, prompt)
 }
 
+// HTTP01ChallengeResponse makes no requests to the ACME API and so isn't rate
+// limited.
+func (lac *limitedACMEClient) HTTP01ChallengeResponse(token string) (string, error) {
+	return lac.cl.HTTP01ChallengeResponse(token)
+}
+
+// DNS01ChallengeRecord makes no requests to the ACME API and so isn't rate
+// limited.
+func (lac *limitedACMEClient) DNS01ChallengeRecord(token string) (string, error) {
+	return lac.cl.DNS01ChallengeRecord(token)
+}
+
+func (lac *limitedACMEClient) ListCertAlternates(ctx context.Context, url string) ([]string, error) {
+	if err := lac.limit.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return lac.cl.ListCertAlternates(ctx, url)
+}
+
+func (lac *limitedACMEClient) FetchCert(ctx context.Context, url string, bundle bool) ([][]byte, error) {
+	if err := lac.limit.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return lac.cl.FetchCert(ctx, url, bundle)
+}
+
+func (lac *limitedACMEClient) RevokeCert(ctx context.Context, key crypto.Signer, cert []byte, reason acme.CRLReasonCode) error {
+	if err := lac.limit.Wait(ctx); err != nil {
+		return err
+	}
+	return lac.cl.RevokeCert(ctx, key, cert, reason)
+}
+
+// TLSALPN01ChallengeCert makes no requests to the ACME API and so isn't rate
+// limited.
+func (lac *limitedACMEClient) TLSALPN01ChallengeCert(token, domain string) (tls.Certificate, error) {
+	return lac.cl.TLSALPN01ChallengeCert(token, domain)
+}
+
+func (lac *limitedACMEClient) AccountKeyRollover(ctx context.Context, newKey crypto.Signer) error {
+	if err := lac.limit.Wait(ctx); err != nil {
+		return err
+	}
+	return lac.cl.AccountKeyRollover(ctx, newKey)
+}
+
 func (lac *limitedACMEClient) WaitOrder(ctx context.Context, url string) (*acme.Order, error) {
 	if err := lac.limit.Wait(ctx); err != nil {
 		return nil, err
@@ -1,12 +1,37 @@
 package main
 
 import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
 	"net/http/httptest"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	jose "github.com/go-jose/go-jose/v4"
 	"github.com/google/go-cmp/cmp"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/time/rate"
+	kubeapi "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 )
 
 func TestConfigLoadGoldenPath(t *testing.T) {
@@ -19,9 +44,9 @@ func TestConfigLoadGoldenPath(t *testing.T) {
 	if !cmp.Equal(c, c2) {
 		t.Errorf("config pointers returned by newConfLoader and Get should be the same but were not")
 	}
-	email := "fake@example.com"
-	if c.Email != email {
-		t.Errorf("email: want %#v, got %#v", email, c.Email)
+	emails := []string{"fake@example.com"}
+	if !cmp.Equal(c.Emails, emails) {
+		t.Errorf("email: want %#v, got %#v", emails, c.Emails)
 	}
 	if !c.UseProd {
 		t.Errorf("use_prod: want %t, got %t", true, c.UseProd)
@@ -41,25 +66,91 @@ func TestConfigLoadGoldenPath(t *testing.T) {
 	if c.ConfigCheckBootDelay != expectedBootDelay {
 		t.Errorf("config_check_boot_delay: want %s, got %s", expectedBootDelay, c.ConfigCheckBootDelay)
 	}
+	expectedSelfCheck := 45 * time.Second
+	if c.HTTP01SelfCheckTimeout != expectedSelfCheck {
+		t.Errorf("http01_self_check_timeout: want %s, got %s", expectedSelfCheck, c.HTTP01SelfCheckTimeout)
+	}
+	expectedAccountKeyMaxAge := 90 * 24 * time.Hour
+	if c.AccountKeyMaxAge != expectedAccountKeyMaxAge {
+		t.Errorf("account_key_max_age: want %s, got %s", expectedAccountKeyMaxAge, c.AccountKeyMaxAge)
+	}
+	expectedCAs := []*acmeCAConf{{
+		DirectoryURL: "https://acme.zerossl.com/v2/DV90",
+		EAB:          &eabConf{KeyID: "kid", HMACKey: &secretKeyRef{Namespace: "lekube", Name: "zerossl-eab", Key: "hmac"}},
+	}}
+	if !cmp.Equal(c.ACMECAs, expectedCAs) {
+		t.Errorf("acme_cas: %s", cmp.Diff(expectedCAs, c.ACMECAs))
+	}
+	if c.Concurrency != 4 {
+		t.Errorf("concurrency: want 4, got %d", c.Concurrency)
+	}
+	if c.CAFallbackFailures != 2 {
+		t.Errorf("ca_fallback_failures: want 2, got %d", c.CAFallbackFailures)
+	}
+	if c.CAFallbackRemainingLifetime != 96*time.Hour {
+		t.Errorf("ca_fallback_remaining_lifetime: want %s, got %s", 96*time.Hour, c.CAFallbackRemainingLifetime)
+	}
+	expectedAccountSecret := secretRef{Namespace: "lekube", Name: "acme-account"}
+	if c.AccountSecret != expectedAccountSecret {
+		t.Errorf("account_secret: want %#v, got %#v", expectedAccountSecret, c.AccountSecret)
+	}
+	expectedDNS01 := &dns01Conf{
+		RFC2136: rfc2136Conf{
+			Nameserver:    "ns1.example.com:53",
+			TSIGKeyName:   "lekube",
+			TSIGAlgorithm: "hmac-sha256.",
+			TSIGSecret:    &secretKeyRef{Namespace: "lekube", Name: "tsig", Key: "secret"},
+		},
+		PropagationTimeout:     2 * time.Minute,
+		PropagationNameservers: []string{"ns1.example.com:53"},
+	}
+	if !cmp.Equal(c.DNS01, expectedDNS01) {
+		t.Errorf("dns01: want %#v, got %#v", expectedDNS01, c.DNS01)
+	}
 	defaultNS := "default"
 	stagingNS := "staging"
 
 	secs := []*secretConf{
 		{
-			Namespace: defaultNS,
-			Name:      "test",
-			Domains:   []string{"example.com"},
+			Namespace:     defaultNS,
+			Name:          "test",
+			Domains:       []string{"example.com"},
+			KeyType:       keyTypeECDSAP256,
+			ChallengeType: challengeHTTP01,
+		},
+		{
+			Namespace:     defaultNS,
+			Name:          "missingtest",
+			KeyType:       keyTypeRSA2048,
+			UseRSA:        true,
+			Domains:       []string{"www.example.com", "alt.example.com"},
+			ChallengeType: challengeHTTP01,
 		},
 		{
-			Namespace: defaultNS,
-			Name:      "missingtest",
-			UseRSA:    true,
-			Domains:   []string{"www.example.com", "alt.example.com"},
+			Namespace:     stagingNS,
+			Name:          "missingtest",
+			Domains:       []string{"test.example.com"},
+			KeyType:       keyTypeECDSAP384,
+			ChallengeType: challengeHTTP01,
 		},
 		{
-			Namespace: stagingNS,
-			Name:      "missingtest",
-			Domains:   []string{"test.example.com"},
+			Namespace:     stagingNS,
+			Name:          "dnstest",
+			Domains:       []string{"dns.example.com"},
+			KeyType:       keyTypeECDSAP256,
+			ChallengeType: challengeDNS01,
+		},
+		{
+			Namespace:     stagingNS,
+			Name:          "dualtest",
+			Domains:       []string{"dual.example.com"},
+			KeyType:       keyTypeECDSAP256,
+			ChallengeType: challengeHTTP01,
+			DualKey: &dualKeyConf{
+				KeyType:     keyTypeRSA2048,
+				CertDataKey: "tls-rsa.crt",
+				KeyDataKey:  "tls-rsa.key",
+			},
 		},
 	}
 
@@ -95,6 +186,22 @@ func TestConfigLoadDefaultConfigCheckInterval(t *testing.T) {
 	if c.ConfigCheckBootDelay != expectedBootDelay {
 		t.Errorf("default config_check_boot_delay: want %s, got %s", expectedBootDelay, c.ConfigCheckBootDelay)
 	}
+	if c.HTTP01SelfCheckTimeout != 0 {
+		t.Errorf("default http01_self_check_timeout: want off, got %s", c.HTTP01SelfCheckTimeout)
+	}
+	if c.Concurrency != 1 {
+		t.Errorf("default concurrency: want 1, got %d", c.Concurrency)
+	}
+	if c.CAFallbackFailures != 3 {
+		t.Errorf("default ca_fallback_failures: want 3, got %d", c.CAFallbackFailures)
+	}
+	if c.CAFallbackRemainingLifetime != 7*24*time.Hour {
+		t.Errorf("default ca_fallback_remaining_lifetime: want %s, got %s", 7*24*time.Hour, c.CAFallbackRemainingLifetime)
+	}
+	expectedAccountSecret := secretRef{Namespace: "default", Name: "lekube-account"}
+	if c.AccountSecret != expectedAccountSecret {
+		t.Errorf("default account_secret: want %#v, got %#v", expectedAccountSecret, c.AccountSecret)
+	}
 }
 
 func TestDisallowEmptyNamespaceInSecConfig(t *testing.T) {
@@ -109,6 +216,244 @@ func TestDisallowEmptyNamespaceInSecConfig(t *testing.T) {
 	}
 }
 
+func TestConfigLoadDirectoryURL(t *testing.T) {
+	fakeInt := new(atomic.Int64)
+	_, c, err := newConfLoader("testdata/directory_url.json", fakeInt, fakeInt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "https://acme.zerossl.com/v2/DV90"
+	if dirURLFromConf(c) != expected {
+		t.Errorf("acme_directory_url: want %#v, got %#v", expected, dirURLFromConf(c))
+	}
+
+	expectedEAB := &eabConf{
+		KeyID:   "kid-1",
+		HMACKey: &secretKeyRef{Namespace: "lekube", Name: "zerossl-eab", Key: "hmac"},
+	}
+	if !cmp.Equal(c.EAB, expectedEAB) {
+		t.Errorf("external_account_binding: want %#v, got %#v", expectedEAB, c.EAB)
+	}
+
+	_, _, err = newConfLoader("testdata/directory_url_and_use_prod.json", fakeInt, fakeInt)
+	if err == nil {
+		t.Errorf("setting both use_prod and acme_directory_url should have errored but didn't")
+	}
+}
+
+func TestValidateWildcardDomains(t *testing.T) {
+	type testcase struct {
+		domain  string
+		dns01   bool
+		wantErr bool
+	}
+	tests := []testcase{
+		{"*.example.com", true, false},
+		{"*.sub.example.com", true, false},
+		{"*.example.com", false, true},
+		{"www.*.example.com", true, true},
+		{"*example.com", true, true},
+		{"*.*.example.com", true, true},
+		{"*.com", true, true},
+	}
+	for _, tc := range tests {
+		conf, err := unmarshalConf([]byte(`{"email": "fake@example.com", "use_prod": false}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.dns01 {
+			conf.DNS01 = &internalDNS01Conf{RFC2136: &rfc2136Conf{Nameserver: "127.0.0.1:53"}}
+		}
+		conf.Secrets = []*secretConf{{Namespace: "default", Name: "wild", Domains: []string{tc.domain}, ChallengeType: challengeDNS01}}
+		err = validateConf(conf)
+		if tc.wantErr && err == nil {
+			t.Errorf("domain %#v, dns01 %t: want error, got none", tc.domain, tc.dns01)
+		}
+		if !tc.wantErr && err != nil {
+			t.Errorf("domain %#v, dns01 %t: want no error, got %s", tc.domain, tc.dns01, err)
+		}
+	}
+}
+
+func TestDomainMismatch(t *testing.T) {
+	type testcase struct {
+		cn       string
+		sans     []string
+		ipSANs   []string
+		domains  []string
+		ips      []string
+		mismatch bool
+	}
+	tests := []testcase{
+		{"*.example.com", []string{"*.example.com", "example.com"}, nil, []string{"*.example.com", "example.com"}, nil, false},
+		{"*.example.com", []string{"*.example.com"}, nil, []string{"*.Example.com."}, nil, false},
+		{"", []string{"*.example.com", "example.com"}, nil, []string{"example.com", "*.example.com"}, nil, false},
+		{"*.example.com", []string{"*.example.com"}, nil, []string{"www.example.com"}, nil, true},
+		{"*.example.com", []string{"*.example.com"}, nil, []string{"*.example.com", "example.com"}, nil, true},
+		{"example.com", []string{"example.com"}, nil, []string{"*.example.com"}, nil, true},
+		{"example.com", []string{"example.com"}, []string{"192.0.2.1", "2001:db8::1"}, []string{"example.com"}, []string{"2001:db8::1", "192.0.2.1"}, false},
+		{"", nil, []string{"192.0.2.1"}, nil, []string{"192.0.2.1"}, false},
+		{"example.com", []string{"example.com"}, []string{"192.0.2.1"}, []string{"example.com"}, []string{"192.0.2.2"}, true},
+		{"example.com", []string{"example.com"}, []string{"192.0.2.1"}, []string{"example.com"}, nil, true},
+		{"example.com", []string{"example.com"}, nil, []string{"example.com"}, []string{"192.0.2.1"}, true},
+	}
+	for _, tc := range tests {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: tc.cn}, DNSNames: tc.sans}
+		for _, ip := range tc.ipSANs {
+			cert.IPAddresses = append(cert.IPAddresses, net.ParseIP(ip))
+		}
+		actual := domainMismatch(cert, tc.domains, tc.ips)
+		if actual != tc.mismatch {
+			t.Errorf("cn %#v, sans %#v, ip sans %#v, domains %#v, ips %#v: want %t, got %t", tc.cn, tc.sans, tc.ipSANs, tc.domains, tc.ips, tc.mismatch, actual)
+		}
+	}
+}
+
+func TestValidateIPAddresses(t *testing.T) {
+	type testcase struct {
+		ips       []string
+		chalType  string
+		canonical []string
+		wantErr   bool
+	}
+	tests := []testcase{
+		{[]string{"192.0.2.1", " 2001:DB8:0::1 "}, "", []string{"192.0.2.1", "2001:db8::1"}, false},
+		{[]string{"::ffff:192.0.2.1"}, challengeHTTP01, []string{"192.0.2.1"}, false},
+		{[]string{"192.0.2.256"}, "", nil, true},
+		{[]string{"fe80::1%eth0"}, "", nil, true},
+		{[]string{"192.0.2.1"}, challengeDNS01, nil, true},
+	}
+	for _, tc := range tests {
+		conf, err := unmarshalConf([]byte(`{"email": "fake@example.com", "use_prod": false}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf.DNS01 = &internalDNS01Conf{RFC2136: &rfc2136Conf{Nameserver: "127.0.0.1:53"}}
+		conf.Secrets = []*secretConf{{Namespace: "default", Name: "ips", IPAddresses: tc.ips, ChallengeType: tc.chalType}}
+		err = validateConf(conf)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("ips %#v, challenge_type %#v: want error, got none", tc.ips, tc.chalType)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ips %#v, challenge_type %#v: want no error, got %s", tc.ips, tc.chalType, err)
+			continue
+		}
+		if !cmp.Equal(conf.Secrets[0].IPAddresses, tc.canonical) {
+			t.Errorf("ips %#v: want canonical %#v, got %#v", tc.ips, tc.canonical, conf.Secrets[0].IPAddresses)
+		}
+	}
+}
+
+func TestCreateCSRWithIPAddresses(t *testing.T) {
+	priv, err := generateCertKey(keyTypeECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := createCSR(nil, []string{"192.0.2.1", "2001:db8::1"}, priv, x509.ECDSAWithSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if csr.Subject.CommonName != "" || len(csr.DNSNames) != 0 {
+		t.Errorf("IP-only CSR should have no CommonName or DNS names, got %#v and %#v", csr.Subject.CommonName, csr.DNSNames)
+	}
+	if len(csr.IPAddresses) != 2 || !csr.IPAddresses[0].Equal(net.ParseIP("192.0.2.1")) || !csr.IPAddresses[1].Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("unexpected IP addresses in CSR: %v", csr.IPAddresses)
+	}
+}
+
+func TestAccountStoreReusesKey(t *testing.T) {
+	ctx := context.Background()
+	secrets := fake.NewClientset().CoreV1().Secrets("default")
+	store := newAccountStore(secrets, "lekube-account")
+	acct, err := store.LoadOrCreate(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirURL := "https://acme.example.com/directory"
+	accountURI := "https://acme.example.com/acct/1"
+	err = store.SaveRegistration(ctx, dirURL, accountURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acct2, err := newAccountStore(secrets, "lekube-account").LoadOrCreate(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !acct.key.Equal(acct2.key) {
+		t.Errorf("account key was not reused on the second load")
+	}
+	if acct2.registrations[dirURL] != accountURI {
+		t.Errorf("registration for %s: want %#v, got %#v", dirURL, accountURI, acct2.registrations[dirURL])
+	}
+}
+
+func TestResponderTLSALPNCertificate(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder := newLEResponser()
+	chalCert, err := (&acme.Client{Key: key}).TLSALPN01ChallengeCert("token", "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder.AddTLSALPNCert("www.example.com", &chalCert)
+	fallback := &tls.Certificate{}
+	getCert := responder.GetCertificate(fallback)
+
+	cert, err := getCert(&tls.ClientHelloInfo{ServerName: "WWW.example.com", SupportedProtos: []string{acme.ALPNProto}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert != &chalCert {
+		t.Errorf("acme-tls/1 request for known domain did not get the challenge cert")
+	}
+	cert, err = getCert(&tls.ClientHelloInfo{ServerName: "www.example.com", SupportedProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert != fallback {
+		t.Errorf("non-acme-tls/1 request did not get the fallback cert")
+	}
+	_, err = getCert(&tls.ClientHelloInfo{ServerName: "other.example.com", SupportedProtos: []string{acme.ALPNProto}})
+	if err == nil {
+		t.Errorf("acme-tls/1 request for unknown domain should have errored")
+	}
+}
+
+func TestExternalAccountBindingFromSecret(t *testing.T) {
+	kube := fake.NewClientset(&kubeapi.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "lekube", Name: "zerossl-eab"},
+		Data:       map[string][]byte{"hmac": []byte("aG1hYy1rZXk=\n")},
+	}).CoreV1()
+	lcm := &leClientMaker{kube: kube}
+	eab := &eabConf{
+		KeyID:   "kid-1",
+		HMACKey: &secretKeyRef{Namespace: "lekube", Name: "zerossl-eab", Key: "hmac"},
+	}
+	acmeEAB, err := lcm.externalAccountBinding(context.Background(), eab)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acmeEAB.KID != "kid-1" || string(acmeEAB.Key) != "hmac-key" {
+		t.Errorf("want KID %#v and key %#v, got KID %#v and key %#v", "kid-1", "hmac-key", acmeEAB.KID, string(acmeEAB.Key))
+	}
+
+	eab.HMACKey.Key = "missing"
+	_, err = lcm.externalAccountBinding(context.Background(), eab)
+	if err == nil {
+		t.Errorf("missing HMAC key in secret should have errored")
+	}
+}
+
 func TestBlockedRequest(t *testing.T) {
 	type testcase struct {
 		path       string
@@ -121,11 +466,15 @@ func TestBlockedRequest(t *testing.T) {
 		{"/debug/foobar", "93.184.216.34", true},
 		{"/", "93.184.216.34", false},
 		{"/foobar", "93.184.216.34", false},
+		{"/admin", "93.184.216.34", true},
+		{"/admin/revoke", "93.184.216.34", true},
+		{"/administrator", "93.184.216.34", false},
 		{"/debug", "127.0.0.1", false},
 		{"/debug/", "127.0.0.1", false},
 		{"/debug/foobar", "127.0.0.1", false},
 		{"/", "127.0.0.1", false},
 		{"/foobar", "127.0.0.1", false},
+		{"/admin/revoke", "127.0.0.1", false},
 	}
 	for _, tc := range tests {
 		r := httptest.NewRequest("GET", tc.path, nil)
@@ -136,3 +485,1211 @@ func TestBlockedRequest(t *testing.T) {
 		}
 	}
 }
+
+func TestShouldRevoke(t *testing.T) {
+	serial, _ := new(big.Int).SetString("fa0b3c71d2", 16)
+	cert := &x509.Certificate{SerialNumber: serial}
+	tests := []struct {
+		serials []string
+		revoke  bool
+	}{
+		{nil, false},
+		{[]string{"fa0b3c71d2"}, true},
+		{[]string{"FA:0B:3C:71:D2"}, true},
+		{[]string{"00fa0b3c71d2"}, true},
+		{[]string{"abcd", "fa0b3c71d2"}, true},
+		{[]string{"fa0b3c71d3"}, false},
+	}
+	for _, tc := range tests {
+		sconf := &secretConf{RevokeSerials: tc.serials}
+		actual := sconf.shouldRevoke(cert)
+		if actual != tc.revoke {
+			t.Errorf("serials %#v: want %t, got %t", tc.serials, tc.revoke, actual)
+		}
+	}
+}
+
+func TestParseRevocationReason(t *testing.T) {
+	tests := []struct {
+		name   string
+		reason acme.CRLReasonCode
+		ok     bool
+	}{
+		{"", acme.CRLReasonUnspecified, true},
+		{"unspecified", acme.CRLReasonUnspecified, true},
+		{"keyCompromise", acme.CRLReasonKeyCompromise, true},
+		{"superseded", acme.CRLReasonSuperseded, true},
+		{"cessationOfOperation", acme.CRLReasonCessationOfOperation, true},
+		// CAs reject the CA-only reasons, so they aren't accepted here.
+		{"cACompromise", 0, false},
+		{"keycompromise", 0, false},
+	}
+	for _, tc := range tests {
+		reason, err := parseRevocationReason(tc.name)
+		if tc.ok != (err == nil) {
+			t.Errorf("%#v: want ok %t, got error %v", tc.name, tc.ok, err)
+			continue
+		}
+		if reason != tc.reason {
+			t.Errorf("%#v: want reason %d, got %d", tc.name, tc.reason, reason)
+		}
+	}
+}
+
+func TestPreferredChain(t *testing.T) {
+	intermediateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediateTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "R3"},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	leafDER := signTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		DNSNames:     []string{"www.example.com"},
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}, intermediateTmpl, &intermediateKey.PublicKey, intermediateKey)
+	// The same intermediate cross-signed by two different roots.
+	chainTo := func(rootCN string) [][]byte {
+		rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rootTmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: rootCN},
+			NotBefore:             time.Now().Add(-1 * time.Hour),
+			NotAfter:              time.Now().Add(24 * time.Hour),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+		}
+		return [][]byte{leafDER, signTestCert(t, intermediateTmpl, rootTmpl, &intermediateKey.PublicKey, rootKey)}
+	}
+	chains := map[string][][]byte{
+		"/cert/1":       chainTo("ISRG Root X1"),
+		"/cert/1/alt/1": chainTo("DST Root CA X3"),
+		"/cert/1/alt/2": chainTo("ISRG Root X2"),
+	}
+
+	var srvURL string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		if r.URL.Path == "/directory" {
+			fmt.Fprintf(w, `{"newNonce": %q, "newAccount": %q, "newOrder": %q}`, srvURL+"/nonce", srvURL+"/account", srvURL+"/order")
+			return
+		}
+		if r.URL.Path == "/nonce" {
+			return
+		}
+		chain, ok := chains[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Path == "/cert/1" {
+			w.Header().Add("Link", fmt.Sprintf(`<%s/cert/1/alt/1>;rel="alternate"`, srvURL))
+			w.Header().Add("Link", fmt.Sprintf(`<%s/cert/1/alt/2>;rel="alternate"`, srvURL))
+		}
+		for _, der := range chain {
+			pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+		}
+	}))
+	defer srv.Close()
+	srvURL = srv.URL
+
+	acctKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := &leClient{
+		cl: &limitedACMEClient{
+			limit: rate.NewLimiter(rate.Inf, 1),
+			cl: &acme.Client{
+				Key:          acctKey,
+				KID:          acme.KeyID(srv.URL + "/account/1"),
+				HTTPClient:   srv.Client(),
+				DirectoryURL: srv.URL + "/directory",
+			},
+		},
+	}
+	tests := []struct {
+		preferred string
+		want      string
+	}{
+		{"ISRG Root X1", "/cert/1"},
+		{"DST Root CA X3", "/cert/1/alt/1"},
+		{"ISRG Root X2", "/cert/1/alt/2"},
+		{"Nonexistent Root", "/cert/1"},
+	}
+	for _, tc := range tests {
+		sconf := &secretConf{Namespace: "default", Name: "www", PreferredChain: tc.preferred}
+		chain := lc.preferredChain(context.Background(), sconf, srv.URL+"/cert/1", chains["/cert/1"])
+		if !cmp.Equal(chain, chains[tc.want]) {
+			issuer, _ := chainTopIssuer(chain)
+			t.Errorf("preferred_chain %#v: want the chain at %s, got one with issuer %#v", tc.preferred, tc.want, issuer)
+		}
+	}
+}
+
+func signTestCert(t *testing.T, tmpl, parent *x509.Certificate, pub crypto.PublicKey, priv crypto.Signer) []byte {
+	t.Helper()
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestCertKeyType(t *testing.T) {
+	for _, keyType := range keyTypes {
+		priv, err := generateCertKey(keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert := &x509.Certificate{PublicKey: priv.Public()}
+		if certKeyType(cert) != keyType {
+			t.Errorf("want key type %#v, got %#v", keyType, certKeyType(cert))
+		}
+	}
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kt := certKeyType(&x509.Certificate{PublicKey: priv.Public()}); kt != "" {
+		t.Errorf("RSA-1024 key: want no key type, got %#v", kt)
+	}
+}
+
+func TestValidateKeyType(t *testing.T) {
+	tests := []struct {
+		keyType string
+		useRSA  bool
+		want    string
+		ok      bool
+	}{
+		{"", false, keyTypeECDSAP256, true},
+		{"", true, keyTypeRSA2048, true},
+		{keyTypeRSA4096, true, keyTypeRSA4096, true},
+		{keyTypeECDSAP384, false, keyTypeECDSAP384, true},
+		{keyTypeECDSAP384, true, "", false},
+		{"ed25519", false, "", false},
+	}
+	for _, tc := range tests {
+		conf, err := unmarshalConf([]byte(`{"email": "fake@example.com", "use_prod": false}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf.Secrets = []*secretConf{{Namespace: "default", Name: "test", Domains: []string{"example.com"}, KeyType: tc.keyType, UseRSA: tc.useRSA}}
+		err = validateConf(conf)
+		if tc.ok != (err == nil) {
+			t.Errorf("key_type %#v, use_rsa %t: want ok %t, got error %v", tc.keyType, tc.useRSA, tc.ok, err)
+			continue
+		}
+		if tc.ok && conf.Secrets[0].KeyType != tc.want {
+			t.Errorf("key_type %#v, use_rsa %t: want key type %#v, got %#v", tc.keyType, tc.useRSA, tc.want, conf.Secrets[0].KeyType)
+		}
+	}
+}
+
+func TestReusableKey(t *testing.T) {
+	priv, err := generateCertKey(keyTypeECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pblock, _, err := encodeCertKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(pblock)
+	dayOld := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+
+	tests := []struct {
+		name      string
+		sconf     *secretConf
+		createdAt time.Time
+		reused    bool
+	}{
+		{"reuse off", &secretConf{KeyType: keyTypeECDSAP256}, dayOld, false},
+		{"reuse on", &secretConf{KeyType: keyTypeECDSAP256, ReuseKey: true}, dayOld, true},
+		{"unknown age without max_key_age", &secretConf{KeyType: keyTypeECDSAP256, ReuseKey: true}, time.Time{}, true},
+		{"key type changed", &secretConf{KeyType: keyTypeRSA2048, ReuseKey: true}, dayOld, false},
+		{"younger than max_key_age", &secretConf{KeyType: keyTypeECDSAP256, ReuseKey: true, MaxKeyAge: jsonDuration(48 * time.Hour)}, dayOld, true},
+		{"older than max_key_age", &secretConf{KeyType: keyTypeECDSAP256, ReuseKey: true, MaxKeyAge: jsonDuration(12 * time.Hour)}, dayOld, false},
+		{"unknown age with max_key_age", &secretConf{KeyType: keyTypeECDSAP256, ReuseKey: true, MaxKeyAge: jsonDuration(48 * time.Hour)}, time.Time{}, false},
+	}
+	for _, tc := range tests {
+		slot := tc.sconf.certSlots()[0]
+		sec := &kubeapi.Secret{Data: map[string][]byte{"tls.key": keyPEM}}
+		setKeyCreatedAt(sec, slot, tc.createdAt)
+		key, createdAt := reusableKey(&tlsSecret{Secret: sec}, tc.sconf, slot)
+		if tc.reused != (key != nil) {
+			t.Errorf("%s: want reused %t, got key %v", tc.name, tc.reused, key)
+			continue
+		}
+		if tc.reused && !createdAt.Equal(tc.createdAt) {
+			t.Errorf("%s: want created at %s, got %s", tc.name, tc.createdAt, createdAt)
+		}
+	}
+
+	// The key of a revoked cert is never reused, whether it was revoked by
+	// revoke_serials or by `lekube revoke`.
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(0xbeef),
+		DNSNames:     []string{"www.example.com"},
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     time.Now().Add(60 * 24 * time.Hour),
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: signTestCert(t, tmpl, tmpl, priv.Public(), priv)})
+	sconf := &secretConf{KeyType: keyTypeECDSAP256, ReuseKey: true}
+	slot := sconf.certSlots()[0]
+	tlsSec := newTLSSecret(&kubeapi.Secret{Data: map[string][]byte{"tls.crt": certPEM, "tls.key": keyPEM}})
+	if key, _ := reusableKey(tlsSec, sconf, slot); key == nil {
+		t.Fatalf("key of unrevoked cert wasn't reused")
+	}
+	revokeSconf := &secretConf{KeyType: keyTypeECDSAP256, ReuseKey: true, RevokeSerials: []string{"be:ef"}}
+	if key, _ := reusableKey(tlsSec, revokeSconf, slot); key != nil {
+		t.Errorf("key of cert in revoke_serials was reused")
+	}
+	tlsSec.Annotations = map[string]string{revokedSerialAnnotation: "beef"}
+	if key, _ := reusableKey(tlsSec, sconf, slot); key != nil {
+		t.Errorf("key of cert recorded as revoked was reused")
+	}
+}
+
+func TestDualKeySlotsCheckedIndependently(t *testing.T) {
+	sconf := &secretConf{
+		Namespace: "default",
+		Name:      "dual",
+		Domains:   []string{"www.example.com"},
+		KeyType:   keyTypeECDSAP256,
+		DualKey:   &dualKeyConf{KeyType: keyTypeRSA2048, CertDataKey: "tls-rsa.crt", KeyDataKey: "tls-rsa.key"},
+	}
+	slots := sconf.certSlots()
+	if len(slots) != 2 {
+		t.Fatalf("want 2 cert slots, got %d", len(slots))
+	}
+	selfSigned := func(keyType string, notAfter time.Time) []byte {
+		priv, err := generateCertKey(keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			DNSNames:     []string{"www.example.com"},
+			NotBefore:    time.Now().Add(-1 * time.Hour),
+			NotAfter:     notAfter,
+		}
+		der := signTestCert(t, tmpl, tmpl, priv.Public(), priv)
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	farOff := time.Now().Add(60 * 24 * time.Hour)
+	soon := time.Now().Add(24 * time.Hour)
+	tests := []struct {
+		name string
+		data map[string][]byte
+		want []bool
+	}{
+		{"both fine", map[string][]byte{"tls.crt": selfSigned(keyTypeECDSAP256, farOff), "tls-rsa.crt": selfSigned(keyTypeRSA2048, farOff)}, []bool{false, false}},
+		{"rsa missing", map[string][]byte{"tls.crt": selfSigned(keyTypeECDSAP256, farOff)}, []bool{false, true}},
+		{"rsa expiring", map[string][]byte{"tls.crt": selfSigned(keyTypeECDSAP256, farOff), "tls-rsa.crt": selfSigned(keyTypeRSA2048, soon)}, []bool{false, true}},
+		{"ecdsa drifted", map[string][]byte{"tls.crt": selfSigned(keyTypeRSA2048, farOff), "tls-rsa.crt": selfSigned(keyTypeRSA2048, farOff)}, []bool{true, false}},
+		{"rsa drifted", map[string][]byte{"tls.crt": selfSigned(keyTypeECDSAP256, farOff), "tls-rsa.crt": selfSigned(keyTypeRSA4096, farOff)}, []bool{false, true}},
+	}
+	for _, tc := range tests {
+		tlsSec := newTLSSecret(&kubeapi.Secret{Data: tc.data})
+		for i, slot := range slots {
+			actual := needsNewCert(context.Background(), nil, tlsSec, sconf, slot, 30*24*time.Hour)
+			if actual != tc.want[i] {
+				t.Errorf("%s: %s: want %t, got %t", tc.name, slot.CertDataKey, tc.want[i], actual)
+			}
+		}
+	}
+}
+
+func TestStoreK8SSecretDualKey(t *testing.T) {
+	kube := fake.NewClientset(&kubeapi.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "dual"},
+		Data:       map[string][]byte{"tls.crt": []byte("ecdsa cert"), "tls.key": []byte("ecdsa key"), "other": []byte("other")},
+	})
+	sconf := &secretConf{
+		Namespace: "default",
+		Name:      "dual",
+		KeyType:   keyTypeECDSAP256,
+		DualKey:   &dualKeyConf{KeyType: keyTypeRSA2048, CertDataKey: "tls-rsa.crt", KeyDataKey: "tls-rsa.key"},
+	}
+	ctx := context.Background()
+	secrets := kube.CoreV1().Secrets("default")
+	tlsSec, err := fetchK8SSecret(ctx, secrets, sconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Now().Truncate(time.Second)
+	sec, err := storeK8SSecret(ctx, secrets, sconf, sconf.certSlots()[1], tlsSec.Secret, &newCert{Cert: []byte("rsa cert"), Key: []byte("rsa key"), KeyCreatedAt: created})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]byte{
+		"tls.crt":     []byte("ecdsa cert"),
+		"tls.key":     []byte("ecdsa key"),
+		"tls-rsa.crt": []byte("rsa cert"),
+		"tls-rsa.key": []byte("rsa key"),
+		"other":       []byte("other"),
+	}
+	if !cmp.Equal(sec.Data, expected) {
+		t.Errorf("secret data: want %q, got %q", expected, sec.Data)
+	}
+	if !keyCreatedAt(sec, sconf.certSlots()[1]).Equal(created) {
+		t.Errorf("rsa key created at: want %s, got %s", created, keyCreatedAt(sec, sconf.certSlots()[1]))
+	}
+	if !keyCreatedAt(sec, sconf.certSlots()[0]).IsZero() {
+		t.Errorf("ecdsa key created at should not have been set, got %s", keyCreatedAt(sec, sconf.certSlots()[0]))
+	}
+}
+
+func TestFetchK8SSecret(t *testing.T) {
+	sconf := &secretConf{
+		Namespace: "default",
+		Name:      "dual",
+		KeyType:   keyTypeECDSAP256,
+		DualKey:   &dualKeyConf{KeyType: keyTypeRSA2048, CertDataKey: "tls-rsa.crt", KeyDataKey: "tls-rsa.key"},
+	}
+	tests := []struct {
+		name   string
+		sec    *kubeapi.Secret
+		exists bool
+	}{
+		{"missing", nil, false},
+		{"tls.crt", &kubeapi.Secret{Data: map[string][]byte{"tls.crt": []byte("ecdsa cert")}}, true},
+		{"only the dual_key slot", &kubeapi.Secret{Data: map[string][]byte{"tls-rsa.crt": []byte("rsa cert")}}, true},
+		{"only other data", &kubeapi.Secret{Data: map[string][]byte{"other": []byte("other")}}, false},
+		{"only lekube annotations", &kubeapi.Secret{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{failureCountAnnotation: "1"}}}, true},
+		{"only other annotations", &kubeapi.Secret{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"example.com/note": "hi"}}}, false},
+	}
+	for _, tc := range tests {
+		kube := fake.NewClientset()
+		if tc.sec != nil {
+			tc.sec.Namespace, tc.sec.Name = "default", "dual"
+			kube = fake.NewClientset(tc.sec)
+		}
+		tlsSec, err := fetchK8SSecret(context.Background(), kube.CoreV1().Secrets("default"), sconf)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if tc.exists != (tlsSec != nil) {
+			t.Errorf("%s: want existing secret %t, got %v", tc.name, tc.exists, tlsSec)
+		}
+	}
+
+	// A Secret holding only lekube's annotations is updated, not created
+	// again, when a cert is stored in it.
+	kube := fake.NewClientset(&kubeapi.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "dual", Annotations: map[string]string{failureCountAnnotation: "1"}}})
+	secrets := kube.CoreV1().Secrets("default")
+	tlsSec, err := fetchK8SSecret(context.Background(), secrets, sconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec, err := storeK8SSecret(context.Background(), secrets, sconf, sconf.certSlots()[1], tlsSec.Secret, &newCert{Cert: []byte("rsa cert"), Key: []byte("rsa key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(sec.Data["tls-rsa.crt"]) != "rsa cert" {
+		t.Errorf("dual_key cert wasn't stored: %q", sec.Data)
+	}
+}
+
+func TestCleanUpFailedOrder(t *testing.T) {
+	acctKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var srvURL string
+	var mu sync.Mutex
+	deactivated := []string{}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		switch r.URL.Path {
+		case "/directory":
+			fmt.Fprintf(w, `{"newNonce": %q, "newAccount": %q, "newOrder": %q}`, srvURL+"/nonce", srvURL+"/account", srvURL+"/order")
+			return
+		case "/nonce":
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		jws, err := jose.ParseSigned(string(b), []jose.SignatureAlgorithm{jose.RS256})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		payload, err := jws.Verify(&acctKey.PublicKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status := map[string]string{"/authz/1": "valid", "/authz/2": "invalid", "/authz/3": "pending"}[r.URL.Path]
+		if status == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if len(payload) != 0 {
+			var req struct{ Status string }
+			json.Unmarshal(payload, &req)
+			if req.Status == "deactivated" {
+				mu.Lock()
+				deactivated = append(deactivated, r.URL.Path)
+				mu.Unlock()
+				status = "deactivated"
+			}
+		}
+		chalErr := ""
+		if status == "invalid" {
+			chalErr = `, "error": {"type": "urn:ietf:params:acme:error:unauthorized", "detail": "Invalid response"}`
+		}
+		fmt.Fprintf(w, `{"status": %q, "identifier": {"type": "dns", "value": "www.example.com"}, "challenges": [{"type": "http-01", "url": %q, "token": "t", "status": %q%s}]}`, status, srvURL+"/chal"+r.URL.Path, status, chalErr)
+	}))
+	defer srv.Close()
+	srvURL = srv.URL
+
+	lc := &leClient{
+		cl: &limitedACMEClient{
+			limit: rate.NewLimiter(rate.Inf, 1),
+			cl: &acme.Client{
+				Key:          acctKey,
+				KID:          acme.KeyID(srv.URL + "/account/1"),
+				HTTPClient:   srv.Client(),
+				DirectoryURL: srv.URL + "/directory",
+			},
+		},
+	}
+	lc.cleanUpFailedOrder(context.Background(), []string{srv.URL + "/authz/1", srv.URL + "/authz/2", srv.URL + "/authz/3"})
+	if !cmp.Equal(deactivated, []string{"/authz/3"}) {
+		t.Errorf("deactivated authorizations: want %#v, got %#v", []string{"/authz/3"}, deactivated)
+	}
+}
+
+func TestResponderRemovesOnlyGivenChallenges(t *testing.T) {
+	responder := newLEResponser()
+	responder.AddAuthorization("a.example.com", "token-a", "token-a.thumbprint")
+	responder.AddAuthorization("b.example.com", "token-b", "token-b.thumbprint")
+	responder.RemoveAuthorization("token-a")
+
+	for token, want := range map[string]int{"token-a": http.StatusNotFound, "token-b": http.StatusOK} {
+		w := httptest.NewRecorder()
+		responder.ServeHTTP(w, httptest.NewRequest("GET", acmePath+token, nil))
+		if w.Code != want {
+			t.Errorf("%s: want status %d, got %d", token, want, w.Code)
+		}
+	}
+
+	// An order finishing with a domain's tls-alpn-01 cert leaves the one
+	// another order has since put in its place.
+	oldCert, newCert := &tls.Certificate{}, &tls.Certificate{}
+	responder.AddTLSALPNCert("c.example.com", oldCert)
+	responder.AddTLSALPNCert("c.example.com", newCert)
+	responder.RemoveTLSALPNCert("c.example.com", oldCert)
+	cert, err := responder.GetCertificate(nil)(&tls.ClientHelloInfo{ServerName: "c.example.com", SupportedProtos: []string{acme.ALPNProto}})
+	if err != nil || cert != newCert {
+		t.Errorf("replacement tls-alpn-01 cert was removed along with the one it replaced")
+	}
+	responder.RemoveTLSALPNCert("c.example.com", newCert)
+	if _, err := responder.GetCertificate(nil)(&tls.ClientHelloInfo{ServerName: "c.example.com", SupportedProtos: []string{acme.ALPNProto}}); err == nil {
+		t.Errorf("tls-alpn-01 cert was still served after its order removed it")
+	}
+}
+
+// slowCoreV1 hands out Secrets clients whose Gets call get and then fail, so
+// runs never get as far as ordering certs.
+type slowCoreV1 struct {
+	corev1.CoreV1Interface
+	get func()
+}
+
+func (c slowCoreV1) Secrets(namespace string) corev1.SecretInterface {
+	return slowSecrets{c.CoreV1Interface.Secrets(namespace), c.get}
+}
+
+type slowSecrets struct {
+	corev1.SecretInterface
+	get func()
+}
+
+func (s slowSecrets) Get(ctx context.Context, name string, opts metav1.GetOptions) (*kubeapi.Secret, error) {
+	s.get()
+	return nil, errors.New("secret fetches are turned off in this test")
+}
+
+func TestRunWorksOnSecretsConcurrently(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, maxInFlight, total := 0, 0, 0
+	client := slowCoreV1{
+		CoreV1Interface: fake.NewClientset().CoreV1(),
+		get: func() {
+			mu.Lock()
+			inFlight++
+			total++
+			maxInFlight = max(maxInFlight, inFlight)
+			mu.Unlock()
+			time.Sleep(100 * time.Millisecond)
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		},
+	}
+	conf := &allConf{Concurrency: 3}
+	for i := 0; i < 7; i++ {
+		conf.Secrets = append(conf.Secrets, &secretConf{Namespace: "default", Name: fmt.Sprintf("sec%d", i), Domains: []string{fmt.Sprintf("sec%d.example.com", i)}})
+	}
+	run(&leClientMaker{}, client, conf, time.Minute)
+
+	if total != 7 {
+		t.Errorf("fetched %d secrets, want 7", total)
+	}
+	if maxInFlight != 3 {
+		t.Errorf("at most %d secrets were worked on at once, want 3", maxInFlight)
+	}
+}
+
+// newKeyChangeTestCA returns an ACME server whose key-change endpoint accepts
+// rollovers from the current account key, or rejects all of them if fail is
+// true. Its new-account endpoint only looks up the account at
+// /account/1 by its current key. It returns a func giving the account key it
+// currently accepts.
+func newKeyChangeTestCA(t *testing.T, acctKey *rsa.PrivateKey, fail bool) (*httptest.Server, func() *rsa.PublicKey) {
+	var mu sync.Mutex
+	current := &acctKey.PublicKey
+	var srvURL string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		switch r.URL.Path {
+		case "/directory":
+			fmt.Fprintf(w, `{"newNonce": %q, "newAccount": %q, "newOrder": %q, "keyChange": %q}`, srvURL+"/nonce", srvURL+"/account", srvURL+"/order", srvURL+"/key-change")
+			return
+		case "/nonce":
+			return
+		case "/account":
+			b, _ := io.ReadAll(r.Body)
+			jws, err := jose.ParseSigned(string(b), []jose.SignatureAlgorithm{jose.RS256})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			jwk := jws.Signatures[0].Header.JSONWebKey
+			if jwk == nil || !current.Equal(jwk.Key) {
+				w.Header().Set("Content-Type", "application/problem+json")
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"type": "urn:ietf:params:acme:error:accountDoesNotExist", "detail": "no account with this key"}`)
+				return
+			}
+			w.Header().Set("Location", srvURL+"/account/1")
+			fmt.Fprint(w, `{"status": "valid"}`)
+			return
+		case "/key-change":
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if fail {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"type": "urn:ietf:params:acme:error:unauthorized", "detail": "key change is not allowed"}`)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		outer, err := jose.ParseSigned(string(b), []jose.SignatureAlgorithm{jose.RS256})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		payload, err := outer.Verify(current)
+		if err != nil {
+			http.Error(w, "outer JWS not signed by the current account key: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		inner, err := jose.ParseSigned(string(payload), []jose.SignatureAlgorithm{jose.RS256})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		newKey, ok := inner.Signatures[0].Header.JSONWebKey.Key.(*rsa.PublicKey)
+		if !ok {
+			http.Error(w, "no RSA jwk in inner JWS", http.StatusBadRequest)
+			return
+		}
+		if _, err := inner.Verify(newKey); err != nil {
+			http.Error(w, "inner JWS not signed by its jwk: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		current = newKey
+		fmt.Fprint(w, `{}`)
+	}))
+	t.Cleanup(srv.Close)
+	srvURL = srv.URL
+	return srv, func() *rsa.PublicKey {
+		mu.Lock()
+		defer mu.Unlock()
+		return current
+	}
+}
+
+func TestRolloverAccountKey(t *testing.T) {
+	ctx := context.Background()
+	secrets := fake.NewClientset().CoreV1().Secrets("default")
+	store := newAccountStore(secrets, "lekube-account")
+	acct, err := store.LoadOrCreate(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acct.keyCreatedAt.IsZero() {
+		t.Errorf("new account key has no creation time")
+	}
+	oldKey := acct.key
+	good, goodKey := newKeyChangeTestCA(t, oldKey, false)
+	bad, _ := newKeyChangeTestCA(t, oldKey, true)
+	goodDir, badDir := good.URL+"/directory", bad.URL+"/directory"
+	for dir, uri := range map[string]string{goodDir: good.URL + "/account/1", badDir: bad.URL + "/account/1"} {
+		err = store.SaveRegistration(ctx, dir, uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		acct.registrations[dir] = uri
+	}
+
+	responder := newLEResponser()
+	// Both test servers use the same test cert.
+	lcm := newLEClientMaker(good.Client(), acct, store, nil, responder, rate.NewLimiter(rate.Inf, 1))
+	lcm.clients[goodDir] = &leClient{}
+
+	err = lcm.RolloverAccountKey(ctx, goodDir)
+	if err != nil {
+		t.Fatalf("RolloverAccountKey: %s", err)
+	}
+	if lcm.accountKey.Equal(oldKey) {
+		t.Fatalf("account key wasn't changed")
+	}
+	if !goodKey().Equal(&lcm.accountKey.PublicKey) {
+		t.Errorf("CA doesn't have the new account key")
+	}
+	if len(lcm.clients) != 0 {
+		t.Errorf("cached clients using the old key weren't dropped")
+	}
+	// The CA that rejected the rollover still knows the account by the old
+	// key, so it's kept for it.
+	wantRegs := map[string]string{goodDir: good.URL + "/account/1", badDir: bad.URL + "/account/1"}
+	if !cmp.Equal(lcm.registrations, wantRegs) {
+		t.Errorf("registrations: want %#v, got %#v", wantRegs, lcm.registrations)
+	}
+	if len(lcm.keys) != 1 || !oldKey.Equal(lcm.keys[badDir]) {
+		t.Errorf("old key wasn't kept for the CA that rejected the rollover: %#v", lcm.keys)
+	}
+
+	stored, err := newAccountStore(secrets, "lekube-account").LoadOrCreate(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.key.Equal(lcm.accountKey) {
+		t.Errorf("stored account key isn't the new one")
+	}
+	if !cmp.Equal(stored.registrations, wantRegs) {
+		t.Errorf("stored registrations: want %#v, got %#v", wantRegs, stored.registrations)
+	}
+	if len(stored.keys) != 1 || !oldKey.Equal(stored.keys[badDir]) {
+		t.Errorf("stored keys: old key wasn't kept for the CA that rejected the rollover")
+	}
+	sec, err := secrets.Get(ctx, "lekube-account", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sec.Data[accountNextKeySecretKey]; ok {
+		t.Errorf("%s left in account secret after a finished rollover", accountNextKeySecretKey)
+	}
+}
+
+func TestRolloverAccountKeyFailureKeepsOldKey(t *testing.T) {
+	ctx := context.Background()
+	secrets := fake.NewClientset().CoreV1().Secrets("default")
+	store := newAccountStore(secrets, "lekube-account")
+	acct, err := store.LoadOrCreate(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey := acct.key
+	bad, _ := newKeyChangeTestCA(t, oldKey, true)
+	badDir := bad.URL + "/directory"
+	acct.registrations[badDir] = bad.URL + "/account/1"
+	responder := newLEResponser()
+	lcm := newLEClientMaker(bad.Client(), acct, store, nil, responder, rate.NewLimiter(rate.Inf, 1))
+
+	err = lcm.RolloverAccountKey(ctx, badDir)
+	if err == nil {
+		t.Fatalf("RolloverAccountKey succeeded against a CA that rejected it")
+	}
+	if !lcm.accountKey.Equal(oldKey) {
+		t.Errorf("account key was changed after a failed rollover")
+	}
+	sec, err := secrets.Get(ctx, "lekube-account", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{accountNextKeySecretKey, accountRegistrationNextKeysSecretKey} {
+		if _, ok := sec.Data[k]; ok {
+			t.Errorf("%s was left in the account secret after the CA turned down the rollover", k)
+		}
+	}
+	stored, err := newAccountStore(secrets, "lekube-account").LoadOrCreate(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.key.Equal(oldKey) {
+		t.Errorf("stored account key was changed after a failed rollover")
+	}
+}
+
+func TestRolloverAccountKeyRetriesFailedCA(t *testing.T) {
+	ctx := context.Background()
+	secrets := fake.NewClientset().CoreV1().Secrets("default")
+	store := newAccountStore(secrets, "lekube-account")
+	acct, err := store.LoadOrCreate(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey := acct.key
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary, _ := newKeyChangeTestCA(t, oldKey, false)
+	other, otherCAKey := newKeyChangeTestCA(t, otherKey, false)
+	primaryDir, otherDir := primary.URL+"/directory", other.URL+"/directory"
+	acct.registrations[primaryDir] = primary.URL + "/account/1"
+	acct.registrations[otherDir] = other.URL + "/account/1"
+	// A previous rollover left the other CA on its own key.
+	acct.keys[otherDir] = otherKey
+	lcm := newLEClientMaker(primary.Client(), acct, store, nil, newLEResponser(), rate.NewLimiter(rate.Inf, 1))
+
+	err = lcm.RolloverAccountKey(ctx, primaryDir)
+	if err != nil {
+		t.Fatalf("RolloverAccountKey: %s", err)
+	}
+	if !otherCAKey().Equal(&lcm.accountKey.PublicKey) {
+		t.Errorf("CA left on its own key wasn't moved to the new account key")
+	}
+	if len(lcm.keys) != 0 {
+		t.Errorf("registration keys left after every CA was rolled over: %#v", lcm.keys)
+	}
+}
+
+func TestRolloverAccountKeyOwnAccounts(t *testing.T) {
+	ctx := context.Background()
+	secrets := fake.NewClientset().CoreV1().Secrets("default")
+	store := newAccountStore(secrets, "lekube-account")
+	acct, err := store.LoadOrCreate(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ownKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary, primaryKey := newKeyChangeTestCA(t, acct.key, false)
+	own, ownCAKey := newKeyChangeTestCA(t, ownKey, false)
+	primaryDir := primary.URL + "/directory"
+	ownName := acmeCA{DirectoryURL: own.URL + "/directory", Emails: []string{"team@example.com"}, OwnAccountOf: "default:team"}.account()
+	acct.registrations[primaryDir] = primary.URL + "/account/1"
+	acct.registrations[ownName] = own.URL + "/account/1"
+	acct.keys[ownName] = ownKey
+	lcm := newLEClientMaker(primary.Client(), acct, store, nil, newLEResponser(), rate.NewLimiter(rate.Inf, 1))
+
+	err = lcm.RolloverAccountKey(ctx, primaryDir)
+	if err != nil {
+		t.Fatalf("RolloverAccountKey: %s", err)
+	}
+	if !primaryKey().Equal(&lcm.accountKey.PublicKey) {
+		t.Errorf("CA doesn't have the new account key")
+	}
+	newOwnKey := lcm.keys[ownName]
+	if newOwnKey == nil || newOwnKey.Equal(ownKey) || newOwnKey.Equal(lcm.accountKey) {
+		t.Fatalf("account of a secret's own emails wasn't given a new key of its own")
+	}
+	if !ownCAKey().Equal(&newOwnKey.PublicKey) {
+		t.Errorf("CA doesn't have the new key of the account of a secret's own emails")
+	}
+	stored, err := newAccountStore(secrets, "lekube-account").LoadOrCreate(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !newOwnKey.Equal(stored.keys[ownName]) {
+		t.Errorf("new key of the account of a secret's own emails wasn't stored")
+	}
+}
+
+func TestLoadOrCreateFinishesInterruptedRollover(t *testing.T) {
+	ctx := context.Background()
+	secrets := fake.NewClientset().CoreV1().Secrets("default")
+	store := newAccountStore(secrets, "lekube-account")
+	acct, err := store.LoadOrCreate(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey := acct.key
+	switched, _ := newKeyChangeTestCA(t, oldKey, false)
+	unswitched, _ := newKeyChangeTestCA(t, oldKey, false)
+	switchedDir, unswitchedDir := switched.URL+"/directory", unswitched.URL+"/directory"
+	for dir, uri := range map[string]string{switchedDir: switched.URL + "/account/1", unswitchedDir: unswitched.URL + "/account/1"} {
+		err = store.SaveRegistration(ctx, dir, uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.SavePendingKey(ctx, newKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// lekube died after only one of the CAs switched to the new key.
+	cl := &acme.Client{Key: oldKey, KID: acme.KeyID(switched.URL + "/account/1"), HTTPClient: switched.Client(), DirectoryURL: switchedDir}
+	err = cl.AccountKeyRollover(ctx, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both test servers use the same test cert.
+	got, err := newAccountStore(secrets, "lekube-account").LoadOrCreate(ctx, switched.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.key.Equal(newKey) {
+		t.Errorf("account key isn't the one the CA switched to")
+	}
+	if len(got.keys) != 1 || !oldKey.Equal(got.keys[unswitchedDir]) {
+		t.Errorf("old key wasn't kept for the CA that didn't switch: %#v", got.keys)
+	}
+	stored, err := newAccountStore(secrets, "lekube-account").LoadOrCreate(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.key.Equal(newKey) || !oldKey.Equal(stored.keys[unswitchedDir]) {
+		t.Errorf("finished rollover wasn't stored")
+	}
+	sec, err := secrets.Get(ctx, "lekube-account", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sec.Data[accountNextKeySecretKey]; ok {
+		t.Errorf("%s left in account secret after the rollover was finished", accountNextKeySecretKey)
+	}
+}
+
+func TestLoadOrCreateDropsUnusedNextKey(t *testing.T) {
+	ctx := context.Background()
+	secrets := fake.NewClientset().CoreV1().Secrets("default")
+	store := newAccountStore(secrets, "lekube-account")
+	acct, err := store.LoadOrCreate(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := newKeyChangeTestCA(t, acct.key, false)
+	err = store.SaveRegistration(ctx, ca.URL+"/directory", ca.URL+"/account/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.SavePendingKey(ctx, newKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := newAccountStore(secrets, "lekube-account").LoadOrCreate(ctx, ca.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.key.Equal(acct.key) || len(got.keys) != 0 {
+		t.Errorf("account key changed though no CA switched to the new one")
+	}
+	sec, err := secrets.Get(ctx, "lekube-account", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sec.Data[accountNextKeySecretKey]; ok {
+		t.Errorf("unused %s left in account secret", accountNextKeySecretKey)
+	}
+}
+
+func TestValidateEmails(t *testing.T) {
+	tests := []struct {
+		email   string
+		emails  []string
+		want    []string
+		wantErr bool
+	}{
+		{email: "a@example.com", want: []string{"a@example.com"}},
+		{emails: []string{"a@example.com", "mailto:b@example.com"}, want: []string{"a@example.com", "b@example.com"}},
+		{email: "a@example.com", emails: []string{"b@example.com"}, wantErr: true},
+		{wantErr: true},
+		{emails: []string{""}, wantErr: true},
+		{emails: []string{"a@example.com, b@example.com"}, wantErr: true},
+	}
+	for i, tc := range tests {
+		useProd := false
+		conf := &internalAllConf{
+			Email:         tc.email,
+			Emails:        tc.emails,
+			UseProd:       &useProd,
+			AccountSecret: &secretRef{Namespace: "default", Name: "lekube-account"},
+		}
+		err := validateConf(conf)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("#%d: want error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: want no error, got %s", i, err)
+			continue
+		}
+		if !cmp.Equal(conf.Emails, tc.want) {
+			t.Errorf("#%d: emails: want %#v, got %#v", i, tc.want, conf.Emails)
+		}
+	}
+}
+
+func TestValidateSecretAccounts(t *testing.T) {
+	yes := true
+	no := false
+	tests := []struct {
+		secrets []*secretConf
+		wantErr bool
+	}{
+		{secrets: []*secretConf{{Emails: []string{"b@example.com"}, UseProd: &yes}}},
+		{secrets: []*secretConf{{Email: "b@example.com", DirectoryURL: "https://acme.example.com/directory"}}},
+		// Setting the top-level settings again is fine.
+		{secrets: []*secretConf{{Email: "mailto:a@example.com", UseProd: &no}}},
+		// Secrets with their own emails get their own accounts at the CA.
+		{secrets: []*secretConf{{Email: "b@example.com"}}},
+		{secrets: []*secretConf{{UseProd: &yes, DirectoryURL: "https://acme.example.com/directory"}}, wantErr: true},
+		{secrets: []*secretConf{{DirectoryURL: "http://acme.example.com/directory"}}, wantErr: true},
+		{secrets: []*secretConf{{Email: "b@example.com", Emails: []string{"c@example.com"}, UseProd: &yes}}, wantErr: true},
+		{secrets: []*secretConf{{Email: "b@example.com", DirectoryURL: "https://fallback.example.com/directory"}}},
+		{secrets: []*secretConf{{DirectoryURL: "https://fallback.example.com/directory"}}},
+		{
+			secrets: []*secretConf{
+				{Email: "b@example.com", DirectoryURL: "https://acme.example.com/directory"},
+				{Email: "c@example.com", DirectoryURL: "https://acme.example.com/directory/"},
+			},
+		},
+		{
+			secrets: []*secretConf{
+				{Emails: []string{"b@example.com", "c@example.com"}, DirectoryURL: "https://acme.example.com/directory"},
+				{Emails: []string{"c@example.com", "b@example.com"}, DirectoryURL: "https://acme.example.com/directory/"},
+			},
+		},
+	}
+	for i, tc := range tests {
+		for j, sc := range tc.secrets {
+			sc.Namespace = "default"
+			sc.Name = fmt.Sprintf("sec%d", j)
+			sc.Domains = []string{fmt.Sprintf("sec%d.example.com", j)}
+		}
+		conf := &internalAllConf{
+			Email:         "a@example.com",
+			UseProd:       &no,
+			AccountSecret: &secretRef{Namespace: "default", Name: "lekube-account"},
+			Secrets:       tc.secrets,
+			ACMECAs:       []*acmeCAConf{{DirectoryURL: "https://fallback.example.com/directory"}},
+		}
+		err := validateConf(conf)
+		if tc.wantErr && err == nil {
+			t.Errorf("#%d: want error, got none", i)
+		}
+		if !tc.wantErr && err != nil {
+			t.Errorf("#%d: want no error, got %s", i, err)
+		}
+	}
+}
+
+func TestValidateACMECAs(t *testing.T) {
+	tests := []struct {
+		cas     []*acmeCAConf
+		wantErr bool
+	}{
+		{cas: []*acmeCAConf{{DirectoryURL: "https://a.example.com/directory"}, {DirectoryURL: "https://b.example.com/directory"}}},
+		{cas: []*acmeCAConf{{DirectoryURL: ""}}, wantErr: true},
+		{cas: []*acmeCAConf{{DirectoryURL: "http://a.example.com/directory"}}, wantErr: true},
+		{cas: []*acmeCAConf{{DirectoryURL: "https://a.example.com/directory", EAB: &eabConf{}}}, wantErr: true},
+		{cas: []*acmeCAConf{{DirectoryURL: "https://a.example.com/directory"}, {DirectoryURL: "https://a.example.com/directory/"}}, wantErr: true},
+		{cas: []*acmeCAConf{{DirectoryURL: "https://acme-staging-v02.api.letsencrypt.org/directory"}}, wantErr: true},
+	}
+	for i, tc := range tests {
+		useProd := false
+		conf := &internalAllConf{
+			Email:         "a@example.com",
+			UseProd:       &useProd,
+			AccountSecret: &secretRef{Namespace: "default", Name: "lekube-account"},
+			ACMECAs:       tc.cas,
+		}
+		err := validateConf(conf)
+		if tc.wantErr && err == nil {
+			t.Errorf("#%d: want error, got none", i)
+		}
+		if !tc.wantErr && err != nil {
+			t.Errorf("#%d: want no error, got %s", i, err)
+		}
+	}
+}
+
+func TestAccountFor(t *testing.T) {
+	yes := true
+	eab := &eabConf{KeyID: "kid"}
+	conf := &allConf{
+		Emails:       []string{"a@example.com"},
+		DirectoryURL: "https://acme.example.com/directory",
+		EAB:          eab,
+	}
+	tests := []struct {
+		secConf    *secretConf
+		wantDir    string
+		wantEmails []string
+		wantEAB    *eabConf
+	}{
+		{&secretConf{}, "https://acme.example.com/directory", []string{"a@example.com"}, eab},
+		{&secretConf{Emails: []string{"b@example.com"}}, "https://acme.example.com/directory", []string{"b@example.com"}, eab},
+		{&secretConf{UseProd: &yes}, "https://acme-v02.api.letsencrypt.org/directory", []string{"a@example.com"}, nil},
+		{&secretConf{DirectoryURL: "https://acme.example.com/directory/"}, "https://acme.example.com/directory", []string{"a@example.com"}, eab},
+		{&secretConf{DirectoryURL: "https://other.example.com/directory", Emails: []string{"b@example.com"}}, "https://other.example.com/directory", []string{"b@example.com"}, nil},
+	}
+	for i, tc := range tests {
+		dir, emails, gotEAB := conf.accountFor(tc.secConf)
+		if dir != tc.wantDir || !cmp.Equal(emails, tc.wantEmails) || gotEAB != tc.wantEAB {
+			t.Errorf("#%d: accountFor = %#v, %#v, %p; want %#v, %#v, %p", i, dir, emails, gotEAB, tc.wantDir, tc.wantEmails, tc.wantEAB)
+		}
+	}
+}
+
+func TestMakeUpdatesContactsOfExistingAccount(t *testing.T) {
+	acctKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var srvURL string
+	var mu sync.Mutex
+	contacts := []string{"mailto:old@example.com"}
+	registrations := 0
+	// accountRequests counts the lookups of the account by its key.
+	accountRequests := 0
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		switch r.URL.Path {
+		case "/directory":
+			fmt.Fprintf(w, `{"newNonce": %q, "newAccount": %q, "newOrder": %q}`, srvURL+"/nonce", srvURL+"/account", srvURL+"/order")
+			return
+		case "/nonce":
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		jws, err := jose.ParseSigned(string(b), []jose.SignatureAlgorithm{jose.RS256})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		payload, err := jws.Verify(&acctKey.PublicKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var req struct {
+			Contact            []string
+			OnlyReturnExisting bool
+		}
+		json.Unmarshal(payload, &req)
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/account":
+			if !req.OnlyReturnExisting {
+				registrations++
+			} else {
+				accountRequests++
+			}
+		case "/account/1":
+			contacts = req.Contact
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Location", srvURL+"/account/1")
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "valid", "contact": contacts})
+	}))
+	defer srv.Close()
+	srvURL = srv.URL
+	dirURL := srv.URL + "/directory"
+
+	acct := &persistedAccount{key: acctKey, registrations: map[string]string{dirURL: srv.URL + "/account/1"}}
+	lcm := newLEClientMaker(srv.Client(), acct, nil, nil, nil, rate.NewLimiter(rate.Inf, 1))
+	ctx := context.Background()
+
+	lc, err := lcm.Make(ctx, acmeCA{DirectoryURL: dirURL, Emails: []string{"new@example.com", "ops@example.com"}})
+	if err != nil {
+		t.Fatalf("Make: %s", err)
+	}
+	want := []string{"mailto:new@example.com", "mailto:ops@example.com"}
+	mu.Lock()
+	if !cmp.Equal(contacts, want) {
+		t.Errorf("contacts after first Make: want %#v, got %#v", want, contacts)
+	}
+	mu.Unlock()
+
+	lc2, err := lcm.Make(ctx, acmeCA{DirectoryURL: dirURL + "/", Emails: []string{"other@example.com"}})
+	if err != nil {
+		t.Fatalf("Make: %s", err)
+	}
+	if lc2 != lc {
+		t.Errorf("Make returned a new client for the same directory after the email changed")
+	}
+	want = []string{"mailto:other@example.com"}
+	mu.Lock()
+	if !cmp.Equal(contacts, want) {
+		t.Errorf("contacts after email change: want %#v, got %#v", want, contacts)
+	}
+	if registrations != 0 {
+		t.Errorf("registered %d new accounts, want none", registrations)
+	}
+	before := accountRequests
+	mu.Unlock()
+
+	// The account is only checked once per run.
+	_, err = lcm.Make(ctx, acmeCA{DirectoryURL: dirURL, Emails: []string{"other@example.com"}})
+	if err != nil {
+		t.Fatalf("Make: %s", err)
+	}
+	mu.Lock()
+	if accountRequests != before {
+		t.Errorf("up to date account was checked again in the same run")
+	}
+	mu.Unlock()
+	lcm.StartRun()
+	_, err = lcm.Make(ctx, acmeCA{DirectoryURL: dirURL, Emails: []string{"other@example.com"}})
+	if err != nil {
+		t.Fatalf("Make: %s", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if accountRequests == before {
+		t.Errorf("account wasn't checked again in the next run")
+	}
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"flag"
@@ -13,9 +16,11 @@ import (
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -33,6 +38,8 @@ import (
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/acme"
 	"golang.org/x/time/rate"
 	kubeapi "k8s.io/api/core/v1"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
@@ -43,10 +50,11 @@ import (
 )
 
 var (
-	confPath     = flag.String("conf", "", "path to required JSON config file described by https://github.com/jmhodges/lekube/#config-format")
-	httpAddr     = flag.String("addr", ":10080", "address to boot the HTTP server on")
-	httpsAddr    = flag.String("httpsAddr", ":10443", "address to boot the HTTPS server on")
-	leTimeoutDur = flag.Duration("leTimeout", 30*time.Minute, "max time to spend fetching and creating a certificate (but not time spent fetching and storing secrets)")
+	confPath      = flag.String("conf", "", "path to required JSON config file described by https://github.com/jmhodges/lekube/#config-format")
+	httpAddr      = flag.String("addr", ":10080", "address to boot the HTTP server on")
+	httpsAddr     = flag.String("httpsAddr", ":10443", "address to boot the HTTPS server on")
+	leTimeoutDur  = flag.Duration("leTimeout", 30*time.Minute, "max time to spend fetching and creating the certificates of each secret (but not time spent fetching and storing secrets)")
+	acmeRootsPath = flag.String("acmeRoots", "", "path to a PEM file of root certificates to trust, along with the system's, when talking to the ACME CA (e.g. Pebble's)")
 
 	tracer = otel.Tracer("lekube")
 	meter  = otel.Meter("lekube")
@@ -55,6 +63,7 @@ var (
 	fetchLECertAttempts  = mustInt64Counter(fetchLECertPrefix+"attempts", "The number of attempts when fetching the Let's Encrypt certificate.")
 	fetchLECertErrors    = mustInt64Counter(fetchLECertPrefix+"errors", "The number of errors when fetching the Let's Encrypt certificate.")
 	fetchLECertSuccesses = mustInt64Counter(fetchLECertPrefix+"successes", "The number of successes when fetching the Let's Encrypt certificate.")
+	fetchLECertFallbacks = mustInt64Counter(fetchLECertPrefix+"fallbacks", "The number of times a certificate was ordered from a fallback CA after the usual one failed.")
 
 	fetchSecretPrefix    = "stages/fetch-secret/"
 	fetchSecretAttempts  = mustInt64Counter(fetchSecretPrefix+"attempts", "The number of attempts when fetching a TLS k8s Secret.")
@@ -73,6 +82,16 @@ var (
 	loadConfigErrors    = mustInt64Counter(loadConfigPrefix+"errors", "The number of errors when loading the lekube config.")
 	loadConfigSuccesses = mustInt64Counter(loadConfigPrefix+"successes", "The number of successes when loading the lekube config.")
 
+	revokeCertPrefix    = "stages/revoke-cert/"
+	revokeCertAttempts  = mustInt64Counter(revokeCertPrefix+"attempts", "The number of attempts when revoking a certificate.")
+	revokeCertErrors    = mustInt64Counter(revokeCertPrefix+"errors", "The number of errors when revoking a certificate.")
+	revokeCertSuccesses = mustInt64Counter(revokeCertPrefix+"successes", "The number of successes when revoking a certificate.")
+
+	rolloverPrefix    = "stages/rollover-account-key/"
+	rolloverAttempts  = mustInt64Counter(rolloverPrefix+"attempts", "The number of attempts when rolling over the ACME account key.")
+	rolloverErrors    = mustInt64Counter(rolloverPrefix+"errors", "The number of errors when rolling over the ACME account key.")
+	rolloverSuccesses = mustInt64Counter(rolloverPrefix+"successes", "The number of successes when rolling over the ACME account key.")
+
 	runStartsCount   = mustInt64Counter("run-starts", "The number of top-level runs lekube has started.")
 	runFinishesCount = mustInt64Counter("run-finishes", "The number of top-level runs lekube has finished.")
 	errorCount       = mustInt64Counter("errors", "The number of top-level runs lekube has seen.")
@@ -80,11 +99,21 @@ var (
 	lastCheck, _  = mustInt64Gauge("last-config-check", "The unix epoch time that the configuration file was checked for changes.")
 	lastChange, _ = mustInt64Gauge("last-config-change", "The unix epoch time that the configuration file was reloaded because changes were found.")
 
+	rateLimitedSecrets, _ = mustInt64Gauge("rate-limited-secrets", "The number of secrets lekube is holding off on ordering certs for because the CA rate limited them.")
+
 	buildSHA = "<debug>"
 )
 
 func main() {
 	flag.Parse()
+	switch flag.Arg(0) {
+	case "revoke":
+		os.Exit(revokeCommand(flag.Args()[1:]))
+	case "reset-backoff":
+		os.Exit(resetBackoffCommand(flag.Args()[1:]))
+	case "account":
+		os.Exit(accountCommand(flag.Args()[1:]))
+	}
 	if *confPath == "" {
 		log.Printf("-conf flag is required")
 		flag.Usage()
@@ -154,19 +183,6 @@ func main() {
 		log.Fatalf("unable to load configuration: %s", err)
 	}
 
-	accountKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		log.Fatalf("unable to generate private account key (not a TLS private key) for the Let's Encrypt account: %s", err)
-	}
-	httpClient := &http.Client{
-		Timeout: 20 * time.Second,
-	}
-
-	responder, err := newLEResponser(&accountKey.PublicKey)
-	if err != nil {
-		log.Fatalf("unable to make responder: %s", err)
-	}
-
 	restConfig, err := restclient.InClusterConfig()
 	if err != nil {
 		log.Fatalf("unable to make config for kubernetes client: %s", err)
@@ -174,12 +190,13 @@ func main() {
 
 	kubeClient := k8s.NewForConfigOrDie(restConfig).CoreV1()
 
-	limit := rate.NewLimiter(rate.Limit(3), 3)
-	lcm := newLEClientMaker(httpClient, accountKey, responder, limit)
-
-	_, err = lcm.Make(bootTimeCtx, dirURLFromConf(conf), conf.Email)
+	httpClient, err := newACMEHTTPClient(*acmeRootsPath)
+	if err != nil {
+		log.Fatalf("unable to make HTTP client for the ACME API: %s", err)
+	}
+	lcm, responder, err := setUpACME(bootTimeCtx, conf, kubeClient, httpClient)
 	if err != nil {
-		log.Fatalf("unable to make an account with %s using email %s: %s", dirURLFromConf(conf), conf.Email, err)
+		log.Fatal(err)
 	}
 
 	m := http.NewServeMux()
@@ -196,6 +213,15 @@ func main() {
 		http.DefaultServeMux.ServeHTTP(w, r)
 	})
 
+	workMu := new(sync.Mutex)
+	m.Handle("/admin/", &adminServer{
+		cLoader:   cLoader,
+		lcm:       lcm,
+		client:    kubeClient,
+		leTimeout: *leTimeoutDur,
+		workMu:    workMu,
+	})
+
 	m.Handle("/", otelhttp.NewHandler(responder, "leresponder"))
 
 	watchCh := make(chan *allConf)
@@ -222,15 +248,32 @@ func main() {
 	}()
 	go func() {
 		for conf := range runCh {
+			workMu.Lock()
 			run(lcm, kubeClient, conf, *leTimeoutDur)
+			workMu.Unlock()
 		}
 	}()
 
 	if conf.TLSDir != "" {
+		crt := filepath.Join(conf.TLSDir, "tls.crt")
+		key := filepath.Join(conf.TLSDir, "tls.key")
+		cert, err := tls.LoadX509KeyPair(crt, key)
+		if err != nil {
+			log.Fatalf("unable to load HTTPS server cert from %s: %s", conf.TLSDir, err)
+		}
+		srv := &http.Server{
+			Addr:    *httpsAddr,
+			Handler: m,
+			TLSConfig: &tls.Config{
+				// The CA's tls-alpn-01 validation requests only offer
+				// acme-tls/1, and the responder hands them the challenge
+				// cert instead of the one from tls_dir.
+				NextProtos:     []string{"h2", "http/1.1", acme.ALPNProto},
+				GetCertificate: responder.GetCertificate(&cert),
+			},
+		}
 		go func() {
-			crt := filepath.Join(conf.TLSDir, "tls.crt")
-			key := filepath.Join(conf.TLSDir, "tls.key")
-			err := http.ListenAndServeTLS(*httpsAddr, crt, key, m)
+			err := srv.ListenAndServeTLS("", "")
 			if err != nil {
 				log.Fatalf("unable to boot HTTPS server: %s", err)
 			}
@@ -243,6 +286,55 @@ func main() {
 	}
 }
 
+// setUpACME loads the ACME account key from the account_secret, creating it if
+// need be, and registers it with the configured CA. It's split out of main so
+// that tests can run lekube against their own Kubernetes API and CA.
+func setUpACME(ctx context.Context, conf *allConf, kubeClient corev1.CoreV1Interface, httpClient *http.Client) (*leClientMaker, *leResponder, error) {
+	acctStore := newAccountStore(kubeClient.Secrets(conf.AccountSecret.Namespace), conf.AccountSecret.Name)
+	acct, err := acctStore.LoadOrCreate(ctx, httpClient)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to load the ACME account key from secret %s: %s", conf.AccountSecret.FullName(), err)
+	}
+
+	responder := newLEResponser()
+
+	limit := rate.NewLimiter(rate.Limit(3), 3)
+	lcm := newLEClientMaker(httpClient, acct, acctStore, kubeClient, responder, limit)
+
+	_, err = lcm.Make(ctx, acmeCA{DirectoryURL: dirURLFromConf(conf), Emails: conf.Emails, EAB: conf.EAB})
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to make an account with %s using emails %s: %s", dirURLFromConf(conf), conf.Emails, err)
+	}
+	return lcm, responder, nil
+}
+
+// newACMEHTTPClient returns the HTTP client lekube talks to ACME CAs with. The
+// certs in the PEM file at rootsPath, if it's set, are trusted along with the
+// system's roots so that test CAs like Pebble can be used.
+func newACMEHTTPClient(rootsPath string) (*http.Client, error) {
+	c := &http.Client{
+		Timeout: 20 * time.Second,
+	}
+	if rootsPath == "" {
+		return c, nil
+	}
+	b, err := os.ReadFile(rootsPath)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no PEM encoded certificates found in %s", rootsPath)
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = &tls.Config{RootCAs: roots}
+	c.Transport = t
+	return c, nil
+}
+
 func mustInt64Counter(name, description string) metric.Int64Counter {
 	c, err := meter.Int64Counter(name, metric.WithDescription(description))
 	if err != nil {
@@ -264,92 +356,276 @@ func mustInt64Gauge(name, description string) (*atomic.Int64, metric.Int64Observ
 }
 
 func run(lcm *leClientMaker, client corev1.CoreV1Interface, conf *allConf, leTimeout time.Duration) {
-	ctx, cancel := context.WithTimeout(context.Background(), leTimeout+20*time.Second)
-	defer cancel()
-	ctx, span := tracer.Start(ctx, "lekube/run")
+	ctx, span := tracer.Start(context.Background(), "lekube/run")
 	defer span.End()
 	runStartsCount.Add(ctx, 1)
 	defer runFinishesCount.Add(ctx, 1)
 
-	lcm.responder.Reset()
-	tlsSecs := make(map[nsSecName]*tlsSecret)
-	okaySecs := []*secretConf{}
+	// Each secret gets its own deadline below, and the work before them
+	// gets one of its own.
+	setupCtx, cancel := context.WithTimeout(ctx, leTimeout+20*time.Second)
+	defer cancel()
+	lcm.StartRun()
+	if conf.AccountKeyMaxAge != 0 && time.Since(lcm.accountKeyCreatedAt) > conf.AccountKeyMaxAge {
+		log.Printf("ACME account key is older than account_key_max_age of %s, rolling it over", conf.AccountKeyMaxAge)
+		// Errors are recorded in RolloverAccountKey, and the old key is
+		// still usable if it failed.
+		lcm.RolloverAccountKey(setupCtx, dirURLFromConf(conf))
+	}
+
+	var dns01 *dns01Solver
+	if conf.DNS01 != nil {
+		var err error
+		dns01, err = newDNS01Solver(setupCtx, client, conf.DNS01)
+		if err != nil {
+			// Secrets using http-01 challenges can still be worked on, and the
+			// dns-01 ones will error out in CreateCert.
+			recordErrorMetric(ctx, fetchSecStage, "unable to set up the dns01 provider: %s", err)
+		}
+	}
 
-	fetchCtx, fetchSpan := tracer.Start(ctx, "fetch-secrets")
-	fetchAttempts := 0
-	fetchErrors := 0
-	fetchSuccesses := 0
+	rc := &runClients{lcm: lcm, clients: make(map[string]*runClient)}
+	// sem bounds how many secrets are fetched and worked on at once. They
+	// all share lcm's rate limiter and responder.
+	sem := make(chan struct{}, conf.Concurrency)
+	var wg sync.WaitGroup
 	for _, secConf := range conf.Secrets {
-		secCtx, secSpan := tracer.Start(fetchCtx, "fetch-secret")
-		log.Printf("Fetching kubernetes secret %s", secConf.FullName())
-		fetchSecretAttempts.Add(secCtx, 1)
-		secSpan.SetAttributes(attribute.String("secret.name", secConf.Name), attribute.String("secret.namespace", secConf.Namespace))
-		tlsSec, err := fetchK8SSecret(secCtx, client.Secrets(secConf.Namespace), secConf.Name)
+		sem <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-sem }()
+			// One slow secret shouldn't use up the time of the others.
+			secCtx, cancel := context.WithTimeout(ctx, leTimeout+20*time.Second)
+			defer cancel()
+			checkSecret(secCtx, secConf, lcm, rc, client, conf, dns01, leTimeout)
+		})
+	}
+	wg.Wait()
+}
+
+// runClients are the ACME clients a run uses to ask CAs for ARI renewal info
+// and to revoke certs listed in revoke_serials. If one can't be made, certs can
+// still be renewed based on start_renew_duration, so they're kept by account
+// name, with nil for the ones that couldn't be made, and each account is only
+// made once per run.
+type runClients struct {
+	lcm     *leClientMaker
+	mu      sync.Mutex
+	clients map[string]*runClient
+}
+
+// runClient is an account's client in a run. It's made at most once, without
+// holding runClients.mu, so that the secrets using other CAs don't wait on a
+// slow one.
+type runClient struct {
+	once sync.Once
+	lc   *leClient
+}
+
+// Get returns the client for the CA or nil if it couldn't be made.
+func (rc *runClients) Get(ctx context.Context, ca acmeCA) *leClient {
+	rc.mu.Lock()
+	c, ok := rc.clients[ca.account()]
+	if !ok {
+		c = &runClient{}
+		rc.clients[ca.account()] = c
+	}
+	rc.mu.Unlock()
+	c.once.Do(func() {
+		var err error
+		c.lc, err = rc.lcm.Make(ctx, ca)
 		if err != nil {
-			secSpan.SetStatus(codes.Error, err.Error())
-			recordErrorMetric(secCtx, fetchSecStage, "unable to fetch TLS secret value %#v: %s", secConf.Name, err)
-			continue
+			log.Printf("unable to get client for ACME API at %s to check renewal info and revoke certs: %s", ca.DirectoryURL, err)
 		}
-		secSpan.SetStatus(codes.Ok, "")
-		fetchSecretSuccesses.Add(secCtx, 1)
-		log.Printf("Fetched kubernetes secret %s", secConf.FullName())
+	})
+	return c.lc
+}
 
-		tlsSecs[secConf.FullName()] = tlsSec
-		okaySecs = append(okaySecs, secConf)
+// checkSecret fetches the secret and orders and stores new certs for the slots
+// of it that need them.
+func checkSecret(ctx context.Context, secConf *secretConf, lcm *leClientMaker, rc *runClients, client corev1.CoreV1Interface, conf *allConf, dns01 *dns01Solver, leTimeout time.Duration) {
+	span := trace.SpanFromContext(ctx)
+	fetchCtx, fetchSpan := tracer.Start(ctx, "fetch-secret")
+	log.Printf("Fetching kubernetes secret %s", secConf.FullName())
+	fetchSecretAttempts.Add(fetchCtx, 1)
+	fetchSpan.SetAttributes(attribute.String("secret.name", secConf.Name), attribute.String("secret.namespace", secConf.Namespace))
+	tlsSec, err := fetchK8SSecret(fetchCtx, client.Secrets(secConf.Namespace), secConf)
+	if err != nil {
+		fetchSpan.SetStatus(codes.Error, err.Error())
+		fetchSpan.End()
+		recordErrorMetric(fetchCtx, fetchSecStage, "unable to fetch TLS secret value %#v: %s", secConf.Name, err)
+		return
 	}
-	fetchSpan.SetAttributes(attribute.Int("given", len(conf.Secrets)), attribute.Int("attempts", fetchAttempts), attribute.Int("errors", fetchErrors), attribute.Int("successes", fetchSuccesses))
+	fetchSpan.SetStatus(codes.Ok, "")
 	fetchSpan.End()
+	fetchSecretSuccesses.Add(fetchCtx, 1)
+	log.Printf("Fetched kubernetes secret %s", secConf.FullName())
+
+	if tlsSec != nil {
+		if until := rateLimitedUntilFromSecret(tlsSec.Secret); until.After(time.Now()) {
+			lcm.backoff.Add(secConf, until)
+		}
+		lcm.failures.Load(secConf.FullName(), tlsSec.Secret)
+	}
+
+	log.Printf("checking on %s", secConf.FullName())
+	cas := conf.casFor(secConf)
+	// Each cert in a dual_key secret is checked and replaced on its own,
+	// and the Secret stored with one new cert is the one the next is
+	// stored into.
+	for _, slot := range secConf.certSlots() {
+		// Renewal info and revocations are asked of the CA that issued the
+		// cert.
+		acmeClient := rc.Get(ctx, issuerCA(cas, tlsSec, slot))
+		if !needsNewCert(ctx, acmeClient, tlsSec, secConf, slot, time.Duration(conf.StartRenewDur)) {
+			log.Printf("no work needed for %s in secret %s", slot.CertDataKey, secConf.FullName())
+			continue
+		}
+		tryCAs := cas[:1]
+		var cert *x509.Certificate
+		if tlsSec != nil {
+			cert = tlsSec.slotCert(slot)
+		}
+		if len(cas) > 1 && fallbackDue(conf, lcm.failures.Count(secConf.FullName()), cert) {
+			tryCAs = cas
+		}
+		if until, reason, ok := lcm.backoff.Until(secConf); ok {
+			if len(tryCAs) == 1 {
+				log.Printf("not ordering a new cert for %s in secret %s until %s because the CA rate limited %s", slot.CertDataKey, secConf.FullName(), until.Format(time.RFC3339), reason)
+				span.AddEvent("rate-limited", trace.WithAttributes(attribute.String("secret.name", secConf.Name), attribute.String("secret.namespace", secConf.Namespace), attribute.String("rate_limited.until", until.Format(time.RFC3339)), attribute.String("rate_limited.reason", reason)))
+				continue
+			}
+			log.Printf("only ordering a new cert for %s in secret %s from the fallback CAs until %s because the CA rate limited %s", slot.CertDataKey, secConf.FullName(), until.Format(time.RFC3339), reason)
+			tryCAs = tryCAs[1:]
+		}
+		if f, ok := lcm.failures.Until(secConf.FullName()); ok {
+			log.Printf("skipping %s in secret %s until %s after failing %d time(s) in a row, last error: %s", slot.CertDataKey, secConf.FullName(), f.NextAttempt.Format(time.RFC3339), f.Count, f.LastError)
+			span.AddEvent("failure-backoff", trace.WithAttributes(attribute.String("secret.name", secConf.Name), attribute.String("secret.namespace", secConf.Namespace), attribute.Int("failures", f.Count), attribute.String("next_attempt", f.NextAttempt.Format(time.RFC3339))))
+			continue
+		}
+		// Certs in revoke_serials are only revoked once they're about to be
+		// replaced, and the revocation is recorded so that later runs
+		// replace them if this one can't. The serial stays in the config
+		// after the cert is replaced, so the cert isn't replaced until it's
+		// been revoked.
+		if cert != nil && secConf.shouldRevoke(cert) && !wasRevoked(tlsSec, slot, cert) {
+			if acmeClient == nil {
+				log.Printf("not replacing cert with serial %x in secret %s until it can be revoked", cert.SerialNumber, secConf.FullName())
+				continue
+			}
+			err := revokeCert(ctx, acmeClient, secConf, cert, tlsSec.Data[slot.KeyDataKey], secConf.revokeReason(), false)
+			if err != nil {
+				continue
+			}
+			tlsSec = recordRevocation(ctx, client.Secrets(secConf.Namespace), secConf, tlsSec, slot, cert)
+		}
+		log.Printf("working on %s in secret %s", slot.CertDataKey, secConf.FullName())
+		// Errors are recorded in workOn.
+		tlsSec, err = workOn(ctx, tlsSec, secConf, slot, tryCAs, lcm, client, conf, dns01, leTimeout)
+		if err != nil {
+			// The Secret may have changed under tlsSec, but the backoff
+			// keeps the secret's other slots from being stored with it.
+			if err := recordFailure(ctx, lcm, client.Secrets(secConf.Namespace), secConf, tlsSec, err); err != nil {
+				log.Printf("unable to record failure backoff on secret %s: %s", secConf.FullName(), err)
+			}
+			continue
+		}
+		lcm.failures.Reset(secConf.FullName())
+	}
+}
+
+// needsNewCert returns true if the cert in the slot of the secret is missing
+// or should be replaced. Certs in the secret's revoke_serials are revoked by
+// checkSecret right before they're replaced.
+func needsNewCert(ctx context.Context, lc *leClient, tlsSec *tlsSecret, secConf *secretConf, slot certSlot, startRenewDur time.Duration) bool {
+	if tlsSec == nil {
+		log.Printf("no such secret %s", secConf.FullName())
+		return true
+	}
+	cert := tlsSec.slotCert(slot)
+	if cert == nil {
+		log.Printf("no %s in secret %s", slot.CertDataKey, secConf.FullName())
+		return true
+	}
+	if wasRevoked(tlsSec, slot, cert) {
+		log.Printf("cert with serial %x in %s in secret %s was revoked", cert.SerialNumber, slot.CertDataKey, secConf.FullName())
+		return true
+	}
+	if secConf.shouldRevoke(cert) {
+		log.Printf("cert with serial %x in %s in secret %s is in revoke_serials", cert.SerialNumber, slot.CertDataKey, secConf.FullName())
+		return true
+	}
+	if closeToExpiration(cert, startRenewDur) {
+		log.Printf("cert close to expiration in %s in secret %s, NotAfter: %s; Now: %s StartRenewDur: %s", slot.CertDataKey, secConf.FullName(), cert.NotAfter, time.Now(), startRenewDur)
+		return true
+	}
+	if ariSaysRenew(ctx, lc, cert, secConf) {
+		return true
+	}
+	if domainMismatch(cert, secConf.Domains, secConf.IPAddresses) {
+		log.Printf("domain mismatch between cert in %s and secret %s", slot.CertDataKey, secConf.FullName())
+		return true
+	}
+	if certKeyType(cert) != slot.KeyType {
+		log.Printf("Requested key type %#v doesn't match type %#v of cert in %s in secret %s", slot.KeyType, certKeyType(cert), slot.CertDataKey, secConf.FullName())
+		return true
+	}
+	if secConf.ReuseKey && keyTooOld(secConf, keyCreatedAt(tlsSec.Secret, slot)) {
+		log.Printf("private key in %s in secret %s is older than max_key_age of %s", slot.KeyDataKey, secConf.FullName(), time.Duration(secConf.MaxKeyAge))
+		return true
+	}
+	return false
+}
 
-	for _, secConf := range okaySecs {
-		log.Printf("checking on %s", secConf.FullName())
-		tlsSec := tlsSecs[secConf.FullName()]
-		refreshCert := false
-		if tlsSec == nil {
-			log.Printf("no such secret %s", secConf.FullName())
-			refreshCert = true
-		} else if tlsSec.Cert == nil {
-			log.Printf("no tls.crt in secret %s", secConf.FullName())
-			refreshCert = true
-		} else if closeToExpiration(tlsSec.Cert, time.Duration(conf.StartRenewDur)) {
-			log.Printf("cert close to expiration in secret %s, NotAfter: %s; Now: %s StartRenewDur: %s", secConf.FullName(), tlsSec.Cert.NotAfter, time.Now(), time.Duration(conf.StartRenewDur))
-			refreshCert = true
-		} else if domainMismatch(tlsSec.Cert, secConf.Domains) {
-			log.Printf("domain mismatch between cert and secret %s", secConf.FullName())
-			refreshCert = true
-		} else if certPublicKeyAlgoDoesntMatch(tlsSec.Cert, secConf) {
-			log.Printf("Requested key type (UseRSA: %t) doesn't match type of cert in secret %s", secConf.UseRSA, secConf.FullName())
-			refreshCert = true
-		}
-
-		if refreshCert {
-			log.Printf("working on %s", secConf.FullName())
-			workOn(ctx, tlsSec, secConf, lcm, client, conf, leTimeout)
-		} else {
-			log.Printf("no work needed for secret %s", secConf.FullName())
-		}
-	}
-}
-
-func workOn(ctx context.Context, tlsSec *tlsSecret, secConf *secretConf, lcm *leClientMaker, client corev1.CoreV1Interface, conf *allConf, leTimeout time.Duration) {
+// workOn orders a new cert for the slot of the secret from the first of the
+// CAs that will issue it and stores it, returning the secret as stored. The
+// error returned is the last CA's, and is returned along with tlsSec as
+// workOn last updated it.
+func workOn(ctx context.Context, tlsSec *tlsSecret, secConf *secretConf, slot certSlot, cas []acmeCA, lcm *leClientMaker, client corev1.CoreV1Interface, conf *allConf, dns01 *dns01Solver, leTimeout time.Duration) (*tlsSecret, error) {
 	fetchCtx, fetchSpan := tracer.Start(ctx, "fetch-certs")
 	defer fetchSpan.End()
-	fetchSpan.SetAttributes(attribute.String("secret.name", secConf.Name), attribute.String("secret.namespace", secConf.Namespace))
+	fetchSpan.SetAttributes(attribute.String("secret.name", secConf.Name), attribute.String("secret.namespace", secConf.Namespace), attribute.String("secret.cert_data_key", slot.CertDataKey))
 	fetchLECertAttempts.Add(fetchCtx, 1)
 
-	acmeClient, err := lcm.Make(fetchCtx, dirURLFromConf(conf), conf.Email)
-	if err != nil {
-		fetchSpan.SetStatus(codes.Error, fmt.Sprintf("unable to get client for Let's Encrypt API that is up to date: %s", err))
-		recordErrorMetric(fetchCtx, fetchLECertStage, "unable to get client for Let's Encrypt API that is up to date: %s", err)
-		return
+	key, keyCreated := reusableKey(tlsSec, secConf, slot)
+	if key == nil {
+		keyCreated = time.Now()
+	} else {
+		log.Printf("reusing private key in %s in secret %s", slot.KeyDataKey, secConf.FullName())
+	}
+	fetchSpan.SetAttributes(attribute.Bool("key.reused", key != nil))
+	var leCert *newCert
+	var err error
+	for i, ca := range cas {
+		if i != 0 {
+			log.Printf("falling back to the CA at %s for %s in secret %s", ca.DirectoryURL, slot.CertDataKey, secConf.FullName())
+		}
+		leCert, err = orderCert(fetchCtx, tlsSec, secConf, slot, ca, key, lcm, conf, dns01)
+		if err == nil {
+			break
+		}
+		// Rate limits at a fallback CA don't keep the secret's usual CA
+		// from being ordered from.
+		if until, ok := rateLimitedUntil(err); ok && !ca.Fallback {
+			log.Printf("CA rate limited secret %s, not ordering certs for it or its registered domains until %s", secConf.FullName(), until.Format(time.RFC3339))
+			fetchSpan.SetAttributes(attribute.String("rate_limited.until", until.Format(time.RFC3339)))
+			lcm.backoff.Add(secConf, until)
+			// The annotated Secret is kept so that a cert from a
+			// fallback CA is stored on top of it.
+			var perr error
+			tlsSec, perr = persistRateLimit(fetchCtx, client.Secrets(secConf.Namespace), secConf, tlsSec, until)
+			if perr != nil {
+				log.Printf("unable to record rate limit backoff on secret %s: %s", secConf.FullName(), perr)
+			}
+		}
 	}
-	leCert, err := acmeClient.CreateCert(fetchCtx, secConf)
 	if err != nil {
 		fetchSpan.SetStatus(codes.Error, fmt.Sprintf("unable to get Let's Encrypt certificate: %s", err))
-		recordErrorMetric(fetchCtx, fetchLECertStage, "unable to get Let's Encrypt certificate for %s: %s", secConf.FullName(), err)
-		return
+		return tlsSec, err
 	}
+	fetchSpan.SetAttributes(attribute.String("acme.directory_url", leCert.DirectoryURL))
+	leCert.KeyCreatedAt = keyCreated
 	fetchLECertSuccesses.Add(fetchCtx, 1)
-	log.Printf("have new cert for %s", secConf.FullName())
+	log.Printf("have new cert for %s from the CA at %s", secConf.FullName(), leCert.DirectoryURL)
 	var oldSec *kubeapi.Secret
 	if tlsSec != nil {
 		oldSec = tlsSec.Secret
@@ -360,20 +636,51 @@ func workOn(ctx context.Context, tlsSec *tlsSecret, secConf *secretConf, lcm *le
 	defer storeSpan.End()
 	storeSpan.SetAttributes(attribute.String("secret.name", secConf.Name), attribute.String("secret.namespace", secConf.Namespace))
 	storeSecretAttempts.Add(storeCtx, 1)
-	err = storeK8SSecret(ctx, client.Secrets(secConf.Namespace), secConf, oldSec, leCert)
+	sec, err := storeK8SSecret(ctx, client.Secrets(secConf.Namespace), secConf, slot, oldSec, leCert)
 	if err != nil {
 		storeSpan.SetStatus(codes.Error, err.Error())
 		recordErrorMetric(ctx, storeSecStage, "unable to store the TLS cert and key as secret %#v: %s", secConf.Name, err)
-		return
+		return tlsSec, err
 	}
 	storeSpan.SetStatus(codes.Ok, "")
 	storeSecretSuccesses.Add(storeCtx, 1)
-	log.Printf("successfully stored new cert in %s", secConf.FullName())
+	log.Printf("successfully stored new cert in %s in secret %s", slot.CertDataKey, secConf.FullName())
+	return newTLSSecret(sec), nil
+}
+
+// orderCert orders a new cert for the slot of the secret from the CA with the
+// given key, or a new one if key is nil.
+func orderCert(ctx context.Context, tlsSec *tlsSecret, secConf *secretConf, slot certSlot, ca acmeCA, key crypto.Signer, lcm *leClientMaker, conf *allConf, dns01 *dns01Solver) (*newCert, error) {
+	acmeClient, err := lcm.Make(ctx, ca)
+	if err != nil {
+		recordErrorMetric(ctx, fetchLECertStage, "unable to get client for ACME API at %s that is up to date: %s", ca.DirectoryURL, err)
+		return nil, err
+	}
+	if ca.Fallback {
+		fetchLECertFallbacks.Add(ctx, 1)
+	}
+	replaces := ""
+	// ARI only lets a cert be replaced by an order at the CA that issued it.
+	if tlsSec != nil && acmeClient.dirExtras.RenewalInfo != "" && issuedBy(tlsSec, slot, ca) {
+		if oldCert := tlsSec.slotCert(slot); oldCert != nil {
+			replaces, err = ariCertID(oldCert)
+			if err != nil {
+				log.Printf("unable to mark new order as replacing the cert in %s: %s", secConf.FullName(), err)
+			}
+		}
+	}
+	leCert, err := acmeClient.CreateCert(ctx, secConf, slot.KeyType, dns01, newHTTP01SelfChecker(conf.HTTP01SelfCheckTimeout), replaces, key)
+	if err != nil {
+		recordErrorMetric(ctx, fetchLECertStage, "unable to get certificate for %s from the CA at %s: %s", secConf.FullName(), ca.DirectoryURL, err)
+		return nil, err
+	}
+	leCert.DirectoryURL = ca.DirectoryURL
+	return leCert, nil
 }
 
 // fetchK8SSecret may return a nil tlsSecret if no secret was found.
-func fetchK8SSecret(ctx context.Context, client corev1.SecretInterface, secretName string) (*tlsSecret, error) {
-	sec, err := client.Get(ctx, secretName, metav1.GetOptions{})
+func fetchK8SSecret(ctx context.Context, client corev1.SecretInterface, secConf *secretConf) (*tlsSecret, error) {
+	sec, err := client.Get(ctx, secConf.Name, metav1.GetOptions{})
 	if err != nil {
 		if kerrors.IsNotFound(err) {
 			return nil, nil
@@ -382,40 +689,78 @@ func fetchK8SSecret(ctx context.Context, client corev1.SecretInterface, secretNa
 	}
 	// If there's no cert data already in the Secret, we'll assume the user knew
 	// what they were doing and multiple bits of private data inside the same
-	// Secret and so return nil.
-	b, ok := sec.Data["tls.crt"]
-	if !ok {
-		return nil, nil
+	// Secret and so return nil. A Secret lekube has stored only some of the
+	// slots of a dual_key secret in, or has only annotated, is one it's
+	// already working on.
+	for _, slot := range secConf.certSlots() {
+		if _, ok := sec.Data[slot.CertDataKey]; ok {
+			return newTLSSecret(sec), nil
+		}
+	}
+	for k := range sec.Annotations {
+		if strings.HasPrefix(k, lekubeAnnotationPrefix) {
+			return newTLSSecret(sec), nil
+		}
 	}
+	return nil, nil
+}
+
+func newTLSSecret(sec *kubeapi.Secret) *tlsSecret {
+	return &tlsSecret{Secret: sec, Cert: leafCert(sec.Data["tls.crt"])}
+}
+
+// leafCert returns the leaf cert in the PEM encoded cert chain, or nil if there
+// isn't one or it can't be parsed. We don't actually need it to do our work.
+func leafCert(b []byte) *x509.Certificate {
 	block, _ := pem.Decode(b)
 	if block == nil {
-		// tls.crt isn't valid PEM, but we don't actually need it to do our
-		// work.
-		return &tlsSecret{Secret: sec}, nil
+		return nil
 	}
 	certs, err := x509.ParseCertificates(block.Bytes)
 	if err != nil {
-		// unable to parse certificates already in the Secret, but we don't
-		// actually need it to do our work.
-		return &tlsSecret{Secret: sec}, nil
+		return nil
 	}
-
-	tlsSec := &tlsSecret{Secret: sec}
 	// Find the leaf cert. The order people store the certs is not always the
 	// correct order, especially if they were doing things manually for a
 	// while. If all of the certs are CA certs, we let ourselves overwrite
-	// tls.crt in the secret.
+	// the cert in the secret.
 	for _, c := range certs {
 		if !c.IsCA {
-			tlsSec.Cert = c
-			break
+			return c
+		}
+	}
+	return nil
+}
+
+// newDNS01Solver builds the dns01Solver described by the config, fetching the
+// TSIG key it needs from its Secret.
+func newDNS01Solver(ctx context.Context, client corev1.CoreV1Interface, conf *dns01Conf) (*dns01Solver, error) {
+	tsigSecret := ""
+	if conf.RFC2136.TSIGSecret != nil {
+		b, err := fetchK8SSecretValue(ctx, client, conf.RFC2136.TSIGSecret)
+		if err != nil {
+			return nil, fmt.Errorf("unable to fetch TSIG secret for rfc2136: %s", err)
 		}
+		tsigSecret = strings.TrimSpace(string(b))
 	}
+	return newDNS01SolverFromConf(conf, tsigSecret), nil
+}
 
-	return tlsSec, nil
+// fetchK8SSecretValue returns the value of a single key in a Secret, erroring
+// if the Secret or the key is missing.
+func fetchK8SSecretValue(ctx context.Context, client corev1.CoreV1Interface, ref *secretKeyRef) ([]byte, error) {
+	sec, err := client.Secrets(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	b, ok := sec.Data[ref.Key]
+	if !ok {
+		return nil, fmt.Errorf("no key %#v in secret %s", ref.Key, nsSecName{ref.Namespace, ref.Name})
+	}
+	return b, nil
 }
 
-func storeK8SSecret(ctx context.Context, cl corev1.SecretInterface, secConf *secretConf, oldSec *kubeapi.Secret, leCert *newCert) error {
+func storeK8SSecret(ctx context.Context, cl corev1.SecretInterface, secConf *secretConf, slot certSlot, oldSec *kubeapi.Secret, leCert *newCert) (*kubeapi.Secret, error) {
 	if oldSec == nil {
 		sec := &kubeapi.Secret{
 			ObjectMeta: metav1.ObjectMeta{
@@ -423,34 +768,80 @@ func storeK8SSecret(ctx context.Context, cl corev1.SecretInterface, secConf *sec
 			},
 			Data: make(map[string][]byte),
 		}
-		sec.Data["tls.crt"] = leCert.Cert
-		sec.Data["tls.key"] = leCert.Key
+		sec.Data[slot.CertDataKey] = leCert.Cert
+		sec.Data[slot.KeyDataKey] = leCert.Key
+		setKeyCreatedAt(sec, slot, leCert.KeyCreatedAt)
+		setIssuerDirectory(sec, slot, leCert.DirectoryURL)
 
 		storeSecretCreates.Add(ctx, 1)
-		_, err := cl.Create(ctx, sec, metav1.CreateOptions{})
-		return err
+		return cl.Create(ctx, sec, metav1.CreateOptions{})
 	}
 
 	sec := oldSec.DeepCopy()
-	sec.Data["tls.crt"] = leCert.Cert
-	sec.Data["tls.key"] = leCert.Key
+	if sec.Data == nil {
+		sec.Data = make(map[string][]byte)
+	}
+	sec.Data[slot.CertDataKey] = leCert.Cert
+	sec.Data[slot.KeyDataKey] = leCert.Key
+	setKeyCreatedAt(sec, slot, leCert.KeyCreatedAt)
+	setIssuerDirectory(sec, slot, leCert.DirectoryURL)
+	delete(sec.Annotations, slot.revokedSerialAnnotation())
+	delete(sec.Annotations, rateLimitedUntilAnnotation)
+	for _, a := range failureBackoffAnnotations {
+		delete(sec.Annotations, a)
+	}
 
 	storeSecretUpdates.Add(ctx, 1)
-	_, err := cl.Update(ctx, sec, metav1.UpdateOptions{})
-
-	return err
+	return cl.Update(ctx, sec, metav1.UpdateOptions{})
 }
 
 type newCert struct {
 	Cert []byte // PEM encoded bytes of the TLS cert and the cert chain needed to resolve it correctly.
 	Key  []byte // PEM encoded bytes of the TLS private key generated
+
+	KeyCreatedAt time.Time // when Key was generated, or the zero time if unknown
+	DirectoryURL string    // the ACME directory of the CA that issued Cert, or empty if unknown
+}
+
+// lekubeAnnotationPrefix starts the names of all of the annotations lekube
+// records its state in on the Secrets it manages.
+const lekubeAnnotationPrefix = "lekube.jmhodges.com/"
+
+// keyCreatedAtAnnotation records when the private key in a Secret was
+// generated so that max_key_age can be enforced while reuse_key is set.
+const keyCreatedAtAnnotation = "lekube.jmhodges.com/key-created-at"
+
+// keyCreatedAtAnnotation returns the annotation that records when the slot's
+// private key was generated. The dual_key slot's is suffixed with its data key.
+func (slot certSlot) keyCreatedAtAnnotation() string {
+	if slot.KeyDataKey == "tls.key" {
+		return keyCreatedAtAnnotation
+	}
+	return keyCreatedAtAnnotation + "." + slot.KeyDataKey
+}
+
+func setKeyCreatedAt(sec *kubeapi.Secret, slot certSlot, t time.Time) {
+	if t.IsZero() {
+		delete(sec.Annotations, slot.keyCreatedAtAnnotation())
+		return
+	}
+	if sec.Annotations == nil {
+		sec.Annotations = make(map[string]string)
+	}
+	sec.Annotations[slot.keyCreatedAtAnnotation()] = t.UTC().Format(time.RFC3339)
 }
 
 type tlsSecret struct {
-	Cert *x509.Certificate
+	Cert *x509.Certificate // the leaf cert in tls.crt
 	*kubeapi.Secret
 }
 
+// slotCert returns the leaf cert stored in the slot, or nil if there isn't one
+// that can be parsed.
+func (ts *tlsSecret) slotCert(slot certSlot) *x509.Certificate {
+	return leafCert(ts.Data[slot.CertDataKey])
+}
+
 type stage int
 
 const (
@@ -458,6 +849,8 @@ const (
 	fetchLECertStage
 	storeSecStage
 	loadConfigStage
+	revokeCertStage
+	rolloverStage
 )
 
 var stageErrors = map[stage]metric.Int64Counter{
@@ -465,6 +858,8 @@ var stageErrors = map[stage]metric.Int64Counter{
 	fetchLECertStage: fetchLECertErrors,
 	storeSecStage:    storeSecretErrors,
 	loadConfigStage:  loadConfigErrors,
+	revokeCertStage:  revokeCertErrors,
+	rolloverStage:    rolloverErrors,
 }
 
 func recordErrorMetric(ctx context.Context, st stage, format string, args ...interface{}) {
@@ -473,28 +868,80 @@ func recordErrorMetric(ctx context.Context, st stage, format string, args ...int
 	log.Printf(format, args...)
 }
 
+// ariSaysRenew returns true if the CA's ARI renewal info for the cert says it's
+// time to renew it. It returns false if the CA doesn't support ARI or the
+// renewal info couldn't be fetched, leaving closeToExpiration to decide.
+func ariSaysRenew(ctx context.Context, lc *leClient, cert *x509.Certificate, secConf *secretConf) bool {
+	if lc == nil {
+		return false
+	}
+	sched, err := lc.RenewalSchedule(ctx, cert)
+	if err != nil {
+		log.Printf("unable to fetch ARI renewal info for cert in secret %s: %s", secConf.FullName(), err)
+		return false
+	}
+	if sched == nil || time.Now().Before(sched.renewAt) {
+		return false
+	}
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent("ari-renewal", trace.WithAttributes(
+		attribute.String("secret.name", secConf.Name),
+		attribute.String("secret.namespace", secConf.Namespace),
+		attribute.String("ari.window_start", sched.windowStart.String()),
+		attribute.String("ari.window_end", sched.windowEnd.String()),
+		attribute.String("ari.explanation_url", sched.explanationURL),
+	))
+	log.Printf("CA's renewal info says to renew cert in secret %s: suggested window %s to %s, picked %s, explanation URL %#v", secConf.FullName(), sched.windowStart, sched.windowEnd, sched.renewAt, sched.explanationURL)
+	return true
+}
+
 func closeToExpiration(cert *x509.Certificate, startRenewDur time.Duration) bool {
 	t := time.Now().Add(startRenewDur)
 	return t.Equal(cert.NotAfter) || t.After(cert.NotAfter)
 }
 
-func domainMismatch(cert *x509.Certificate, domains []string) bool {
+func domainMismatch(cert *x509.Certificate, domains, ips []string) bool {
 	// Since the CommonName can also be in the SAN, let's unique the domains by
 	// using maps instead of sorting some slices.
 	cdoms := make(map[string]struct{})
 	doms := make(map[string]struct{})
-	cdoms[cert.Subject.CommonName] = struct{}{}
+	// Some CAs leave the CommonName out entirely.
+	if cert.Subject.CommonName != "" {
+		cdoms[normalizeDomain(cert.Subject.CommonName)] = struct{}{}
+	}
 	for _, d := range cert.DNSNames {
-		cdoms[d] = struct{}{}
+		cdoms[normalizeDomain(d)] = struct{}{}
 	}
 	for _, d := range domains {
-		doms[d] = struct{}{}
+		doms[normalizeDomain(d)] = struct{}{}
+	}
+	// IPs are compared in their canonical forms. The config's have already
+	// been put into it by validateConf.
+	for _, ip := range cert.IPAddresses {
+		if addr, ok := netip.AddrFromSlice(ip); ok {
+			cdoms[addr.Unmap().String()] = struct{}{}
+		}
+	}
+	for _, ip := range ips {
+		doms[ip] = struct{}{}
 	}
 	return !maps.Equal(cdoms, doms)
 }
 
+// normalizeDomain lowercases the domain and removes any trailing dot so that a
+// wildcard like "*.Example.com." in the config matches the "*.example.com" SAN
+// the CA put in the cert. Wildcard SANs are otherwise compared as the literal
+// strings they are and not matched against the names they cover, since the
+// config asking for "www.example.com" and a cert containing only
+// "*.example.com" is a change the user wants reflected in a new cert.
+func normalizeDomain(d string) string {
+	return strings.ToLower(strings.TrimSuffix(d, "."))
+}
+
+// isBlockedRequest returns true if the request is for the /debug/ or /admin/
+// endpoints and didn't come from the loopback interface.
 func isBlockedRequest(r *http.Request) bool {
-	if r.URL.Path == "/debug" || strings.HasPrefix(r.URL.Path, "/debug/") {
+	if r.URL.Path == "/debug" || strings.HasPrefix(r.URL.Path, "/debug/") || r.URL.Path == "/admin" || strings.HasPrefix(r.URL.Path, "/admin/") {
 		i := strings.Index(r.RemoteAddr, ":")
 		if i < 0 {
 			return false
@@ -504,14 +951,85 @@ func isBlockedRequest(r *http.Request) bool {
 	return false
 }
 
-// certPublicKeyAlgoDoesntMatch returns true if the type of key (RSA or ECDSA) used to
-// generate the existing certificate differs from the type requested.
-func certPublicKeyAlgoDoesntMatch(cert *x509.Certificate, secConf *secretConf) bool {
-	// If you adjust this UseRSA code, be sure to also adjust the use of UseRSA
-	// in the Let's Encrypt code.
-	if secConf.UseRSA {
-		return cert.PublicKeyAlgorithm != x509.RSA
-	} else {
-		return cert.PublicKeyAlgorithm != x509.ECDSA
+// certKeyType returns the key_type of the cert's public key, or the empty
+// string if it's a type of key lekube doesn't generate. Comparing curves and
+// modulus sizes and not just the algorithm means changing key_type from
+// "rsa-2048" to "rsa-4096" gets a new cert.
+func certKeyType(cert *x509.Certificate) string {
+	return publicKeyType(cert.PublicKey)
+}
+
+func publicKeyType(pub crypto.PublicKey) string {
+	// If you adjust this code, be sure to also adjust generateCertKey in the
+	// Let's Encrypt code.
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		switch k.N.BitLen() {
+		case 2048:
+			return keyTypeRSA2048
+		case 3072:
+			return keyTypeRSA3072
+		case 4096:
+			return keyTypeRSA4096
+		}
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return keyTypeECDSAP256
+		case elliptic.P384():
+			return keyTypeECDSAP384
+		}
+	}
+	return ""
+}
+
+// reusableKey returns the private key already in the slot if the secret has
+// reuse_key set, the key is of the slot's key type, it's not older than
+// max_key_age, and the cert being replaced wasn't revoked. It also returns when
+// the key was created, which is the zero time if lekube didn't record it.
+func reusableKey(tlsSec *tlsSecret, secConf *secretConf, slot certSlot) (crypto.Signer, time.Time) {
+	if !secConf.ReuseKey || tlsSec == nil {
+		return nil, time.Time{}
+	}
+	// A revoked cert's key may have been compromised, and CAs refuse to
+	// issue for keys revoked for keyCompromise anyway.
+	if cert := tlsSec.slotCert(slot); cert != nil && (wasRevoked(tlsSec, slot, cert) || secConf.shouldRevoke(cert)) {
+		log.Printf("cert with serial %x in %s in secret %s was revoked, generating a new private key to replace it", cert.SerialNumber, slot.CertDataKey, secConf.FullName())
+		return nil, time.Time{}
+	}
+	key, err := parsePrivateKey(tlsSec.Data[slot.KeyDataKey])
+	if err != nil {
+		log.Printf("unable to reuse %s in secret %s, generating a new one: %s", slot.KeyDataKey, secConf.FullName(), err)
+		return nil, time.Time{}
+	}
+	if kt := publicKeyType(key.Public()); kt != slot.KeyType {
+		log.Printf("%s in secret %s has key type %#v but %#v was requested, generating a new one", slot.KeyDataKey, secConf.FullName(), kt, slot.KeyType)
+		return nil, time.Time{}
+	}
+	createdAt := keyCreatedAt(tlsSec.Secret, slot)
+	if keyTooOld(secConf, createdAt) {
+		log.Printf("%s in secret %s was created at %s, older than max_key_age of %s, generating a new one", slot.KeyDataKey, secConf.FullName(), createdAt, time.Duration(secConf.MaxKeyAge))
+		return nil, time.Time{}
+	}
+	return key, createdAt
+}
+
+// keyTooOld returns true if the secret has a max_key_age and the key created
+// at createdAt is older than it. A key with an unknown creation time is
+// treated as too old.
+func keyTooOld(secConf *secretConf, createdAt time.Time) bool {
+	if secConf.MaxKeyAge <= 0 {
+		return false
+	}
+	return createdAt.IsZero() || time.Since(createdAt) >= time.Duration(secConf.MaxKeyAge)
+}
+
+// keyCreatedAt returns the time recorded in the secret's key-created-at
+// annotation for the slot, or the zero time if there isn't a valid one.
+func keyCreatedAt(sec *kubeapi.Secret, slot certSlot) time.Time {
+	t, err := time.Parse(time.RFC3339, sec.Annotations[slot.keyCreatedAtAnnotation()])
+	if err != nil {
+		return time.Time{}
 	}
+	return t
 }
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"golang.org/x/crypto/acme"
+)
+
+// This file fills in the parts of the ACME protocol added after RFC 8555 that
+// x/crypto/acme doesn't support, like the "replaces" field in new-order
+// requests, the renewalInfo directory endpoint, and certificate profiles.
+
+// directoryExtras are the fields of the ACME directory that acme.Directory
+// doesn't have.
+type directoryExtras struct {
+	RenewalInfo string `json:"renewalInfo"`
+	Meta        struct {
+		// Profiles maps the names of the certificate profiles the CA offers
+		// to their descriptions.
+		Profiles map[string]string `json:"profiles"`
+	} `json:"meta"`
+}
+
+// DiscoverExtras fetches the ACME directory and returns the fields that
+// acme.Directory leaves out.
+func (lac *limitedACMEClient) DiscoverExtras(ctx context.Context) (directoryExtras, error) {
+	extras := directoryExtras{}
+	if err := lac.limit.Wait(ctx); err != nil {
+		return extras, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", lac.cl.DirectoryURL, nil)
+	if err != nil {
+		return extras, err
+	}
+	res, err := lac.httpClient().Do(req)
+	if err != nil {
+		return extras, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return extras, responseProblem(res)
+	}
+	err = json.NewDecoder(res.Body).Decode(&extras)
+	if err != nil {
+		return extras, fmt.Errorf("unable to parse ACME directory: %s", err)
+	}
+	return extras, nil
+}
+
+// orderExtras are the new-order request fields that acme.Client's
+// AuthorizeOrder can't send.
+type orderExtras struct {
+	// Replaces is the ARI certificate ID of the cert the order is renewing.
+	Replaces string
+	// Profile is the name of the certificate profile the CA should issue
+	// the cert under.
+	Profile string
+}
+
+// AuthorizeOrderWithExtras is AuthorizeOrder, but able to set the fields in
+// orderExtras. If none of them are set, it calls acme.Client's AuthorizeOrder.
+func (lac *limitedACMEClient) AuthorizeOrderWithExtras(ctx context.Context, ids []acme.AuthzID, extras orderExtras) (*acme.Order, error) {
+	if extras == (orderExtras{}) {
+		return lac.AuthorizeOrder(ctx, ids)
+	}
+	dir, err := lac.cl.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	type wireAuthzID struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+	req := struct {
+		Identifiers []wireAuthzID `json:"identifiers"`
+		Replaces    string        `json:"replaces,omitempty"`
+		Profile     string        `json:"profile,omitempty"`
+	}{
+		Replaces: extras.Replaces,
+		Profile:  extras.Profile,
+	}
+	for _, id := range ids {
+		req.Identifiers = append(req.Identifiers, wireAuthzID{Type: id.Type, Value: id.Value})
+	}
+	res, err := lac.postJWS(ctx, dir.OrderURL, req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("new-order request to %s returned unexpected status code %d", dir.OrderURL, res.StatusCode)
+	}
+	return responseOrder(res)
+}
+
+// postJWS sends payload to url signed with the account key in the way RFC 8555
+// requires. It returns an *acme.Error if the CA responds with an error.
+func (lac *limitedACMEClient) postJWS(ctx context.Context, url string, payload interface{}) (*http.Response, error) {
+	dir, err := lac.cl.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; ; attempt++ {
+		if err := lac.limit.Wait(ctx); err != nil {
+			return nil, err
+		}
+		nonce, err := lac.fetchNonce(ctx, dir.NonceURL)
+		if err != nil {
+			return nil, err
+		}
+		body, err := signJWS(lac.cl.Key, string(lac.cl.KID), nonce, url, b)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/jose+json")
+		res, err := lac.httpClient().Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode < 400 {
+			return res, nil
+		}
+		perr := responseProblem(res)
+		res.Body.Close()
+		// A bad nonce is the one error RFC 8555 says clients should retry
+		// immediately.
+		if attempt == 0 && strings.HasSuffix(strings.ToLower(perr.ProblemType), ":badnonce") {
+			continue
+		}
+		return nil, perr
+	}
+}
+
+func (lac *limitedACMEClient) fetchNonce(ctx context.Context, nonceURL string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", nonceURL, nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := lac.httpClient().Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to fetch nonce: %s", err)
+	}
+	res.Body.Close()
+	nonce := res.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", fmt.Errorf("no Replay-Nonce header in response from %s", nonceURL)
+	}
+	return nonce, nil
+}
+
+func (lac *limitedACMEClient) httpClient() *http.Client {
+	if lac.cl.HTTPClient != nil {
+		return lac.cl.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+type staticNonce string
+
+func (n staticNonce) Nonce() (string, error) { return string(n), nil }
+
+func signJWS(key crypto.Signer, kid, nonce, url string, payload []byte) ([]byte, error) {
+	var alg jose.SignatureAlgorithm
+	switch k := key.Public().(type) {
+	case *rsa.PublicKey:
+		alg = jose.RS256
+	case *ecdsa.PublicKey:
+		switch k.Curve.Params().BitSize {
+		case 256:
+			alg = jose.ES256
+		case 384:
+			alg = jose.ES384
+		default:
+			return nil, fmt.Errorf("unsupported ECDSA curve %s for account key", k.Curve.Params().Name)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported account key type %T", k)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, &jose.SignerOptions{
+		NonceSource: staticNonce(nonce),
+		ExtraHeaders: map[jose.HeaderKey]interface{}{
+			"kid": kid,
+			"url": url,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	sig, err := signer.Sign(payload)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(sig.FullSerialize()), nil
+}
+
+// responseProblem parses an RFC 7807 problem document out of an error response
+// from the CA.
+func responseProblem(res *http.Response) *acme.Error {
+	b, _ := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	var v struct {
+		Type        string
+		Detail      string
+		Instance    string
+		Subproblems []acme.Subproblem
+	}
+	err := json.Unmarshal(b, &v)
+	if err != nil {
+		v.Detail = string(b)
+		if v.Detail == "" {
+			v.Detail = res.Status
+		}
+	}
+	return &acme.Error{
+		StatusCode:  res.StatusCode,
+		ProblemType: v.Type,
+		Detail:      v.Detail,
+		Instance:    v.Instance,
+		Header:      res.Header,
+		Subproblems: v.Subproblems,
+	}
+}
+
+func responseOrder(res *http.Response) (*acme.Order, error) {
+	var v struct {
+		Status         string
+		Expires        time.Time
+		Identifiers    []acme.AuthzID
+		NotBefore      time.Time
+		NotAfter       time.Time
+		Error          *struct{ Type, Detail string }
+		Authorizations []string
+		Finalize       string
+		Certificate    string
+	}
+	if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
+		return nil, fmt.Errorf("unable to parse order: %s", err)
+	}
+	o := &acme.Order{
+		URI:         res.Header.Get("Location"),
+		Status:      v.Status,
+		Expires:     v.Expires,
+		Identifiers: v.Identifiers,
+		NotBefore:   v.NotBefore,
+		NotAfter:    v.NotAfter,
+		AuthzURLs:   v.Authorizations,
+		FinalizeURL: v.Finalize,
+		CertURL:     v.Certificate,
+	}
+	if v.Error != nil {
+		o.Error = &acme.Error{ProblemType: v.Error.Type, Detail: v.Error.Detail}
+	}
+	return o, nil
+}
@@ -1,22 +1,26 @@
 package main
 
 import (
-	"crypto"
-	"crypto/rsa"
-	"encoding/base64"
+	"crypto/tls"
+	"fmt"
 	"log"
 	"net/http"
+	"slices"
 	"strings"
 	"sync"
 
-	jose "github.com/go-jose/go-jose/v4"
+	"golang.org/x/crypto/acme"
 )
 
 type leResponder struct {
-	accountKeyThumbprint string // raw base64url encoded thumbprint
-
 	sync.Mutex
+	// bodies are the http-01 key authorizations keyed by their tokens. They
+	// aren't all made with the same account key, since the registrations
+	// at each CA may have their own.
 	bodies map[string]responseInfo
+	// alpnCerts are the tls-alpn-01 challenge certs keyed by the domain
+	// they're for.
+	alpnCerts map[string]*tls.Certificate
 }
 
 type responseInfo struct {
@@ -24,18 +28,11 @@ type responseInfo struct {
 	domain string
 }
 
-func newLEResponser(accountPubKey *rsa.PublicKey) (*leResponder, error) {
-	k := jose.JSONWebKey{Key: accountPubKey}
-	thumbprint, err := k.Thumbprint(crypto.SHA256)
-	if err != nil {
-		return nil, err
-	}
-	thumbprintB64 := base64.RawURLEncoding.EncodeToString(thumbprint)
-	lr := &leResponder{
-		accountKeyThumbprint: thumbprintB64,
-		bodies:               make(map[string]responseInfo),
+func newLEResponser() *leResponder {
+	return &leResponder{
+		bodies:    make(map[string]responseInfo),
+		alpnCerts: make(map[string]*tls.Certificate),
 	}
-	return lr, nil
 }
 
 const acmePath = "/.well-known/acme-challenge/"
@@ -68,15 +65,58 @@ func (lr *leResponder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Write(info.body)
 }
 
-func (lr *leResponder) AddAuthorization(domain, token string) {
-	ka := token + "." + lr.accountKeyThumbprint
+// AddAuthorization serves the key authorization, made with the key of the
+// account the challenge is for, as the http-01 challenge response for the
+// token.
+func (lr *leResponder) AddAuthorization(domain, token, keyAuth string) {
+	lr.Lock()
+	defer lr.Unlock()
+	lr.bodies[token] = responseInfo{body: []byte(keyAuth), domain: domain}
+}
+
+// RemoveAuthorization stops the http-01 challenge response for the token from
+// being served.
+func (lr *leResponder) RemoveAuthorization(token string) {
+	lr.Lock()
+	defer lr.Unlock()
+	delete(lr.bodies, token)
+}
+
+// AddTLSALPNCert adds the tls-alpn-01 challenge cert to serve to connections
+// for the domain that negotiate the acme-tls/1 protocol.
+func (lr *leResponder) AddTLSALPNCert(domain string, cert *tls.Certificate) {
 	lr.Lock()
 	defer lr.Unlock()
-	lr.bodies[token] = responseInfo{body: []byte(ka), domain: domain}
+	lr.alpnCerts[strings.ToLower(domain)] = cert
 }
 
-func (lr *leResponder) Reset() {
+// RemoveTLSALPNCert stops the domain's tls-alpn-01 challenge cert from being
+// served, unless another order has since replaced it with its own.
+func (lr *leResponder) RemoveTLSALPNCert(domain string, cert *tls.Certificate) {
 	lr.Lock()
 	defer lr.Unlock()
-	lr.bodies = make(map[string]responseInfo)
+	domain = strings.ToLower(domain)
+	if lr.alpnCerts[domain] == cert {
+		delete(lr.alpnCerts, domain)
+	}
+}
+
+// GetCertificate returns a tls.Config.GetCertificate hook that serves the
+// tls-alpn-01 challenge certs to the CA's validation requests, and fallback to
+// everyone else.
+func (lr *leResponder) GetCertificate(fallback *tls.Certificate) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if !slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+			return fallback, nil
+		}
+		lr.Lock()
+		cert, ok := lr.alpnCerts[strings.ToLower(hello.ServerName)]
+		lr.Unlock()
+		if !ok {
+			log.Printf("responder received tls-alpn-01 request for unknown domain %#v", hello.ServerName)
+			return nil, fmt.Errorf("no tls-alpn-01 challenge cert for %#v", hello.ServerName)
+		}
+		log.Printf("responder received tls-alpn-01 request for known domain %s", hello.ServerName)
+		return cert, nil
+	}
 }